@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/keymgr"
+)
+
+// httpService serves HTTP requests on a dedicated listener
+type httpService struct {
+	name     string
+	listener net.Listener
+	server   *http.Server
+}
+
+// listenHTTP returns an httpService listening on addr
+func listenHTTP(name, addr string, handler http.Handler) (s *httpService, err error) {
+	s = &httpService{
+		name: name,
+		server: &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	s.listener, err = net.Listen("tcp", addr)
+	return
+}
+
+// serve handles requests until the server is closed
+func (s *httpService) serve() {
+	log.Infof("%s listening on %s", s.name, s.listener.Addr())
+	err := s.server.Serve(s.listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Warnf("%s failed: %s", s.name, err)
+	}
+}
+
+// close stops the server
+func (s *httpService) close() error {
+	return s.server.Close()
+}
+
+// adminServer provides a read-only JSON API describing the state of a
+// running remailer.  It's intended for the operator so, by default, it only
+// listens on localhost.
+type adminServer struct {
+	secret  *keymgr.Secring
+	started time.Time
+}
+
+// poolSize describes the files in the pool with a given prefix
+type poolSize struct {
+	Type     string `json:"type"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// keyState describes a secret key, without revealing it
+type keyState struct {
+	Keyid      string    `json:"keyid"`
+	ValidFrom  time.Time `json:"valid_from"`
+	ValidUntil time.Time `json:"valid_until"`
+	State      string    `json:"state"`
+}
+
+// secringState summarises the secret keyring
+type secringState struct {
+	Active   int        `json:"active"`
+	Expiring int        `json:"expiring"`
+	Expired  int        `json:"expired"`
+	Keys     []keyState `json:"keys"`
+}
+
+// pubringState describes the freshness of the public keyring and stats
+type pubringState struct {
+	Keys           int       `json:"keys"`
+	KeysImported   time.Time `json:"keys_imported"`
+	HaveStats      bool      `json:"have_stats"`
+	StatsImported  time.Time `json:"stats_imported"`
+	StatsGenerated time.Time `json:"stats_generated"`
+	StatsStale     bool      `json:"stats_stale"`
+}
+
+// newAdminServer returns an adminServer reporting on secret
+func newAdminServer(secret *keymgr.Secring) *adminServer {
+	return &adminServer{
+		secret:  secret,
+		started: time.Now(),
+	}
+}
+
+// handler returns the API's request router
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", a.health)
+	mux.HandleFunc("/pool", getJSON(a.pool))
+	mux.HandleFunc("/stats", getJSON(a.stats))
+	mux.HandleFunc("/secring", getJSON(a.secring))
+	mux.HandleFunc("/pubring", getJSON(a.pubring))
+	mux.HandleFunc("/db", getJSON(a.db))
+	return mux
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// getJSON returns a handler that responds to GET requests with the JSON
+// representation of the value returned by f.
+func getJSON(f func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+				"error": "method not allowed",
+			})
+			return
+		}
+		v, err := f()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// health responds with 200 if the remailer can access its pool, otherwise
+// 503.  It's suitable for liveness checks.
+func (a *adminServer) health(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(a.started).Seconds()),
+	}
+	code := http.StatusOK
+	if _, err := ioutil.ReadDir(cfg.Files.Pooldir); err != nil {
+		status["status"] = "unavailable"
+		status["error"] = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// poolSizes returns the number and size of pool files, keyed by prefix
+func poolSizes() (sizes map[string]*poolSize, err error) {
+	sizes = make(map[string]*poolSize)
+	for prefix, kind := range poolFileTypes {
+		sizes[prefix] = &poolSize{Type: kind}
+	}
+	files, err := ioutil.ReadDir(cfg.Files.Pooldir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if s, known := sizes[f.Name()[:1]]; known {
+			s.Messages++
+			s.Bytes += f.Size()
+		}
+	}
+	return
+}
+
+func (a *adminServer) pool() (interface{}, error) {
+	return poolSizes()
+}
+
+func (a *adminServer) stats() (interface{}, error) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	return stats.counters(), nil
+}
+
+func (a *adminServer) secring() (interface{}, error) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	s := secringState{Keys: []keyState{}}
+	for _, k := range a.secret.Keys() {
+		switch k.State {
+		case keymgr.KeyActive:
+			s.Active++
+		case keymgr.KeyExpiring:
+			s.Expiring++
+		case keymgr.KeyExpired:
+			s.Expired++
+		}
+		s.Keys = append(s.Keys, keyState{
+			Keyid:      k.Keyid,
+			ValidFrom:  k.From,
+			ValidUntil: k.Until,
+			State:      k.State,
+		})
+	}
+	return s, nil
+}
+
+func (a *adminServer) pubring() (interface{}, error) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	return pubringState{
+		Keys:           Pubring.Count(),
+		KeysImported:   Pubring.KeysImported(),
+		HaveStats:      Pubring.HaveStats(),
+		StatsImported:  Pubring.StatsImported(),
+		StatsGenerated: Pubring.StatsGenerated(),
+		StatsStale:     Pubring.StatsStale(cfg.Stats.StaleHrs),
+	}, nil
+}
+
+func (a *adminServer) db() (interface{}, error) {
+	return map[string]int{
+		"id_log":   IDDb.Count(),
+		"chunk_db": ChunkDb.Count(),
+	}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/crooks/yamn/idlog"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+// testAdminServer returns an admin API backed by temporary keyrings and DBs
+func testAdminServer(t *testing.T) *httptest.Server {
+	testPoolDirs(t)
+	dir := t.TempDir()
+	Pubring = keymgr.NewPubring(
+		path.Join(dir, "pubring.mix"),
+		path.Join(dir, "mlist2.txt"),
+	)
+	secret := keymgr.NewSecring(
+		path.Join(dir, "secring.mix"),
+		path.Join(dir, "key.txt"),
+	)
+	secret.SetValidity(14, 28)
+	pub, sec := packet.GenerateKey()
+	secret.Insert(pub, sec)
+	IDDb = idlog.NewIDLog(path.Join(dir, "idlog"), 1)
+	ChunkDb = OpenChunk(path.Join(dir, "chunkdb"))
+	t.Cleanup(func() {
+		IDDb.Close()
+		ChunkDb.Close()
+	})
+	a := &adminServer{secret: secret}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getAdmin requests an API endpoint and decodes the JSON response into v
+func getAdmin(t *testing.T, srv *httptest.Server, endpoint string, v interface{}) int {
+	resp, err := http.Get(srv.URL + endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Unexpected Content-Type: %s", endpoint, ct)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("%s: %s", endpoint, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	srv := testAdminServer(t)
+	for _, name := range []string{"m1", "m2", "i1"} {
+		err := os.WriteFile(path.Join(cfg.Files.Pooldir, name), []byte("foo"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var health map[string]interface{}
+	if code := getAdmin(t, srv, "/health", &health); code != http.StatusOK {
+		t.Errorf("Health: Expected=200, Got=%d", code)
+	}
+
+	var pool map[string]poolSize
+	getAdmin(t, srv, "/pool", &pool)
+	if pool["m"].Messages != 2 || pool["m"].Bytes != 6 {
+		t.Errorf("Unexpected outbound pool size: %+v", pool["m"])
+	}
+	if pool["i"].Messages != 1 || pool["p"].Messages != 0 {
+		t.Errorf("Unexpected pool sizes: %+v", pool)
+	}
+
+	var secring secringState
+	getAdmin(t, srv, "/secring", &secring)
+	if secring.Active != 1 || len(secring.Keys) != 1 {
+		t.Errorf("Expected one active key, got %+v", secring)
+	}
+
+	var counters map[string]int
+	getAdmin(t, srv, "/stats", &counters)
+	if _, ok := counters["in_mail"]; !ok {
+		t.Error("Stats don't contain in_mail")
+	}
+
+	var db map[string]int
+	getAdmin(t, srv, "/db", &db)
+	if db["id_log"] != 0 || db["chunk_db"] != 0 {
+		t.Errorf("Expected empty DBs, got %v", db)
+	}
+}
+
+func TestAdminAPIHealthFailure(t *testing.T) {
+	srv := testAdminServer(t)
+	cfg.Files.Pooldir = path.Join(t.TempDir(), "missing")
+	var health map[string]interface{}
+	code := getAdmin(t, srv, "/health", &health)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected=503, Got=%d", code)
+	}
+}
+
+func TestAdminAPIMethod(t *testing.T) {
+	srv := testAdminServer(t)
+	resp, err := http.Post(srv.URL+"/stats", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected=405, Got=%d", resp.StatusCode)
+	}
+}
@@ -5,11 +5,18 @@ package main
 import (
 	"errors"
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/Masterminds/log-go"
-	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+var (
+	errChainLength     = errors.New("chain too long")
+	errNoCandidates    = errors.New("no remailers available to build random chain link")
+	errUnknownRemailer = errors.New("unknown remailer")
+	errNeedStats       = errors.New("cannot use random remailers without stats")
 )
 
 // distanceCriteria enforces user-defined minimal distance criteria
@@ -24,8 +31,104 @@ func distanceCriteria(addresses, dist []string) (c []string) {
 	return
 }
 
-// makeChain takes a chain string and constructs a valid remailer chain
-func makeChain(inChain []string) (outChain []string, err error) {
+// importFamilies reads the declared remailer families.  Failure isn't fatal as
+// families only constrain chain construction.
+func importFamilies() {
+	err := Pubring.ImportFamilies(cfg.Files.Families)
+	if err != nil {
+		log.Warnf("Unable to read remailer families: %s", err)
+	}
+}
+
+// domain returns the lowercase email domain of an address
+func domain(addy string) string {
+	return strings.ToLower(addy[strings.LastIndex(addy, "@")+1:])
+}
+
+// diversityCriteria excludes remailers in the same declared family as any of
+// the other hops in the chain.  If unique domains are configured, remailers
+// sharing an email domain with another hop are also excluded.
+func diversityCriteria(addresses, hops []string) (c []string) {
+	for _, addy := range addresses {
+		related := false
+		for _, hop := range hops {
+			if Pubring.Related(addy, hop) ||
+				(cfg.Stats.UniqueDomains && domain(addy) == domain(hop)) {
+				related = true
+				break
+			}
+		}
+		if related {
+			continue
+		}
+		c = append(c, addy)
+	}
+	return
+}
+
+// knownHops returns the addresses of every hop in the chain that's either
+// already selected or user-specified.
+func knownHops(inChain, outChain []string) (hops []string) {
+	hops = append(hops, outChain...)
+	for _, hop := range inChain {
+		if isRandom(hop) {
+			continue
+		}
+		remailer, err := Pubring.Get(hop)
+		if err == nil {
+			hops = append(hops, remailer.Address)
+		}
+	}
+	return
+}
+
+// brokenCriteria excludes remailers that would form a known broken chain with
+// the previous or next hop.  Either hop may be empty if it's not yet known.
+func brokenCriteria(addresses []string, prev, next string) (c []string) {
+	for _, addy := range addresses {
+		if prev != "" && Pubring.Broken(prev, addy) {
+			continue
+		}
+		if next != "" && Pubring.Broken(addy, next) {
+			continue
+		}
+		c = append(c, addy)
+	}
+	return
+}
+
+// adjacentHops returns the addresses of the hops either side of the next hop
+// to be selected.  Chains are built from the exit backwards so the next hop is
+// already known but the previous hop is only known if it's user-specified.
+func adjacentHops(inChain, outChain []string) (prev, next string) {
+	if len(outChain) > 0 {
+		next = outChain[0]
+	}
+	if len(inChain) > 0 && !isRandom(inChain[len(inChain)-1]) {
+		remailer, err := Pubring.Get(inChain[len(inChain)-1])
+		if err == nil {
+			prev = remailer.Address
+		}
+	}
+	return
+}
+
+// middleCriteria excludes remailers that aren't Middlemen
+func middleCriteria(addresses []string) (c []string) {
+	for _, addy := range addresses {
+		remailer, err := Pubring.Get(addy)
+		if err != nil || !remailer.Middle() {
+			continue
+		}
+		c = append(c, addy)
+	}
+	return
+}
+
+// makeChain takes a chain specification and constructs a valid remailer chain
+func makeChain(spec chainSpec) (outChain []string, err error) {
+	// Take a copy of the hops as they're consumed during construction
+	inChain := append([]string(nil), spec.hops...)
 	// Test if stats file has been modified since last imported
 	if Pubring.StatRefresh() {
 		// Try and import the modified stats file
@@ -45,19 +148,29 @@ func makeChain(inChain []string) (outChain []string, err error) {
 		)
 	}
 	// If the chain contains a random remailer, we're going to need stats
-	if !Pubring.HaveStats() && IsMemberStr("*", inChain) {
-		err = errors.New("cannot use random remailers without stats")
-		log.Warn(err)
+	randoms := 0
+	for _, hop := range inChain {
+		if isRandom(hop) {
+			randoms++
+		}
+	}
+	if !Pubring.HaveStats() && randoms > 0 {
+		err = errNeedStats
 		return
 	}
 	dist := cfg.Stats.Distance
-	if dist > maxChainLength {
-		dist = maxChainLength
+	if dist > packet.MaxChainLength {
+		dist = packet.MaxChainLength
 	}
 	var candidates []string // Candidate remailers for each hop
-	if len(inChain) > maxChainLength {
-		fmt.Fprintf(os.Stderr, "%d hops exceeds maximum of %d\n", len(inChain), maxChainLength)
-		os.Exit(1)
+	if len(inChain) > packet.MaxChainLength {
+		err = fmt.Errorf(
+			"%w: %d hops exceeds maximum of %d",
+			errChainLength,
+			len(inChain),
+			packet.MaxChainLength,
+		)
+		return
 	}
 	// If dist is greater than the actual chain length, all hops will be unique.
 	if dist > len(inChain) {
@@ -72,8 +185,10 @@ func makeChain(inChain []string) (outChain []string, err error) {
 	var hop string
 	for {
 		hop = popstr(&inChain)
-		if hop == "*" {
-			// Random remailer selection
+		if isRandom(hop) {
+			// Random remailer selection.  The last hop must always be an
+			// Exit.
+			exit := len(outChain) == 0 || hop == randomExit
 			if len(outChain) == 0 {
 				// Construct a list of suitable exit remailers
 				candidates = Pubring.Candidates(
@@ -87,21 +202,47 @@ func makeChain(inChain []string) (outChain []string, err error) {
 					cfg.Stats.Minlat,
 					cfg.Stats.Maxlat,
 					cfg.Stats.Minrel,
-					false)
+					exit)
 			}
-			if len(candidates) > 0 {
-				// Apply distance criteria
-				candidates = distanceCriteria(candidates, distance)
-				if len(candidates) == 0 {
-					log.Warn("Insufficient remailers to comply with distance criteria")
+			if hop == randomMiddle {
+				candidates = middleCriteria(candidates)
+			}
+			// criteria removes user-excluded remailers and applies the
+			// distance, diversity and broken chain criteria.  Unlike
+			// latency and uptime, these are never relaxed.
+			criteria := func(candidates []string) []string {
+				candidates = distanceCriteria(candidates, spec.exclude)
+				if len(candidates) > 0 {
+					// Apply distance criteria
+					candidates = distanceCriteria(candidates, distance)
+					if len(candidates) == 0 {
+						log.Warn("Insufficient remailers to comply with distance criteria")
+					}
+				} else {
+					log.Warn("No candidate remailers match selection criteria")
 				}
-			} else {
-				log.Warn("No candidate remailers match selection criteria")
+				if len(candidates) > 0 {
+					// Apply family and domain diversity criteria
+					candidates = diversityCriteria(candidates, knownHops(inChain, outChain))
+					if len(candidates) == 0 {
+						log.Warn("Insufficient remailers to comply with diversity criteria")
+					}
+				}
+				if len(candidates) > 0 {
+					// Avoid chains the stats report as broken
+					prev, next := adjacentHops(inChain, outChain)
+					candidates = brokenCriteria(candidates, prev, next)
+					if len(candidates) == 0 {
+						log.Warn("Insufficient remailers to avoid broken chains")
+					}
+				}
+				return candidates
 			}
+			candidates = criteria(candidates)
 
 			if len(candidates) == 0 && flag.Remailer {
 				log.Warn("Relaxing latency and uptime criteria to build chain")
-				if len(outChain) == 0 {
+				if exit {
 					// Construct a list of suitable exit remailers
 					log.Info("Constructing relaxed list of Exit remailers")
 					candidates = Pubring.Candidates(0, 480, 0, true)
@@ -113,17 +254,18 @@ func makeChain(inChain []string) (outChain []string, err error) {
 					// Construct a list of all suitable remailers
 					log.Info("Constructing relaxed list of candidate remailers")
 					candidates = Pubring.Candidates(0, 480, 0, false)
+					if hop == randomMiddle {
+						candidates = middleCriteria(candidates)
+					}
 					log.Infof(
 						"Discovered %d candidate Remailers matching relaxed criteria",
 						len(candidates),
 					)
 				}
-			} else if len(candidates) == 0 {
-				// Insufficient remailers meet criteria and we're a client, so die.
-				os.Exit(1)
+				candidates = criteria(candidates)
 			}
 			if len(candidates) == 0 {
-				err = errors.New("no remailers available to build random chain link")
+				err = errNoCandidates
 				return
 			} else if len(candidates) == 1 {
 				hop = candidates[0]
@@ -133,15 +275,30 @@ func makeChain(inChain []string) (outChain []string, err error) {
 					hop,
 				)
 			} else {
-				hop = candidates[crandom.RandomInt(len(candidates))]
+				hop, err = Pubring.Select(candidates, cfg.Stats.Selection)
+				if err != nil {
+					return
+				}
 			}
 		} else {
 			var remailer keymgr.Remailer
 			remailer, err = Pubring.Get(hop)
 			if err != nil {
+				err = fmt.Errorf("%w: %s", errUnknownRemailer, err)
 				return
 			}
 			hop = remailer.Address
+			if len(outChain) > 0 && Pubring.Broken(hop, outChain[0]) {
+				if cfg.Stats.StrictBroken {
+					err = fmt.Errorf(
+						"%s -> %s is a known broken chain",
+						hop,
+						outChain[0],
+					)
+					return
+				}
+				log.Warnf("%s -> %s is a known broken chain", hop, outChain[0])
+			}
 		}
 		// Extend outChain by 1 element
 		outChain = outChain[0 : len(outChain)+1]
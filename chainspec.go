@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Random hop specifiers.  Any suitable remailer can be selected for a random
+// hop unless it's qualified to require an Exit or a Middleman.
+const (
+	randomHop    = "*"
+	randomExit   = "*E"
+	randomMiddle = "*M"
+)
+
+var errEmptyChain = errors.New("chain contains no hops")
+
+// chainSpec is a parsed chain specification.  Hops are remailer addresses or
+// random hop specifiers.
+type chainSpec struct {
+	hops    []string // Addresses or random specifiers for each hop
+	exclude []string // Addresses that are never selected as random hops
+}
+
+// isRandom tests if a chain hop is a random hop specifier
+func isRandom(hop string) bool {
+	return strings.HasPrefix(hop, randomHop)
+}
+
+// randomChain returns a chainSpec of n unqualified random hops
+func randomChain(n int) (spec chainSpec) {
+	for i := 0; i < n; i++ {
+		spec.hops = append(spec.hops, randomHop)
+	}
+	return
+}
+
+// userChain parses the chain specified by the --chain flag or, in its
+// absence, the configured default chain.
+func userChain() (spec chainSpec, err error) {
+	if flag.Chain == "" {
+		return parseChain(cfg.Stats.Chain)
+	}
+	return parseChain(flag.Chain)
+}
+
+/*
+parseChain converts a comma-separated chain string into a chainSpec.  Each
+element of the chain can be:
+name or address - A specific remailer
+*               - A random remailer
+*E or *M        - A random Exit or Middleman remailer
+!name           - Exclude a remailer from random selection
+
+Alternatively, the whole chain can be @template, where template is the name
+of a chain defined in the chains section of the config.  Named remailers must
+exist in the Public Keyring.
+*/
+func parseChain(s string) (spec chainSpec, err error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "@") {
+		template, exists := cfg.Chains[s[1:]]
+		if !exists {
+			err = fmt.Errorf("%s: Unknown chain template", s[1:])
+			return
+		}
+		if strings.HasPrefix(strings.TrimSpace(template), "@") {
+			err = fmt.Errorf("%s: Chain templates cannot refer to other templates", s[1:])
+			return
+		}
+		s = template
+	}
+	for _, hop := range strings.Split(s, ",") {
+		hop = strings.TrimSpace(hop)
+		switch {
+		case hop == randomHop, hop == randomExit, hop == randomMiddle:
+			spec.hops = append(spec.hops, hop)
+		case isRandom(hop):
+			err = fmt.Errorf("%s: Unknown random hop specifier", hop)
+			return
+		case strings.HasPrefix(hop, "!"):
+			var addy string
+			addy, err = chainAddress(hop[1:])
+			if err != nil {
+				return
+			}
+			spec.exclude = append(spec.exclude, addy)
+		case hop == "":
+			err = fmt.Errorf("empty hop in chain: %s", s)
+			return
+		default:
+			var addy string
+			addy, err = chainAddress(hop)
+			if err != nil {
+				return
+			}
+			spec.hops = append(spec.hops, addy)
+		}
+	}
+	if len(spec.hops) == 0 {
+		err = errEmptyChain
+		return
+	}
+	if spec.hops[len(spec.hops)-1] == randomMiddle {
+		err = errors.New("the last hop in a chain must be an Exit remailer")
+		return
+	}
+	return
+}
+
+// chainAddress returns the address of a remailer referenced by name or
+// address in a chain
+func chainAddress(ref string) (addy string, err error) {
+	remailer, err := Pubring.Get(ref)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errUnknownRemailer, err)
+		return
+	}
+	addy = remailer.Address
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crooks/yamn/config"
+	"github.com/crooks/yamn/keymgr"
+)
+
+func TestParseChain(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Chains = map[string]string{
+		"paranoid": "*,*,*,*,*",
+		"loop":     "@paranoid",
+	}
+	Pubring = keymgr.NewPubring("", "")
+	Pubring.Put(keymgr.Remailer{Address: "a@domain.foo"})
+	Pubring.Put(keymgr.Remailer{Address: "b@domain.foo"})
+
+	spec, err := parseChain("!a@domain.foo, *M, *, b@domain.foo, *E")
+	if err != nil {
+		t.Fatalf("parseChain failed: %s", err)
+	}
+	expected := []string{"*M", "*", "b@domain.foo", "*E"}
+	if len(spec.hops) != len(expected) {
+		t.Fatalf("Expected hops %v, got %v", expected, spec.hops)
+	}
+	for n, hop := range expected {
+		if spec.hops[n] != hop {
+			t.Errorf("Hop %d: Expected %s, got %s", n, hop, spec.hops[n])
+		}
+	}
+	if len(spec.exclude) != 1 || spec.exclude[0] != "a@domain.foo" {
+		t.Errorf("Unexpected exclusions: %v", spec.exclude)
+	}
+
+	spec, err = parseChain("@paranoid")
+	if err != nil {
+		t.Fatalf("parseChain failed on template: %s", err)
+	}
+	if len(spec.hops) != 5 {
+		t.Errorf("Expected 5 hops from template, got %d", len(spec.hops))
+	}
+
+	invalid := []string{
+		"@unknown",
+		"@loop",
+		"*,c@domain.foo",
+		"*,!c@domain.foo",
+		"*X",
+		"*,,*",
+		"!a@domain.foo",
+		"*,*M",
+	}
+	for _, s := range invalid {
+		_, err = parseChain(s)
+		if err == nil {
+			t.Errorf("%s: Expected parseChain to fail", s)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -21,11 +22,22 @@ type Chunk struct {
 
 // OpenChunk opens a levelDB database file
 func OpenChunk(filename string) *Chunk {
-	levelDB, err := leveldb.OpenFile(filename, nil)
+	chunk, err := openChunk(filename)
 	if err != nil {
 		panic(err)
 	}
-	return &Chunk{db: levelDB}
+	return chunk
+}
+
+// openChunk is OpenChunk for callers that can tolerate the DB being
+// unavailable.  E.g. When it's locked by a running remailer.
+func openChunk(filename string) (chunk *Chunk, err error) {
+	levelDB, err := leveldb.OpenFile(filename, nil)
+	if err != nil {
+		return
+	}
+	chunk = &Chunk{db: levelDB}
+	return
 }
 
 // Close closes the levelDB
@@ -76,6 +88,16 @@ func (chunk *Chunk) Insert(messageid []byte, items []string) {
 	)
 }
 
+// Count returns the number of messages in the DB
+func (chunk *Chunk) Count() (count int) {
+	iter := chunk.db.NewIterator(nil, nil)
+	for iter.Next() {
+		count++
+	}
+	iter.Release()
+	return
+}
+
 // IsPopulated returns true if all elements of items are populated
 func IsPopulated(items []string) bool {
 	for _, n := range items {
@@ -110,28 +132,65 @@ func (chunk *Chunk) Housekeep() (ret, del int) {
 }
 
 // Assemble takes all the file chunks, assembles them in order and stores the
-// result back into the pool.
+// result back into the pool.  The chunks' internal headers are replaced by a
+// single set that holds the message until the latest of their release times.
 func (chunk *Chunk) Assemble(filename string, items []string) (err error) {
-	f, err := os.Create(filename)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	var content []byte
+	var release time.Time
+	assembled := new(bytes.Buffer)
 	for _, c := range items {
 		infile := path.Join(cfg.Files.Pooldir, c)
+		var content []byte
 		content, err = ioutil.ReadFile(infile)
 		if err != nil {
 			log.Warnf("Chunk assembler says: %s", err)
 			continue
 		}
-		f.Write(content)
+		var h poolHeader
+		h, content, err = splitPoolHeader(content)
+		if err != nil {
+			log.Warnf("%s: %s", c, err)
+		}
+		if h.release.After(release) {
+			release = h.release
+		}
+		assembled.Write(content)
 		err = os.Remove(infile)
 		if err != nil {
 			log.Warnf("Assembler chunk delete failed: %s", err)
 			continue
 		}
 	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	writeInternalHeader(f, newPoolHeader(release))
+	_, err = f.Write(assembled.Bytes())
+	return
+}
+
+// Files returns a description of the message each pooled chunk belongs to,
+// keyed by chunk filename.
+func (chunk *Chunk) Files() (files map[string]string) {
+	files = make(map[string]string)
+	iter := chunk.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		// Ignore the first item, it's the expiry date
+		items := strings.Split(string(iter.Value()), ",")[1:]
+		for n, filename := range items {
+			if filename == "" {
+				continue
+			}
+			files[filename] = fmt.Sprintf(
+				"MsgID=%x Chunk=%d/%d",
+				iter.Key(),
+				n+1,
+				len(items),
+			)
+		}
+	}
 	return
 }
 
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAssembleRelease(t *testing.T) {
+	testPoolDirs(t)
+	chunks := []string{
+		writePlainToPool([]byte("To: foo@bar.baz\n\nChunk1"), "p", time.Time{}),
+		writePlainToPool([]byte("Chunk2"), "p", time.Now().Add(2*time.Hour)),
+		writePlainToPool([]byte("Chunk3"), "p", time.Now().Add(time.Hour)),
+	}
+	filename := randPoolFilename("m")
+	chunkDB := &Chunk{}
+	err := chunkDB.Assemble(filename, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, h, err := readPoolFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message is held until the latest release time
+	if h.release.Before(time.Now().Add(time.Hour + time.Minute)) {
+		t.Errorf("Expected release in 2 hours, got %s", h.release)
+	}
+	body := new(bytes.Buffer)
+	body.ReadFrom(msg.Body)
+	if body.String() != "Chunk1Chunk2Chunk3" {
+		t.Errorf("Unexpected assembled body: %q", body.String())
+	}
+	for _, c := range chunks {
+		if _, err := os.Stat(path.Join(cfg.Files.Pooldir, c)); err == nil {
+			t.Errorf("Chunk %s wasn't removed", c)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -14,6 +15,7 @@ import (
 	"github.com/Masterminds/log-go"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
 	//"github.com/codahale/blake2"
 )
 
@@ -50,14 +52,16 @@ func readMessage(filename string) []byte {
 // mixprep fetches the plaintext and prepares it for mix encoding
 func mixprep() {
 	var err error
-	err = os.MkdirAll(cfg.Files.Pooldir, 0700)
-	if err != nil {
-		panic(err)
+	if !flag.Stdout {
+		err = os.MkdirAll(cfg.Files.Pooldir, 0700)
+		if err != nil {
+			panic(err)
+		}
 	}
 	// plain will contain the byte version of the plain text message
 	var plain []byte
 	// final is consistent across multiple copies so we define it early
-	final := newSlotFinal()
+	final := packet.NewFinal()
 	if len(flag.Args) == 0 {
 		//fmt.Println("Enter message, complete with headers.  Ctrl-D to finish")
 		plain, err = ioutil.ReadAll(os.Stdin)
@@ -75,55 +79,42 @@ func mixprep() {
 	}
 	// plainLen is the length of the plain byte message and can exceed
 	// the total body size of the payload.
-	plainLen := len(plain)
-	if plainLen == 0 {
+	if len(plain) == 0 {
 		fmt.Fprintln(os.Stderr, "No bytes in message")
 		os.Exit(1)
 	}
-
-	// Download stats URLs if the time is right
-	if cfg.Urls.Fetch {
-		// Retrieve Mlist2 and Pubring URLs
-		timedURLFetch(cfg.Urls.Pubring, cfg.Files.Pubring)
-		timedURLFetch(cfg.Urls.Mlist2, cfg.Files.Mlist2)
+	if flag.SURB != "" {
+		// Replies are sent to an Exit remailer that attaches them to
+		// the Reply Block.
+		plain, err = replyPayload(flag.SURB, plain)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		final.SetDeliveryMethod(packet.DeliverReply)
 	}
+	plainLen := len(plain)
 
-	// Create the Public Keyring
-	Pubring = keymgr.NewPubring(
-		cfg.Files.Pubring,
-		cfg.Files.Mlist2,
-	)
-	// Set the Use Expired flag to include remailers with expired keys as
-	// candidates.
-	if cfg.Stats.UseExpired {
-		Pubring.UseExpired()
-	}
-	err = Pubring.ImportPubring()
+	err = clientPubring()
 	if err != nil {
 		log.Warnf("Pubring import failed: %s", cfg.Files.Pubring)
 		return
 	}
 	// Read the chain from flag or config
-	var inChain []string
-	var inChainFunc []string
-	if flag.Chain == "" {
-		inChain = strings.Split(cfg.Stats.Chain, ",")
-	} else {
-		inChain = strings.Split(flag.Chain, ",")
-	}
-	if len(inChain) == 0 {
-		log.Fatal("empty input chain")
+	spec, err := userChain()
+	if err != nil {
+		log.Fatalf("Invalid chain: %s", err)
 	}
 	var cnum int // Chunk number
 	numc := int(math.Ceil(float64(plainLen) / float64(maxFragLength)))
-	final.setNumChunks(numc)
+	final.SetNumChunks(numc)
 	var exitnode string // Address of exit node (for multiple copy chains)
 	var gotExit bool    // Flag to indicate an exit node has been selected
 	var firstByte int   // First byte of message slice
 	var lastByte int    // Last byte of message slice
 	// Fragments loop begins here
 	for cnum = 1; cnum <= numc; cnum++ {
-		final.setChunkNum(cnum)
+		final.SetChunkNum(cnum)
 		// First byte of message fragment
 		firstByte = (cnum - 1) * maxFragLength
 		lastByte = firstByte + maxFragLength
@@ -145,17 +136,16 @@ func mixprep() {
 			if gotExit {
 				// Set the last node in the chain to the
 				// previously select exitnode
-				inChain[len(inChain)-1] = exitnode
+				spec.hops[len(spec.hops)-1] = exitnode
 			}
 			var chain []string
-			inChainFunc = append(inChain[:0:0], inChain...)
-			chain, err = makeChain(inChainFunc)
+			chain, err = makeChain(spec)
 			if err != nil {
-				log.Error(err)
-				os.Exit(0)
+				reportChainError(err)
+				os.Exit(1)
 			}
-			if len(chain) != len(inChain) {
-				err = fmt.Errorf("chain length mismatch: in=%d, out=%d", len(inChain), len(chain))
+			if len(chain) != len(spec.hops) {
+				err = fmt.Errorf("chain length mismatch: in=%d, out=%d", len(spec.hops), len(chain))
 				panic(err)
 			}
 			//fmt.Println(chain)
@@ -169,12 +159,17 @@ func mixprep() {
 			if flag.Client {
 				log.Infof("Chain: %s\n", strings.Join(chain, ","))
 			}
-			yamnMsg := encodeMsg(
+			var yamnMsg []byte
+			yamnMsg, err = encodeMsg(
 				plain[firstByte:lastByte],
 				chain,
-				*final,
+				final,
 			)
-			writeMessageToPool(sendTo, yamnMsg)
+			if err != nil {
+				reportChainError(err)
+				os.Exit(1)
+			}
+			clientOutput(sendTo, yamnMsg)
 		} // End of copies loop
 	} // End of fragments loop
 
@@ -184,109 +179,111 @@ func mixprep() {
 	}
 }
 
-// encodeMsg encodes a plaintext fragment into mixmaster format.
-func encodeMsg(
-	plain []byte,
-	chain []string,
-	final slotFinal) []byte {
-
-	var err error
-	var hop string
-	m := newEncMessage()
-	m.setChainLength(len(chain))
-	length := m.setPlainText(plain)
-	// Pop the exit remailer address from the chain
-	hop = popstr(&chain)
-	// Insert the plain message length into the Final Hop header.
+// reportChainError logs a failure to build or encode a chain, along with
+// advice on how to resolve it.
+func reportChainError(err error) {
+	log.Errorf("Unable to build chain: %s", err)
+	switch {
+	case errors.Is(err, errChainLength):
+		log.Errorf("Specify a chain of no more than %d hops", packet.MaxChainLength)
+	case errors.Is(err, errNoCandidates):
+		log.Error("Relax the latency and uptime criteria in the stats config")
+	case errors.Is(err, errUnknownRemailer):
+		log.Errorf("Check the remailer is listed in %s", cfg.Files.Pubring)
+	case errors.Is(err, errNeedStats):
+		log.Errorf("Random remailers require a stats file: %s", cfg.Files.Mlist2)
+	}
+}
 
-	final.setBodyBytes(length)
-	slotData := newSlotData()
-	// Identify this hop as Packet-Type 1 (Exit).
-	slotData.setExit()
-	// For exit hops, the AES key can be entirely random.
-	slotData.setAesKey(crandom.Randbytes(32))
-	// Override the random PacketID so that multi-copy messages all share a
-	// common Exit PacketID.
-	slotData.setPacketID(final.getPacketID())
-	// Encode the (final) Packet Info and store it in the Slot Data.
-	slotData.setPacketInfo(final.encode())
-	// Get KeyID and NaCl PK for the remailer we're enrypting to.
-	remailer, err := Pubring.Get(hop)
-	if err != nil {
-		log.Errorf(
-			"%s: Remailer unknown in public keyring\n",
-			hop,
-		)
-		os.Exit(1)
+// clientPubring creates the Public Keyring used by client functions.  If
+// required, the keyring and stats are first fetched from their URLs.
+func clientPubring() (err error) {
+	// Download stats URLs if the time is right
+	if cfg.Urls.Fetch {
+		// Retrieve Mlist2 and Pubring URLs
+		timedURLFetch(cfg.Urls.Pubring, cfg.Files.Pubring)
+		timedURLFetch(cfg.Urls.Mlist2, cfg.Files.Mlist2)
 	}
-	// Create a new Header.
-	header := newEncodeHeader()
-	// Tell the header function what KeyID and PK to NaCl encrypt with.
-	header.setRecipient(remailer.Keyid, remailer.PK)
-	log.Tracef(
-		"Encrypting Final Hop: Hop=%s, KeyID=%x",
-		hop,
-		remailer.Keyid,
+
+	// Create the Public Keyring
+	Pubring = keymgr.NewPubring(
+		cfg.Files.Pubring,
+		cfg.Files.Mlist2,
 	)
-	// Only the body needs to be encrypted during Exit encoding.  At all other
-	// hops, the entire header stack will also need encrypting.
-	m.encryptBody(slotData.aesKey, final.aesIV)
-	// Shift all the header down by headerBytes
-	m.shiftHeaders()
-	// We've already popped an entry from the Chain so were testing for
-	// length greater than zero rather than 1.
-	if len(chain) > 0 {
-		// Single hop chains don't require deterministic headers.  All
-		// longer chains do.
-		m.deterministic(0)
+	// Set the Use Expired flag to include remailers with expired keys as
+	// candidates.
+	if cfg.Stats.UseExpired {
+		Pubring.UseExpired()
 	}
-	// Set the Anti-tag hash in the slotData.
-	slotData.setTagHash(m.getAntiTag())
-	// Encode the slot data into Byte form.
-	slotDataBytes := slotData.encode()
-	// Encode the header and insert it into the payload.
-	m.insertHeader(header.encode(slotDataBytes))
-
-	// That concludes Exit hop compilation.  Now for intermediates.
+	err = Pubring.ImportPubring()
+	if err != nil {
+		return
+	}
+	importFamilies()
+	return
+}
 
-	interHops := m.getIntermediateHops()
-	for interHop := 0; interHop < interHops; interHop++ {
-		inter := newSlotIntermediate()
-		inter.setPartialIV(m.getPartialIV(interHop))
-		// hop still contains the previous iteration (or exit) address.
-		inter.setNextHop(hop)
-		// Pop another remailer from the left side of the Chain
-		hop = popstr(&chain)
-		// Create new Slot Data
-		slotData = newSlotData()
-		slotData.setAesKey(m.getKey(interHop))
-		slotData.setPacketInfo(inter.encode())
-		m.encryptAll(interHop)
-		m.shiftHeaders()
-		m.deterministic(interHop + 1)
-		slotData.setTagHash(m.getAntiTag())
-		slotDataBytes = slotData.encode()
-		header = newEncodeHeader()
-		remailer, err := Pubring.Get(hop)
+// resolveChain converts a chain of remailer names or addresses to public
+// keyring entries.
+func resolveChain(chain []string) (remailers []keymgr.Remailer, err error) {
+	remailers = make([]keymgr.Remailer, len(chain))
+	for n, hop := range chain {
+		remailers[n], err = Pubring.Get(hop)
 		if err != nil {
-			log.Errorf(
-				"%s: Remailer unknown in public keyring\n",
-				hop,
-			)
-			os.Exit(1)
+			err = fmt.Errorf("%w: %s", errUnknownRemailer, err)
+			return
 		}
-		header.setRecipient(remailer.Keyid, remailer.PK)
 		log.Tracef(
 			"Encrypting: Hop=%s, KeyID=%x",
 			hop,
-			remailer.Keyid,
+			remailers[n].Keyid,
 		)
-		m.insertHeader(header.encode(slotDataBytes))
 	}
-	if len(chain) != 0 {
-		panic("After encoding, chain was not empty.")
+	return
+}
+
+// encodeMsg encodes a plaintext fragment into mixmaster format.
+func encodeMsg(
+	plain []byte,
+	chain []string,
+	final *packet.Final,
+) (yamnMsg []byte, err error) {
+	// Resolve the chain of names or addresses to public keyring entries.
+	remailers, err := resolveChain(chain)
+	if err != nil {
+		return
+	}
+	encoder, err := packet.NewEncoder(remailers, final)
+	if err != nil {
+		return
+	}
+	log.Tracef("Encoding packet version %d", encoder.Version())
+	if cfg.Stats.HopDelay > 0 {
+		if encoder.Version() < 4 {
+			log.Warn("Chain doesn't support per-hop delays. Sending without them.")
+		} else {
+			err = encoder.SetDelays(hopDelays(len(remailers)))
+			if err != nil {
+				return
+			}
+		}
 	}
-	return m.getPayload()
+	yamnMsg, err = encoder.Encode(plain)
+	return
+}
+
+// hopDelays returns n exponentially distributed delays with a mean of
+// HopDelay minutes.  Each delay is capped at the packet's maximum.
+func hopDelays(n int) (delays []time.Duration) {
+	mean := float64(time.Duration(cfg.Stats.HopDelay) * time.Minute)
+	for i := 0; i < n; i++ {
+		d := time.Duration(crandom.ExpFloat64() * mean)
+		if d > packet.MaxDelay {
+			d = packet.MaxDelay
+		}
+		delays = append(delays, d)
+	}
+	return
 }
 
 func injectDummy() {
@@ -296,6 +293,7 @@ func injectDummy() {
 		cfg.Files.Mlist2,
 	)
 	Pubring.ImportPubring()
+	importFamilies()
 	dummy()
 }
 
@@ -329,27 +327,32 @@ func dummy() {
 	var err error
 	plainMsg := []byte("I hope Len approves")
 	// Make a single hop chain with a random node
-	var inChain []string
-	if flag.Chain == "" {
-		inChain = []string{"*", "*"}
-	} else {
-		inChain = strings.Split(flag.Chain, ",")
+	spec := randomChain(2)
+	if flag.Chain != "" {
+		spec, err = parseChain(flag.Chain)
+		if err != nil {
+			log.Warnf("Invalid dummy chain: %s", err)
+			return
+		}
 	}
-	final := newSlotFinal()
-	// Override the default delivery method (255 = Dummy)
-	final.setDeliveryMethod(255)
+	final := packet.NewFinal()
+	// Override the default delivery method
+	final.SetDeliveryMethod(packet.DeliverDummy)
 	var chain []string
-	chain, err = makeChain(inChain)
-	if len(chain) == 0 {
-		log.Warn("There are no known remailers. Unable to send dummy.")
+	chain, err = makeChain(spec)
+	if errors.Is(err, errNoCandidates) || errors.Is(err, errNeedStats) {
+		log.Warnf("There are no known remailers. Unable to send dummy: %s", err)
+		return
+	} else if err != nil {
+		log.Warnf("Dummy creation failed: %s", err)
 		return
 	}
 	sendTo := chain[0]
+	log.Tracef("Sending dummy through: %s.", strings.Join(chain, ","))
+	yamnMsg, err := encodeMsg(plainMsg, chain, final)
 	if err != nil {
-		log.Warnf("Dummy creation failed: %s", err)
+		log.Warnf("Dummy encoding failed: %s", err)
 		return
 	}
-	log.Tracef("Sending dummy through: %s.", strings.Join(chain, ","))
-	yamnMsg := encodeMsg(plainMsg, chain, *final)
-	writeMessageToPool(sendTo, yamnMsg)
+	clientOutput(sendTo, yamnMsg)
 }
@@ -20,18 +20,24 @@ type Config struct {
 	Files struct {
 		// Config is a special variable that returns the name of the active config file.
 		// If it's set in the config file, it will be ignored.
-		Config   string
-		Pubring  string `yaml:"pubring"`
-		Mlist2   string `yaml:"mlist2"`
-		Pubkey   string `yaml:"pubkey"`
-		Secring  string `yaml:"secring"`
-		Adminkey string `yaml:"adminkey"`
-		Help     string `yaml:"help"`
-		Pooldir  string `yaml:"pooldir"`
-		Maildir  string `yaml:"maildir"`
-		IDlog    string `yaml:"idlog"`
-		ChunkDB  string `yaml:"chunkdb"`
-		Logfile  string `yaml:"logfile"`
+		Config    string
+		Pubring   string `yaml:"pubring"`
+		Mlist2    string `yaml:"mlist2"`
+		Pubkey    string `yaml:"pubkey"`
+		Secring   string `yaml:"secring"`
+		Adminkey  string `yaml:"adminkey"`
+		Help      string `yaml:"help"`
+		Pooldir   string `yaml:"pooldir"`
+		Maildir   string `yaml:"maildir"`
+		IDlog     string `yaml:"idlog"`
+		ChunkDB   string `yaml:"chunkdb"`
+		Logfile   string `yaml:"logfile"`
+		SURBdir   string `yaml:"surbdir"`
+		PingDB    string `yaml:"pingdb"`
+		PingerDir string `yaml:"pingerdir"`
+		Keydir    string `yaml:"keydir"`
+		Families  string `yaml:"families"`
+		Deaddir   string `yaml:"deaddir"`
 	} `yaml:"files"`
 	Urls struct {
 		Fetch   bool   `yaml:"fetch"`
@@ -53,7 +59,27 @@ type Config struct {
 		OutboundName string `yaml:"outbound_name"`
 		OutboundAddy string `yaml:"outbound_addy"`
 		CustomFrom   bool   `yaml:"custom_from"`
+		// Connect to the SMTP relay using implicit TLS (SMTPS)
+		ImplicitTLS bool `yaml:"implicit_tls"`
+		// TLS policy for outbound SMTP: opportunistic, verify or require
+		TLSPolicy string `yaml:"tls_policy"`
+		// PEM file of CA certificates trusted for SMTP TLS verification
+		TLSCAFile string `yaml:"tls_ca_file"`
+		// Minimum TLS version for outbound SMTP: 1.0, 1.1, 1.2 or 1.3
+		TLSMinVersion string `yaml:"tls_min_version"`
+		// Pinned SPKI hashes (base64 SHA256), keyed by relay hostname
+		TLSPins map[string][]string `yaml:"tls_pins"`
+		// Concurrent workers delivering pool messages
+		Workers int `yaml:"workers"`
+		// Messages sent in a single SMTP session before it's closed
+		SessionMessages int `yaml:"session_messages"`
 	} `yaml:"mail"`
+	Proxy struct {
+		// SOCKS5 proxy (host:port) for outbound SMTP and HTTP connections
+		SOCKS5   string `yaml:"socks5"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"proxy"`
 	Stats struct {
 		Minlat     int     `yaml:"minlat"`
 		Maxlat     int     `yaml:"maxlat"`
@@ -64,15 +90,39 @@ type Config struct {
 		Distance   int     `yaml:"distance"`
 		StaleHrs   int     `yaml:"stale_hours"`
 		UseExpired bool    `yaml:"use_expired"`
+		// Refuse user-specified hops that form a known broken chain
+		StrictBroken bool `yaml:"strict_broken"`
+		// Random hop selection strategy: uniform, uptime, latency or score
+		Selection string `yaml:"selection"`
+		// Prevent chains containing two hops in the same email domain
+		UniqueDomains bool `yaml:"unique_domains"`
+		// Mean per-hop delay (minutes) requested from v4 remailers
+		HopDelay int `yaml:"hop_delay"`
 	} `yaml:"stats"`
 	Pool struct {
-		Size    int `yaml:"size"`
-		Rate    int `yaml:"rate"`
-		MinSend int `yaml:"min_send"`
-		Loop    int `yaml:"loop"`
+		// Mix strategy: binomial, dynamic, threshold or stopgo
+		Type    string `yaml:"type"`
+		Size    int    `yaml:"size"`
+		Rate    int    `yaml:"rate"`
+		MinSend int    `yaml:"min_send"`
+		Loop    int    `yaml:"loop"`
 		// Delete excessively old messages from the outbound pool
 		MaxAge int `yaml:"max_age"`
+		// Mean delay (minutes) for stop-and-go pools
+		Delay int `yaml:"delay"`
+		// Delay (minutes) before the first retry of a failed delivery
+		RetryDelay int `yaml:"retry_delay"`
+		// Failed deliveries before a message becomes a dead letter
+		MaxAttempts int `yaml:"max_attempts"`
 	} `yaml:"pool"`
+	Pinger struct {
+		// Minutes between rounds of pings
+		Interval int `yaml:"interval"`
+		// Number of random chains to ping each round
+		ChainPings int `yaml:"chain_pings"`
+		// Hours before an unreturned ping is considered lost
+		Timeout int `yaml:"timeout"`
+	} `yaml:"pinger"`
 	Remailer struct {
 		Name        string `yaml:"name"`
 		Address     string `yaml:"address"`
@@ -85,6 +135,29 @@ type Config struct {
 		Keygrace    int    `yaml:"key_grace"`
 		Daemon      bool   `yaml:"daemon"`
 	} `yaml:"remailer"`
+	SMTPD struct {
+		// Listen address (host:port) for the SMTP listener.  Empty disables it.
+		Listen string `yaml:"listen"`
+		// Certificate and key offered by STARTTLS
+		TLSCert string `yaml:"tls_cert"`
+		TLSKey  string `yaml:"tls_key"`
+		// Maximum accepted message size (kB)
+		MaxSize int `yaml:"max_size"`
+	} `yaml:"smtpd"`
+	Admin struct {
+		// Serve the admin HTTP API
+		Enabled bool `yaml:"enabled"`
+		// Listen address (host:port) for the admin HTTP API
+		Listen string `yaml:"listen"`
+	} `yaml:"admin"`
+	Metrics struct {
+		// Serve Prometheus metrics
+		Enabled bool `yaml:"enabled"`
+		// Listen address (host:port) for the metrics endpoint
+		Listen string `yaml:"listen"`
+	} `yaml:"metrics"`
+	// Named chain templates, selected with --chain @name
+	Chains map[string]string `yaml:"chains"`
 }
 
 type Flags struct {
@@ -105,6 +178,11 @@ type Flags struct {
 	Stdout   bool
 	Dummy    bool
 	NoDummy  bool
+	NewSURB  bool
+	SURB     string
+	Reply    bool
+	Pinger   bool
+	Preview  bool
 	Version  bool
 	MemInfo  bool
 }
@@ -187,6 +265,16 @@ func ParseFlags() *Flags {
 	flag.BoolVar(&f.Dummy, "d", false, "Inject a dummy message")
 	// Disable dummy messaging
 	flag.BoolVar(&f.NoDummy, "nodummy", false, "Don't send dummies")
+	// Create a Single-Use Reply Block
+	flag.BoolVar(&f.NewSURB, "new-surb", false, "Create a reply block for the --to address")
+	// Reply to a message using a Single-Use Reply Block
+	flag.StringVar(&f.SURB, "surb", "", "Reply using the reply block in this file")
+	// Decrypt a reply
+	flag.BoolVar(&f.Reply, "read-reply", false, "Read a reply from stdin")
+	// Run a pinger
+	flag.BoolVar(&f.Pinger, "pinger", false, "Run a pinger")
+	// Preview the chains a message would be sent through
+	flag.BoolVar(&f.Preview, "preview-chain", false, "Preview chains without sending")
 	// Print Version
 	flag.BoolVar(&f.Version, "version", false, "Print version string")
 	flag.BoolVar(&f.Version, "V", false, "Print version string")
@@ -262,6 +350,12 @@ func (f *Flags) newConfig() *Config {
 	c.Files.IDlog = path.Join(f.Dir, "idlog")
 	c.Files.ChunkDB = path.Join(f.Dir, "chunkdb")
 	c.Files.Logfile = path.Join(f.Dir, "yamn.log")
+	c.Files.SURBdir = path.Join(f.Dir, "surbs")
+	c.Files.PingDB = path.Join(f.Dir, "pingdb")
+	c.Files.PingerDir = path.Join(f.Dir, "pinger")
+	c.Files.Keydir = path.Join(f.Dir, "keys")
+	c.Files.Families = path.Join(f.Dir, "families.txt")
+	c.Files.Deaddir = path.Join(f.Dir, "dead")
 	c.Urls.Fetch = true
 	c.Urls.Pubring = "http://www.mixmin.net/yamn/pubring.mix"
 	c.Urls.Mlist2 = "http://www.mixmin.net/yamn/mlist2.txt"
@@ -278,6 +372,19 @@ func (f *Flags) newConfig() *Config {
 	c.Mail.OutboundName = "Anonymous Remailer"
 	c.Mail.OutboundAddy = "remailer@domain.invalid"
 	c.Mail.CustomFrom = false
+	c.Mail.ImplicitTLS = false
+	c.Mail.TLSPolicy = "opportunistic"
+	c.Mail.TLSCAFile = ""
+	c.Mail.TLSMinVersion = "1.2"
+	c.Mail.Workers = 4
+	c.Mail.SessionMessages = 10
+	c.Proxy.SOCKS5 = ""
+	c.SMTPD.Listen = ""
+	c.SMTPD.MaxSize = 64
+	c.Admin.Enabled = false
+	c.Admin.Listen = "127.0.0.1:9025"
+	c.Metrics.Enabled = false
+	c.Metrics.Listen = "127.0.0.1:9026"
 	c.Stats.Minrel = 98.0
 	c.Stats.Relfinal = 99.0
 	c.Stats.Minlat = 2
@@ -287,11 +394,22 @@ func (f *Flags) newConfig() *Config {
 	c.Stats.Distance = 2
 	c.Stats.StaleHrs = 24
 	c.Stats.UseExpired = false
+	c.Stats.StrictBroken = false
+	c.Stats.Selection = "uniform"
+	c.Stats.UniqueDomains = false
+	c.Stats.HopDelay = 0
+	c.Pool.Type = "binomial"
 	c.Pool.Size = 5 // Good for startups, too small for established
 	c.Pool.Rate = 65
 	c.Pool.MinSend = 5 // Only used in Binomial Mix Pools
 	c.Pool.Loop = 300
 	c.Pool.MaxAge = 28
+	c.Pool.Delay = 30
+	c.Pool.RetryDelay = 15
+	c.Pool.MaxAttempts = 10
+	c.Pinger.Interval = 60
+	c.Pinger.ChainPings = 10
+	c.Pinger.Timeout = 48
 	c.Remailer.Name = "anon"
 	c.Remailer.Address = "mix@nowhere.invalid"
 	c.Remailer.Exit = false
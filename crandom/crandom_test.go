@@ -58,6 +58,22 @@ func TestInt(t *testing.T) {
 	}
 }
 
+func TestExpFloat64(t *testing.T) {
+	samples := 10000
+	var total float64
+	for i := 0; i < samples; i++ {
+		f := ExpFloat64()
+		if f < 0 {
+			t.Fatalf("Exponential value is negative: %f", f)
+		}
+		total += f
+	}
+	mean := total / float64(samples)
+	if mean < 0.9 || mean > 1.1 {
+		t.Fatalf("Expected a mean close to 1, got %f", mean)
+	}
+}
+
 func TestRandInts(t *testing.T) {
 	testLen := 50
 	is := RandInts(testLen)
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout is the maximum time allowed to establish an outbound
+// connection, including any SOCKS5 negotiation.
+const dialTimeout = time.Minute
+
+// netDialer returns the dialer for outbound connections.  When a SOCKS5 proxy
+// is configured, connections are made through it and hostnames are resolved
+// by the proxy.  E.g. Tor's SOCKS port.
+func netDialer() (dialer proxy.Dialer, err error) {
+	direct := &net.Dialer{Timeout: dialTimeout}
+	if cfg.Proxy.SOCKS5 == "" {
+		dialer = direct
+		return
+	}
+	var auth *proxy.Auth
+	if cfg.Proxy.Username != "" {
+		auth = &proxy.Auth{
+			User:     cfg.Proxy.Username,
+			Password: cfg.Proxy.Password,
+		}
+	}
+	dialer, err = proxy.SOCKS5("tcp", cfg.Proxy.SOCKS5, auth, direct)
+	return
+}
+
+// httpTimeout is the maximum time allowed for an HTTP request, such as a
+// keyring or stats fetch.
+const httpTimeout = 2 * time.Minute
+
+// httpClient returns an HTTP client that connects using netDialer.  Without
+// a SOCKS5 proxy, it behaves like http.DefaultClient, apart from having a
+// timeout.
+func httpClient() (client *http.Client, err error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy.SOCKS5 != "" {
+		var dialer proxy.Dialer
+		dialer, err = netDialer()
+		if err != nil {
+			return
+		}
+		// All requests must go through the SOCKS5 proxy
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if d, ok := dialer.(proxy.ContextDialer); ok {
+				return d.DialContext(ctx, network, addr)
+			}
+			return dialer.Dial(network, addr)
+		}
+	}
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   httpTimeout,
+	}
+	return
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/config"
+)
+
+// fakeSOCKS5 accepts a single unauthenticated SOCKS5 CONNECT on l and sends
+// the requested destination to dest.  The connection is then closed.
+func fakeSOCKS5(t *testing.T, l net.Listener, dest chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		close(dest)
+		return
+	}
+	defer conn.Close()
+	// Greeting: Version, Number of methods, Methods
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Error(err)
+		close(dest)
+		return
+	}
+	conn.Write([]byte{5, 0})
+	// Request: Version, Command, Reserved, Address type (3 = Domain), Length
+	request := make([]byte, 5)
+	if _, err := io.ReadFull(conn, request); err != nil || request[3] != 3 {
+		t.Errorf("Expected a domain name request, got %v (%v)", request, err)
+		close(dest)
+		return
+	}
+	host := make([]byte, int(request[4])+2)
+	io.ReadFull(conn, host)
+	port := int(host[len(host)-2])<<8 | int(host[len(host)-1])
+	// Reply success with a bound address of 0.0.0.0:0
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	dest <- net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(port))
+}
+
+func TestNetDialer(t *testing.T) {
+	cfg = new(config.Config)
+	dialer, err := netDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := dialer.(*net.Dialer); !ok || d.Timeout != dialTimeout {
+		t.Error("Expected a direct dialer, with a timeout, when no proxy is configured")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dest := make(chan string, 1)
+	go fakeSOCKS5(t, l, dest)
+	cfg.Proxy.SOCKS5 = l.Addr().String()
+	dialer, err = netDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "entry.remailer.onion:25")
+	if err != nil {
+		t.Fatalf("Dial through SOCKS5 failed: %s", err)
+	}
+	conn.Close()
+	// Hostnames should be resolved by the proxy
+	if got := <-dest; got != "entry.remailer.onion:25" {
+		t.Errorf("Expected proxy to connect to entry.remailer.onion:25, got %s", got)
+	}
+}
+
+func TestMXRelay(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.MXRelay = true
+	single := []string{"foo@domain.bar"}
+	if !mxRelay(single) {
+		t.Error("Expected MX relay for a single recipient")
+	}
+	if mxRelay(append(single, "bar@domain.foo")) {
+		t.Error("Unexpected MX relay for multiple recipients")
+	}
+	// MX lookups would bypass the proxy
+	cfg.Proxy.SOCKS5 = "127.0.0.1:9050"
+	if mxRelay(single) {
+		t.Error("Unexpected MX relay with a SOCKS5 proxy configured")
+	}
+}
+
+// testTLSSMTPServer starts an SMTP listener that offers STARTTLS
+func testTLSSMTPServer(t *testing.T) *smtpServer {
+	s := newTestSMTPServer(t, func(msg *mail.Message) error {
+		return nil
+	})
+	s.tls = &tls.Config{Certificates: []tls.Certificate{testKeyPair(t)}}
+	go s.serve()
+	return s
+}
+
+func TestDialSMTPStartTLS(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSPolicy = tlsOpportunistic
+	cfg.Mail.TLSMinVersion = "1.2"
+	cfg.Mail.UseTLS = false
+	s := testTLSSMTPServer(t)
+	addr := s.listener.Addr().String()
+	for _, startTLS := range []bool{true, false} {
+		session, err := dialSMTP("127.0.0.1", addr, false, startTLS)
+		if err != nil {
+			t.Fatalf("startTLS=%v: %s", startTLS, err)
+		}
+		_, encrypted := session.client.TLSConnectionState()
+		if encrypted != startTLS {
+			t.Errorf("startTLS=%v: Expected encrypted=%v", startTLS, startTLS)
+		}
+		session.client.Quit()
+	}
+}
+
+func TestDialSMTPTimeout(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSMinVersion = "1.2"
+	defer func(timeout time.Duration) {
+		smtpTimeout = timeout
+	}(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+	// A server that accepts connections but never sends a greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	done := make(chan error)
+	go func() {
+		_, err := dialSMTP("127.0.0.1", l.Addr().String(), false, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected a timeout error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("dialSMTP didn't time out")
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Remailer.Address = "remailer@domain.foo"
+	if got := envelopeSender(); got != cfg.Remailer.Address {
+		t.Errorf("Expected=%s, Got=%s", cfg.Remailer.Address, got)
+	}
+	cfg.Mail.Sender = "sender@domain.foo"
+	if got := envelopeSender(); got != cfg.Mail.Sender {
+		t.Errorf("Expected=%s, Got=%s", cfg.Mail.Sender, got)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	cfg = new(config.Config)
+	client, err := httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout == 0 {
+		t.Error("HTTP client has no timeout")
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.Proxy == nil || transport.TLSHandshakeTimeout == 0 {
+		t.Error("Expected the default transport's proxy and timeout settings")
+	}
+	// Requests are sent through the SOCKS5 proxy
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dest := make(chan string, 1)
+	go fakeSOCKS5(t, l, dest)
+	cfg.Proxy.SOCKS5 = l.Addr().String()
+	client, err = httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Transport.(*http.Transport).Proxy != nil {
+		t.Error("Environment proxies mustn't bypass the SOCKS5 proxy")
+	}
+	// The fake proxy closes the connection so the request fails
+	client.Get("http://keys.remailer.onion/pubring.mix")
+	if got := <-dest; got != "keys.remailer.onion:80" {
+		t.Errorf("Expected proxy to connect to keys.remailer.onion:80, got %s", got)
+	}
+}
+
+func TestSMTPCacheBatch(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSPolicy = tlsOpportunistic
+	cfg.Mail.TLSMinVersion = "1.2"
+	cfg.Mail.SessionMessages = 10
+	cfg.Remailer.Address = "sender@domain.bar"
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		return nil
+	})
+	host, port, err := net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Mail.SMTPRelay = host
+	cfg.Mail.SMTPPort = port
+	payload := []byte("Subject: test\n\nBody\n")
+	idle := func() int {
+		smtpSessions.mu.Lock()
+		defer smtpSessions.mu.Unlock()
+		return len(smtpSessions.idle[s.listener.Addr().String()])
+	}
+	// Sessions opened outside a delivery batch aren't kept open
+	err = smtpRelay(payload, []string{"remailer@domain.foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := idle(); n != 0 {
+		t.Errorf("Expected no cached sessions outside a batch, got %d", n)
+	}
+	smtpSessions.startBatch()
+	err = smtpRelay(payload, []string{"remailer@domain.foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := idle(); n != 1 {
+		t.Errorf("Expected 1 cached session during a batch, got %d", n)
+	}
+	smtpSessions.closeAll()
+	if n := idle(); n != 0 {
+		t.Errorf("Expected no cached sessions after a batch, got %d", n)
+	}
+}
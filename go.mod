@@ -7,10 +7,14 @@ require (
 	github.com/crooks/jlog v0.0.0-20230403143904-3805b8c4f892
 	github.com/crooks/log-go-level v0.0.0-20221021134405-8ea229e5ea34
 	github.com/dchest/blake2s v1.0.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/luksen/maildir v0.0.0-20210101204218-7ed7afdce6bf
+	github.com/prometheus/client_golang v1.12.2
 	github.com/syndtr/goleveldb v1.0.0
 	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.10.0
+	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1
 )
 
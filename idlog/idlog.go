@@ -60,6 +60,16 @@ func (i *IDLog) Unique(key []byte) (unique bool) {
 	return
 }
 
+// Count returns the number of entries in the ID Log
+func (i *IDLog) Count() (count int) {
+	iter := i.db.NewIterator(nil, nil)
+	for iter.Next() {
+		count++
+	}
+	iter.Release()
+	return
+}
+
 func (i *IDLog) Expire() (count, deleted int) {
 	var err error
 	now := time.Now()
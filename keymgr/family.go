@@ -0,0 +1,62 @@
+package keymgr
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// ImportFamilies reads a file declaring families of remailers that shouldn't
+// appear together in a chain, typically because they share an operator.
+// Each line lists the shortnames of one family's members, separated by
+// whitespace or commas.  Text following a # is a comment.  A missing file
+// declares no families.
+func (p *Pubring) ImportFamilies(filename string) (err error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	var families []map[string]bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.SplitN(scanner.Text(), "#", 2)[0]
+		members := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(members) < 2 {
+			// A family of one constrains nothing
+			continue
+		}
+		family := make(map[string]bool)
+		for _, name := range members {
+			family[name] = true
+		}
+		families = append(families, family)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	p.families = families
+	return
+}
+
+// Related returns true if the remailers at addresses a and b are members of
+// the same declared family.
+func (p Pubring) Related(a, b string) bool {
+	aName := p.pub[a].name
+	bName := p.pub[b].name
+	if aName == "" || bName == "" {
+		return false
+	}
+	for _, family := range p.families {
+		if family[aName] && family[bName] {
+			return true
+		}
+	}
+	return false
+}
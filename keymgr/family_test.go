@@ -0,0 +1,43 @@
+package keymgr
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFamilies(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keymgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "families.txt")
+	p := NewPubring("", "")
+	// A missing file declares no families
+	err = p.ImportFamilies(filename)
+	if err != nil {
+		t.Fatalf("ImportFamilies failed on missing file: %s", err)
+	}
+	content := "# Operated by Bob\na b,c  # Same hosting\nd\n"
+	err = os.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		p.Put(Remailer{name: name, Address: name + "@domain.foo"})
+	}
+	err = p.ImportFamilies(filename)
+	if err != nil {
+		t.Fatalf("ImportFamilies failed: %s", err)
+	}
+	if !p.Related("a@domain.foo", "c@domain.foo") {
+		t.Error("Expected a and c to be related")
+	}
+	if p.Related("a@domain.foo", "d@domain.foo") {
+		t.Error("Expected a and d not to be related")
+	}
+	if p.Related("a@domain.foo", "unknown@domain.foo") {
+		t.Error("Expected unknown remailer not to be related")
+	}
+}
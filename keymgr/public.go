@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/dchest/blake2s"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,17 +31,59 @@ type Remailer struct {
 	uptime  int       // Uptime (10ths of a %)
 }
 
+// Name returns the remailer's shortname.
+func (r Remailer) Name() string {
+	return r.name
+}
+
+// Caps returns the remailer's capstring.
+func (r Remailer) Caps() string {
+	return r.caps
+}
+
+// Latent returns the remailer's latency in minutes, according to the stats.
+func (r Remailer) Latent() int {
+	return r.latent
+}
+
+// Uptime returns the remailer's uptime in 10ths of a percent, according to
+// the stats.
+func (r Remailer) Uptime() int {
+	return r.uptime
+}
+
+// Until returns the date the remailer's key expires.
+func (r Remailer) Until() time.Time {
+	return r.until
+}
+
+// Middle returns true if the remailer is a Middleman (not an Exit).
+func (r Remailer) Middle() bool {
+	return strings.Contains(r.caps, "M")
+}
+
+// SupportsVersion returns true if the remailer advertises support for packet
+// version v in its capstring.  All remailers support version 2.
+func (r Remailer) SupportsVersion(v int) bool {
+	if v == 2 {
+		return true
+	}
+	return strings.Contains(r.caps, strconv.Itoa(v))
+}
+
 type Pubring struct {
 	pubringFile    string // Pubring filename
 	statsFile      string // mlist type file
 	useExpired     bool   // Consider exired keys (for Echolot)
 	pub            map[string]Remailer
-	xref           map[string]string // A cross-reference of shortnames to addresses
-	stats          bool              // Have current reliability stats been imported?
-	advertised     string            // The keyid a local server is currently advertising
-	keysImported   time.Time         // Timestamp on most recently read pubring.mix file
-	statsImported  time.Time         // Timestamp on most recently read mlist2.txt file
-	statsGenerated time.Time         // Generated timestamp on mlist2.txt file
+	xref           map[string]string    // A cross-reference of shortnames to addresses
+	stats          bool                 // Have current reliability stats been imported?
+	advertised     string               // The keyid a local server is currently advertising
+	keysImported   time.Time            // Timestamp on most recently read pubring.mix file
+	statsImported  time.Time            // Timestamp on most recently read mlist2.txt file
+	statsGenerated time.Time            // Generated timestamp on mlist2.txt file
+	broken         map[BrokenChain]bool // Broken chains reported in mlist2.txt
+	families       []map[string]bool    // Families of related remailer names
 }
 
 func NewPubring(pubfile, statfile string) *Pubring {
@@ -51,6 +94,7 @@ func NewPubring(pubfile, statfile string) *Pubring {
 		pub:         make(map[string]Remailer),
 		xref:        make(map[string]string),
 		stats:       false,
+		broken:      make(map[BrokenChain]bool),
 	}
 }
 
@@ -59,6 +103,21 @@ func (p *Pubring) StatsStale(h int) bool {
 	return p.stats && int((time.Since(p.statsGenerated).Hours())) > h
 }
 
+// KeysImported returns the modification time of the imported pubring.mix
+func (p *Pubring) KeysImported() time.Time {
+	return p.keysImported
+}
+
+// StatsImported returns the modification time of the imported mlist2.txt
+func (p *Pubring) StatsImported() time.Time {
+	return p.statsImported
+}
+
+// StatsGenerated returns the Generated timestamp of the imported mlist2.txt
+func (p *Pubring) StatsGenerated() time.Time {
+	return p.statsGenerated
+}
+
 func (p *Pubring) HaveStats() bool {
 	return p.stats
 }
@@ -87,6 +146,17 @@ func (p *Pubring) StatRefresh() (refresh bool) {
 	return
 }
 
+// Broken returns true if the stats report that messages cannot pass from the
+// remailer at address from to the remailer at address to.  An asterisk in a
+// reported chain matches any remailer.
+func (p Pubring) Broken(from, to string) bool {
+	fromName := p.pub[from].name
+	toName := p.pub[to].name
+	return p.broken[BrokenChain{From: fromName, To: toName}] ||
+		p.broken[BrokenChain{From: "*", To: toName}] ||
+		p.broken[BrokenChain{From: fromName, To: "*"}]
+}
+
 // Candidates provides a list of remailer addresses that match the specified criteria
 func (p Pubring) Candidates(minlat, maxlat int, minrel float32, exit bool) (c []string) {
 	for addy := range p.pub {
@@ -129,6 +199,17 @@ func (p Pubring) KeyList() (addresses []string) {
 	return
 }
 
+// Remailers returns all the remailers in the keyring, sorted by name.
+func (p Pubring) Remailers() (remailers []Remailer) {
+	for _, r := range p.pub {
+		remailers = append(remailers, r)
+	}
+	sort.Slice(remailers, func(i, j int) bool {
+		return remailers[i].name < remailers[j].name
+	})
+	return
+}
+
 // Put inserts a new remailer struct into the Keyring
 func (p Pubring) Put(r Remailer) {
 	p.pub[r.Address] = r
@@ -177,11 +258,15 @@ func (p *Pubring) ImportStats() (err error) {
 	var lathrs int     //Latent Hours
 	var latmin int     //Latent Minutes
 	var exists bool    //Test for presence of remailer in xref
+	var inBroken bool  //In the Broken type-II chains section
+	// Broken chains are replaced on each import
+	p.broken = make(map[BrokenChain]bool)
 	parsePhase := 0
 	/* Stat phases are:
 	0 Want Generated timestamp
 	1 Expecting long string of dashes
 	2 Expecting stats lines
+	3 Expecting broken chains
 	*/
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -265,8 +350,25 @@ func (p *Pubring) ImportStats() (err error) {
 			tmp.uptime = int(uptmp * 10)
 			p.pub[remAddr] = tmp
 		case 3:
-			// Reserved for future mlist2.txt processing
-			break
+			// Broken type-I chains relate to Mixmaster and are
+			// ignored.  Type-II chains are listed as (from to).
+			if strings.HasPrefix(line, "Broken type-II") {
+				inBroken = true
+				continue
+			} else if strings.HasPrefix(line, "Broken type-") ||
+				strings.HasPrefix(line, "Remailer-Capabilities") {
+				inBroken = false
+				continue
+			}
+			if !inBroken || !strings.HasPrefix(line, "(") {
+				continue
+			}
+			elements := strings.Fields(strings.Trim(line, "() "))
+			if len(elements) != 2 {
+				fmt.Fprintf(os.Stderr, "Invalid broken chain: %s\n", line)
+				continue
+			}
+			p.broken[BrokenChain{From: elements[0], To: elements[1]}] = true
 		}
 	}
 	// Test that all stats phases have been achieved.
@@ -288,6 +390,74 @@ func (p *Pubring) ImportStats() (err error) {
 	return
 }
 
+// Stat describes the reliability of a single remailer in an mlist2.txt file.
+type Stat struct {
+	Name       string
+	LatentHist string // Daily latency history, oldest first
+	Latent     int    // Latency (minutes)
+	UptimeHist string // Daily uptime history, oldest first
+	Uptime     int    // Uptime (10ths of a %)
+}
+
+// BrokenChain is a pair of remailers, identified by name, that are unable to
+// pass messages from one to the other.
+type BrokenChain struct {
+	From string
+	To   string
+}
+
+// WriteStats writes an mlist2.txt style file containing the provided stats
+// and broken chains.  Remailer capabilities are taken from the keyring.
+func (p Pubring) WriteStats(
+	filename string,
+	stats []Stat,
+	broken []BrokenChain,
+) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "Stats-Version: 2.0")
+	fmt.Fprintf(w, "Generated: %s\n", time.Now().UTC().Format(generatedFormat))
+	fmt.Fprintln(w, "Mixmaster    Latent-Hist   Latent  Uptime-Hist   Uptime  Options")
+	fmt.Fprintln(w, strings.Repeat("-", 72))
+	for _, s := range stats {
+		var lathrs string
+		if s.Latent >= 60 {
+			lathrs = strconv.Itoa(s.Latent / 60)
+		}
+		fmt.Fprintf(
+			w,
+			"%-12s %-12s %6s  %-12s  %5.1f%%\n",
+			s.Name,
+			s.LatentHist,
+			fmt.Sprintf("%s:%02d", lathrs, s.Latent%60),
+			s.UptimeHist,
+			float32(s.Uptime)/10,
+		)
+	}
+	// An empty line terminates the stats entries
+	fmt.Fprintln(w, "")
+	fmt.Fprintf(w, "Broken type-I remailer chains:\n\n")
+	fmt.Fprintln(w, "Broken type-II remailer chains:")
+	for _, b := range broken {
+		fmt.Fprintf(w, "(%s %s)\n", b.From, b.To)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintf(w, "Remailer-Capabilities:\n\n")
+	for _, r := range p.Remailers() {
+		var options string
+		if r.Middle() {
+			options = " middle"
+		}
+		fmt.Fprintf(w, "$remailer{\"%s\"} = \"<%s>%s\";\n", r.name, r.Address, options)
+	}
+	err = w.Flush()
+	return
+}
+
 func Headers(filename string) (headers []string, err error) {
 	var f *os.File
 	f, err = os.Open(filename)
@@ -306,11 +476,66 @@ func Headers(filename string) (headers []string, err error) {
 
 // ImportPubring reads a YAMN Pubring.mix file
 func (p *Pubring) ImportPubring() (err error) {
+	err = p.importKeys(p.pubringFile, false)
+	if err != nil {
+		return
+	}
+	// Set key imported timestamp
+	stat, err := os.Stat(p.pubringFile)
+	if err != nil {
+		panic(err)
+	}
+	p.keysImported = stat.ModTime()
+	return
+}
+
+// ImportKeyFile reads a Pubring.mix format file (such as a remailer's
+// key.txt) into the keyring.  Unlike ImportPubring, a key will only replace
+// an existing key for the same remailer if it's newer.
+func (p *Pubring) ImportKeyFile(filename string) (err error) {
+	return p.importKeys(filename, true)
+}
+
+// WritePubring writes all the keys in the keyring to filename in Pubring.mix
+// format.
+func (p Pubring) WritePubring(filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, r := range p.Remailers() {
+		keyidstr := hex.EncodeToString(r.Keyid)
+		fmt.Fprintf(
+			w,
+			"%s %s %s %s %s %s %s\n\n",
+			r.name,
+			r.Address,
+			keyidstr,
+			r.version,
+			r.caps,
+			r.from.UTC().Format(date_format),
+			r.until.UTC().Format(date_format),
+		)
+		fmt.Fprintln(w, "-----Begin Mix Key-----")
+		fmt.Fprintln(w, keyidstr)
+		fmt.Fprintln(w, hex.EncodeToString(r.PK))
+		fmt.Fprintf(w, "-----End Mix Key-----\n\n")
+	}
+	err = w.Flush()
+	return
+}
+
+// importKeys reads keys from a Pubring.mix format file.  If newest is true,
+// existing keys are only replaced by keys with a later valid-from date.
+func (p *Pubring) importKeys(filename string, newest bool) (err error) {
 	var f *os.File
-	f, err = os.Open(p.pubringFile)
+	f, err = os.Open(filename)
 	if err != nil {
 		return
 	}
+	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	var elements []string
 	var num_elements int
@@ -425,18 +650,15 @@ func (p *Pubring) ImportPubring() (err error) {
 		case 4:
 			// Expecting end cutmark
 			if line == "-----End Mix Key-----" {
-				p.Put(*rem)
+				existing, exists := p.pub[rem.Address]
+				if !newest || !exists || rem.from.After(existing.from) {
+					p.Put(*rem)
+				}
 				key_phase = 0
 			}
 		} // End of phases
 	} // End of file scan loop
-
-	// Set key imported timestamp
-	stat, err := os.Stat(p.pubringFile)
-	if err != nil {
-		panic(err)
-	}
-	p.keysImported = stat.ModTime()
+	err = scanner.Err()
 	return
 }
 
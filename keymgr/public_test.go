@@ -160,3 +160,65 @@ func TestCandidates(t *testing.T) {
 		t.Fatalf("Expected 3 Exit candidates, got %d", numCandidates)
 	}
 }
+
+func TestWriteStats(t *testing.T) {
+	p := NewPubring("pubring.mix", "")
+	err := p.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "keymgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pubring := dir + "/pubring.mix"
+	mlist2 := dir + "/mlist2.txt"
+	err = p.WritePubring(pubring)
+	if err != nil {
+		t.Fatalf("WritePubring failed: %s", err)
+	}
+	stats := []Stat{
+		{Name: "test00", LatentHist: "????????++++", Latent: 5, UptimeHist: "????????0000", Uptime: 1000},
+		{Name: "test04", LatentHist: "????????++++", Latent: 75, UptimeHist: "????????0000", Uptime: 955},
+	}
+	broken := []BrokenChain{
+		{From: "test00", To: "test04"},
+		{From: "*", To: "test02"},
+	}
+	err = p.WriteStats(mlist2, stats, broken)
+	if err != nil {
+		t.Fatalf("WriteStats failed: %s", err)
+	}
+	// Read back what was written
+	p = NewPubring(pubring, mlist2)
+	err = p.ImportPubring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Count() != 10 {
+		t.Fatalf("Expected 10 keys in written pubring, got %d", p.Count())
+	}
+	err = p.ImportStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := p.Get("test04")
+	if r.latent != 75 || r.uptime != 955 {
+		t.Fatalf("Unexpected stats for test04: Latent=%d, Uptime=%d", r.latent, r.uptime)
+	}
+	if !r.Middle() {
+		t.Fatal("Expected test04 to be a Middleman")
+	}
+	r0, _ := p.Get("test00")
+	r2, _ := p.Get("test02")
+	if !p.Broken(r0.Address, r.Address) {
+		t.Error("Expected test00 -> test04 to be broken")
+	}
+	if p.Broken(r.Address, r0.Address) {
+		t.Error("Expected test04 -> test00 not to be broken")
+	}
+	if !p.Broken(r.Address, r2.Address) {
+		t.Error("Expected wildcard chain to test02 to be broken")
+	}
+}
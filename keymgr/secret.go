@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,6 +17,13 @@ const (
 	maxAddyLen   int = 52 // Max chars in remailer address
 )
 
+// Secret key states, as counted by Purge
+const (
+	KeyActive   = "active"
+	KeyExpiring = "expiring"
+	KeyExpired  = "expired"
+)
+
 type secret struct {
 	keyid []byte    // keyid
 	sk    []byte    // Secret Key
@@ -22,6 +31,29 @@ type secret struct {
 	until time.Time // Valid Until
 }
 
+// state returns the state of a key at a given time.  Key dates on keyrings
+// are in days so nextMidnight is used so that keys remain valid throughout
+// their whole last day.
+func (m secret) state(now time.Time) string {
+	_, untilNextMidnight := midnights(m.until)
+	expiringThreshold := m.until.Add(time.Duration(-expiringDays) * time.Hour)
+	_, expiringNextMidnight := midnights(expiringThreshold)
+	if now.After(untilNextMidnight) {
+		return KeyExpired
+	} else if now.After(expiringNextMidnight) {
+		return KeyExpiring
+	}
+	return KeyActive
+}
+
+// KeyInfo describes a secret key without revealing it
+type KeyInfo struct {
+	Keyid string
+	From  time.Time
+	Until time.Time
+	State string
+}
+
 type Secring struct {
 	secringFile string // Filename of secret keyring
 	pubkeyFile  string // Public keyfile (key.txt)
@@ -33,6 +65,7 @@ type Secring struct {
 	grace       time.Duration // Period of grace after key expiry
 	exit        bool          // Is this an Exit type remailer?
 	version     string        // Yamn version string
+	versions    []int         // Supported packet versions
 }
 
 // OpenAppend opens a file in Append mode and sets user-only permissions
@@ -115,6 +148,28 @@ func (s *Secring) SetValidity(valid, grace int) {
 	s.grace = time.Duration(24*grace) * time.Hour
 }
 
+// SetPacketVersions defines the packet versions advertised in the capstring
+func (s *Secring) SetPacketVersions(versions []int) {
+	s.versions = versions
+}
+
+// capstring returns the capabilities advertised on keys.  Packet versions
+// beyond v2 are advertised as digits.
+func (s *Secring) capstring() (caps string) {
+	// M = Middle, E = Exit
+	if s.exit {
+		caps = "E"
+	} else {
+		caps = "M"
+	}
+	for _, v := range s.versions {
+		if v > 2 {
+			caps += strconv.Itoa(v)
+		}
+	}
+	return
+}
+
 // SetVersion sets the version string used on keys
 func (s *Secring) SetVersion(v string) {
 	s.version = "4:" + v
@@ -125,6 +180,24 @@ func (s *Secring) Count() int {
 	return len(s.sec)
 }
 
+// Keys returns the details of each key in memory, ordered by expiry date.
+// Unlike Purge, keys are only inspected; none are deleted.
+func (s *Secring) Keys() (keys []KeyInfo) {
+	now := time.Now()
+	for k, m := range s.sec {
+		keys = append(keys, KeyInfo{
+			Keyid: k,
+			From:  m.from,
+			Until: m.until,
+			State: m.state(now),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Until.Before(keys[j].Until)
+	})
+	return
+}
+
 // Insert puts a new secret key into memory and returns its keyid
 func (s *Secring) Insert(pub, sec []byte) (keyidstr string) {
 	var err error
@@ -173,13 +246,7 @@ func (s *Secring) WritePublic(pub []byte, keyidstr string) {
 		panic(err)
 	}
 
-	var capstring string
-	// M = Middle, E = Exit
-	if s.exit {
-		capstring += "E"
-	} else {
-		capstring += "M"
-	}
+	capstring := s.capstring()
 
 	key, exists := s.sec[keyidstr]
 	if !exists {
@@ -266,13 +333,7 @@ func (s *Secring) WriteMyKey(filename string) (keyidstr string) {
 		line = in.Text()
 		elements := strings.Fields(line)
 		if len(elements) == 7 {
-			var capstring string
-			// M = Middle, E = Exit
-			if s.exit {
-				capstring += "E"
-			} else {
-				capstring += "M"
-			}
+			capstring := s.capstring()
 			// Extract the keyid so we can return it
 			keyidstr = elements[2]
 			if len(keyidstr) != 32 {
@@ -363,9 +424,7 @@ func (s *Secring) Purge() (active, expiring, expired, purged int) {
 	}
 	defer f.Close()
 
-	// Set the duration prior to expired that we consider "expiring".
 	now := time.Now()
-	expirePeriod := time.Duration(-expiringDays) * time.Hour
 
 	// Iterate key and value of Secring in memory
 	for k, m := range s.sec {
@@ -394,16 +453,12 @@ func (s *Secring) Purge() (active, expiring, expired, purged int) {
 		if err != nil {
 			panic(err)
 		}
-		// Key dates on keyrings are in days so a we use nextMidnight
-		// so that keys remain valid throughout their whole last day.
-		_, untilNextMidnight := midnights(m.until)
-		expiringThreshold := m.until.Add(expirePeriod)
-		_, expiringNextMidnight := midnights(expiringThreshold)
-		if now.After(untilNextMidnight) {
+		switch m.state(now) {
+		case KeyExpired:
 			expired++
-		} else if now.After(expiringNextMidnight) {
+		case KeyExpiring:
 			expiring++
-		} else {
+		default:
 			active++
 		}
 	}
@@ -0,0 +1,32 @@
+package keymgr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecringKeys(t *testing.T) {
+	s := NewSecring("secring.mix", "key.txt")
+	now := time.Now()
+	day := 24 * time.Hour
+	s.sec["active"] = secret{from: now.Add(-day), until: now.Add(10 * day)}
+	s.sec["expiring"] = secret{from: now.Add(-day), until: now.Add(day)}
+	s.sec["expired"] = secret{from: now.Add(-10 * day), until: now.Add(-2 * day)}
+	keys := s.Keys()
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 keys, got %d", len(keys))
+	}
+	// Keys are ordered by expiry date
+	for i, want := range []string{KeyExpired, KeyExpiring, KeyActive} {
+		if keys[i].State != want {
+			t.Errorf("Key %d: Expected=%s, Got=%s", i, want, keys[i].State)
+		}
+		if keys[i].Keyid != want {
+			t.Errorf("Key %d: Expected keyid %s, Got=%s", i, want, keys[i].Keyid)
+		}
+	}
+	// Inspecting keys mustn't remove them
+	if s.Count() != 3 {
+		t.Errorf("Expected 3 keys to remain, got %d", s.Count())
+	}
+}
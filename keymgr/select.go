@@ -0,0 +1,89 @@
+package keymgr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/crooks/yamn/crandom"
+)
+
+// Strategies for selecting a random remailer from a list of candidates
+const (
+	SelectUniform = "uniform" // Every candidate is equally likely
+	SelectUptime  = "uptime"  // Favour candidates that lose fewer messages
+	SelectLatency = "latency" // Favour candidates with lower latency
+	SelectScore   = "score"   // Combination of uptime and latency
+)
+
+// selectResolution is the granularity of the random point used to pick a
+// candidate from the sum of their weights
+const selectResolution = 1 << 30
+
+var (
+	// ErrUnknownStrategy is returned when a selection strategy isn't one of
+	// the Select constants
+	ErrUnknownStrategy = errors.New("unknown selection strategy")
+	// ErrNoCandidates is returned when selecting from an empty list
+	ErrNoCandidates = errors.New("no candidate remailers")
+)
+
+// ValidStrategy tests if strategy is a known selection strategy.
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case SelectUniform, SelectUptime, SelectLatency, SelectScore:
+		return true
+	}
+	return false
+}
+
+// weight returns the relative likelihood of the remailer being selected
+// under strategy.  Uptime weights are inversely proportional to the
+// percentage of messages lost (plus 1% so perfect remailers don't dominate
+// entirely).  Latency weights are inversely proportional to latency (plus 5
+// minutes).
+func (r Remailer) weight(strategy string) (w float64, err error) {
+	uptime := 1 / float64(1010-r.uptime)
+	latent := 1 / float64(r.latent+5)
+	switch strategy {
+	case SelectUniform:
+		w = 1
+	case SelectUptime:
+		w = uptime
+	case SelectLatency:
+		w = latent
+	case SelectScore:
+		w = uptime * latent
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownStrategy, strategy)
+	}
+	return
+}
+
+// Select randomly picks one of the candidate addresses using strategy to
+// weight each candidate by its stats.
+func (p Pubring) Select(candidates []string, strategy string) (addy string, err error) {
+	if len(candidates) == 0 {
+		err = ErrNoCandidates
+		return
+	}
+	weights := make([]float64, len(candidates))
+	var total float64
+	for n, c := range candidates {
+		weights[n], err = p.pub[c].weight(strategy)
+		if err != nil {
+			return
+		}
+		total += weights[n]
+	}
+	point := total * float64(crandom.RandomInt(selectResolution)) / selectResolution
+	for n, w := range weights {
+		if point < w {
+			addy = candidates[n]
+			return
+		}
+		point -= w
+	}
+	// Only reachable through floating point rounding
+	addy = candidates[len(candidates)-1]
+	return
+}
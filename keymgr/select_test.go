@@ -0,0 +1,61 @@
+package keymgr
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	p := NewPubring("", "")
+	p.Put(Remailer{name: "a", Address: "a@domain.foo", latent: 5, uptime: 1000})
+	p.Put(Remailer{name: "b", Address: "b@domain.foo", latent: 5, uptime: 990})
+	p.Put(Remailer{name: "c", Address: "c@domain.foo", latent: 55, uptime: 990})
+	candidates := []string{"a@domain.foo", "b@domain.foo", "c@domain.foo"}
+	// Expected proportion of draws for a, b and c under each strategy
+	tests := []struct {
+		strategy string
+		expected []float64
+	}{
+		{SelectUniform, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+		{SelectUptime, []float64{0.5, 0.25, 0.25}},
+		{SelectLatency, []float64{6.0 / 13, 6.0 / 13, 1.0 / 13}},
+		{SelectScore, []float64{12.0 / 19, 6.0 / 19, 1.0 / 19}},
+	}
+	draws := 20000
+	for _, test := range tests {
+		counts := make(map[string]int)
+		for n := 0; n < draws; n++ {
+			addy, err := p.Select(candidates, test.strategy)
+			if err != nil {
+				t.Fatalf("%s: Select failed: %s", test.strategy, err)
+			}
+			counts[addy]++
+		}
+		for n, c := range candidates {
+			got := float64(counts[c]) / float64(draws)
+			if math.Abs(got-test.expected[n]) > 0.03 {
+				t.Errorf(
+					"%s: Expected %s to be selected %.3f of the time, got %.3f",
+					test.strategy,
+					c,
+					test.expected[n],
+					got,
+				)
+			}
+		}
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	p := NewPubring("", "")
+	p.Put(Remailer{name: "a", Address: "a@domain.foo"})
+	_, err := p.Select([]string{"a@domain.foo"}, "fastest")
+	if !errors.Is(err, ErrUnknownStrategy) {
+		t.Errorf("Expected ErrUnknownStrategy, got: %v", err)
+	}
+	_, err = p.Select(nil, SelectUniform)
+	if !errors.Is(err, ErrNoCandidates) {
+		t.Errorf("Expected ErrNoCandidates, got: %v", err)
+	}
+}
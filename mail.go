@@ -2,11 +2,9 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"net"
 	"net/mail"
-	"net/smtp"
 	"os"
 	"os/exec"
 	"strings"
@@ -177,37 +175,34 @@ func mailPoolFile(filename string) (delFlag bool, err error) {
 		return
 	}
 
+	internal, err := parsePoolHeader(msg.Header)
+	if err != nil {
+		log.Errorf("%s: %s", filename, err)
+		return
+	}
 	// Test for a Pooled Date header in the message.
-	pooledHeader := msg.Header.Get("Yamn-Pooled-Date")
-	if pooledHeader == "" {
+	if internal.pooled.IsZero() {
 		// Legacy condition.  All current versions apply this header.
 		log.Warn("No Yamn-Pooled-Date header in message")
 	} else {
-		var pooledDate time.Time
-		pooledDate, err = time.Parse(shortdate, pooledHeader)
-		if err != nil {
-			log.Errorf("%s: Failed to parse Yamn-Pooled-Date: %s", filename, err)
-			return
-		}
-		age := daysAgo(pooledDate)
+		age := daysAgo(internal.pooled)
 		if age > cfg.Pool.MaxAge {
 			// The message has expired.  Give up trying to send it.
-			log.Infof(
-				"%s: Refusing to mail pool file. Exceeds max age of %d days",
-				filename,
+			// The error lets the caller retire it to the dead
+			// letters.
+			err = fmt.Errorf(
+				"%w: Refusing to mail pool file. Exceeds max age of %d days",
+				errPoolExpired,
 				cfg.Pool.MaxAge,
 			)
-			// Set deletion flag.  We don't want to retain old
-			// messages forever.
-			delFlag = true
 			return
 		}
 		if age > 0 {
 			log.Tracef("Mailing pooled file that's %d days old.", age)
 		}
-		// Delete the internal header we just tested.
-		delete(msg.Header, "Yamn-Pooled-Date")
 	}
+	// Internal headers have served their purpose once the message is mailed.
+	deleteInternalHeaders(msg.Header)
 
 	// Add some required headers to the message.
 	msg.Header["Date"] = []string{time.Now().Format(rfc5322date)}
@@ -297,14 +292,33 @@ func execSend(payload []byte, execCmd string) (err error) {
 	return
 }
 
+// envelopeSender returns the SMTP envelope sender address
+func envelopeSender() string {
+	// Remailer.Address is a legacy setting as clients may also need to
+	// set the sender address if their ISPs MTA demands it's valid.
+	// TODO remove cfg.Remailer.Address in a later version (27/04/2015)
+	if cfg.Mail.Sender != "" {
+		return cfg.Mail.Sender
+	}
+	return cfg.Remailer.Address
+}
+
+// mxRelay tests if a message should be delivered direct to the recipient's
+// MX.  MX lookups use the system resolver, so they're never made when a SOCKS5
+// proxy is configured.  Doing so would reveal recipient domains to the local
+// network.
+func mxRelay(sendTo []string) bool {
+	return cfg.Mail.MXRelay && len(sendTo) == 1 && cfg.Proxy.SOCKS5 == ""
+}
+
 func smtpRelay(payload []byte, sendTo []string) (err error) {
-	conf := new(tls.Config)
-	//conf.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA}
-	conf.InsecureSkipVerify = true
-	//conf.MinVersion = tls.VersionSSL30
-	//conf.MaxVersion = tls.VersionTLS10
+	start := time.Now()
+	defer func() {
+		observeSMTP(start, err)
+	}()
 	relay := cfg.Mail.SMTPRelay
 	port := cfg.Mail.SMTPPort
+	implicitTLS := cfg.Mail.ImplicitTLS
 
 	/*
 		The following section tries to get the MX record for the
@@ -312,7 +326,7 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 		If it succeeds, the email will be sent directly to the
 		recipient MX.
 	*/
-	if cfg.Mail.MXRelay && len(sendTo) == 1 {
+	if mxRelay(sendTo) {
 		log.Tracef("DNS lookup of MX record for %s.", sendTo[0])
 		mx, err := mxLookup(sendTo[0])
 		if err == nil {
@@ -323,109 +337,46 @@ func smtpRelay(payload []byte, sendTo []string) (err error) {
 			)
 			relay = mx
 			port = "25"
+			// MX relays only offer STARTTLS
+			implicitTLS = false
 		}
 	}
 	serverAddr := net.JoinHostPort(relay, port)
 
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		log.Warnf("Dial Error: Server=%s, Error=%s", serverAddr, err)
-		return
-	}
-
-	client, err := smtp.NewClient(conn, relay)
-	if err != nil {
-		log.Warnf(
-			"SMTP Connection Error: Server=%s, Error=%s",
-			serverAddr,
-			err,
-		)
-		return
-	}
-	// Test if the remote MTA supports STARTTLS
-	ok, _ := client.Extension("STARTTLS")
-	if ok && cfg.Mail.UseTLS {
-		if err = client.StartTLS(conf); err != nil {
-			log.Warnf(
-				"Error performing STARTTLS: Server=%s, Error=%s",
-				serverAddr,
-				err,
-			)
-			return
-		}
-	}
-	// If AUTH is supported and a UserID and Password are configured, try to
-	// authenticate to the remote MTA.
-	ok, _ = client.Extension("AUTH")
-	if ok && cfg.Mail.Username != "" && cfg.Mail.Password != "" {
-		auth := smtp.PlainAuth(
-			"",
-			cfg.Mail.Username,
-			cfg.Mail.Password,
-			cfg.Mail.SMTPRelay,
-		)
-		if err = client.Auth(auth); err != nil {
-			log.Warnf("Auth Error:  Server=%s, Error=%s", serverAddr, err)
-			return
-		}
-	}
-	// Remailer.Address is a legacy setting as clients may also need to
-	// set the sender address if their ISPs MTA demands it's valid.
-	// TODO remove cfg.Remailer.Address in a later version (27/04/2015)
-	var sender string
-	if cfg.Mail.Sender != "" {
-		sender = cfg.Mail.Sender
-	} else {
-		sender = cfg.Remailer.Address
-	}
-	if err = client.Mail(sender); err != nil {
-		log.Warnf("SMTP Error: Server=%s, Error=%s", serverAddr, err)
-		return
-	}
-
-	for _, addr := range sendTo {
-		if err = client.Rcpt(addr); err != nil {
-			log.Warnf("Error: %s\n", err)
+	// Use an idle session to the MTA if there is one
+	session := smtpSessions.get(serverAddr)
+	if session == nil {
+		session, err = dialSMTP(relay, serverAddr, implicitTLS, cfg.Mail.UseTLS)
+		if err != nil {
 			return
 		}
 	}
-
-	w, err := client.Data()
-	if err != nil {
-		log.Warnf("Error: %s\n", err)
-		return
-	}
-
-	_, err = w.Write(payload)
-	if err != nil {
-		log.Warnf("Error: %s\n", err)
-		return
-
-	}
-
-	err = w.Close()
+	err = session.send(envelopeSender(), sendTo, payload)
 	if err != nil {
-		log.Warnf("Error: %s\n", err)
+		// Don't reuse a session in an unknown state
+		session.client.Close()
 		return
-
 	}
-
-	client.Quit()
+	smtpSessions.put(session)
 	return
 }
 
-// sendmail invokes go's sendmail method
+// sendmail sends a single message to the configured SMTP relay in a new
+// session.  Unlike smtpRelay, it never delivers direct to MX and always
+// upgrades to TLS when the relay offers STARTTLS.
 func sendmail(payload []byte, sendTo []string) (err error) {
-	auth := smtp.PlainAuth(
-		"",
-		cfg.Mail.Username,
-		cfg.Mail.Password,
-		cfg.Mail.SMTPRelay)
 	relay := net.JoinHostPort(cfg.Mail.SMTPRelay, cfg.Mail.SMTPPort)
-	err = smtp.SendMail(relay, auth, cfg.Remailer.Address, sendTo, payload)
+	session, err := dialSMTP(cfg.Mail.SMTPRelay, relay, cfg.Mail.ImplicitTLS, true)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	defer session.client.Close()
+	err = session.send(envelopeSender(), sendTo, payload)
 	if err != nil {
 		log.Warn(err)
 		return
 	}
+	session.client.Quit()
 	return
 }
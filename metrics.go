@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crooks/yamn/keymgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// statsMetrics maps statistics counters to Prometheus metrics.  Rejection
+// counters aren't listed; they're exported as decode failures by reason.
+var statsMetrics = map[string]*prometheus.Desc{
+	"in_mail":     metricDesc("mail_received_total", "Emails received."),
+	"in_remfoo":   metricDesc("remailer_requests_total", "remailer-* requests received."),
+	"in_yamn":     metricDesc("packets_received_total", "YAMN packets received."),
+	"in_dummy":    metricDesc("dummies_received_total", "Dummy messages received."),
+	"out_mail":    metricDesc("mail_sent_total", "Emails sent from the pool."),
+	"out_yamn":    metricDesc("packets_forwarded_total", "YAMN packets forwarded to the next hop."),
+	"out_loop":    metricDesc("packets_looped_total", "YAMN packets for which this remailer is also the next hop."),
+	"out_randhop": metricDesc("randhops_total", "Messages randomly hopped to an exit remailer."),
+	"out_plain":   metricDesc("exit_messages_total", "Messages pooled for delivery to final recipients."),
+	"out_dummy":   metricDesc("dummies_sent_total", "Dummy messages sent."),
+	"out_reply":   metricDesc("replies_forwarded_total", "Replies forwarded to a Reply Block's first hop."),
+}
+
+var (
+	decodeFailuresDesc = metricDesc(
+		"decode_failures_total",
+		"Inbound packets rejected, by reason.",
+		"reason",
+	)
+	poolMessagesDesc = metricDesc(
+		"pool_messages",
+		"Messages in the pool, by filename prefix.",
+		"prefix", "type",
+	)
+	poolBytesDesc = metricDesc(
+		"pool_bytes",
+		"Size of the messages in the pool, by filename prefix.",
+		"prefix", "type",
+	)
+	keyExpiryDesc = metricDesc(
+		"secret_key_expiry_timestamp_seconds",
+		"Time at which each secret key expires.",
+		"keyid", "state",
+	)
+	pubringAgeDesc = metricDesc(
+		"pubring_age_seconds",
+		"Age of the imported pubring.mix file.",
+	)
+	mlist2AgeDesc = metricDesc(
+		"mlist2_age_seconds",
+		"Time since the imported mlist2.txt stats were generated.",
+	)
+)
+
+// Metrics recorded as events occur
+var (
+	batchSizes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "yamn_pool_batch_size",
+		Help:    "Messages selected for sending by the mix strategy.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+	smtpDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yamn_smtp_deliveries_total",
+		Help: "SMTP relay deliveries, by outcome.",
+	}, []string{"outcome"})
+	smtpLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "yamn_smtp_delivery_duration_seconds",
+		Help:    "Time taken to deliver a message to the SMTP relay or MX.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+)
+
+// metricDesc returns the description of a yamn metric
+func metricDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("yamn_"+name, help, labels, nil)
+}
+
+// observeSMTP records the outcome and duration of an SMTP relay delivery
+func observeSMTP(start time.Time, err error) {
+	outcome := "sent"
+	if errors.Is(err, errTLSPolicy) {
+		outcome = "tls_policy"
+	} else if err != nil {
+		outcome = "failed"
+	}
+	smtpDeliveries.WithLabelValues(outcome).Inc()
+	smtpLatency.Observe(time.Since(start).Seconds())
+}
+
+// remailerCollector gathers metrics from the remailer's state at the time
+// of each scrape.
+type remailerCollector struct {
+	secret *keymgr.Secring
+}
+
+func (c remailerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range statsMetrics {
+		ch <- desc
+	}
+	ch <- decodeFailuresDesc
+	ch <- poolMessagesDesc
+	ch <- poolBytesDesc
+	ch <- keyExpiryDesc
+	ch <- pubringAgeDesc
+	ch <- mlist2AgeDesc
+}
+
+func (c remailerCollector) Collect(ch chan<- prometheus.Metric) {
+	ingestMu.Lock()
+	totals := stats.totals()
+	keys := c.secret.Keys()
+	keysImported := Pubring.KeysImported()
+	haveStats := Pubring.HaveStats()
+	statsGenerated := Pubring.StatsGenerated()
+	ingestMu.Unlock()
+
+	for name, count := range totals {
+		switch {
+		case statsMetrics[name] != nil:
+			ch <- prometheus.MustNewConstMetric(
+				statsMetrics[name],
+				prometheus.CounterValue,
+				float64(count),
+			)
+		case strings.HasPrefix(name, "rej_"):
+			ch <- prometheus.MustNewConstMetric(
+				decodeFailuresDesc,
+				prometheus.CounterValue,
+				float64(count),
+				strings.TrimPrefix(name, "rej_"),
+			)
+		case name == "in_decode_fail":
+			ch <- prometheus.MustNewConstMetric(
+				decodeFailuresDesc,
+				prometheus.CounterValue,
+				float64(count),
+				"other",
+			)
+		}
+	}
+	if sizes, err := poolSizes(); err == nil {
+		for prefix, s := range sizes {
+			ch <- prometheus.MustNewConstMetric(
+				poolMessagesDesc,
+				prometheus.GaugeValue,
+				float64(s.Messages),
+				prefix,
+				s.Type,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				poolBytesDesc,
+				prometheus.GaugeValue,
+				float64(s.Bytes),
+				prefix,
+				s.Type,
+			)
+		}
+	}
+	for _, k := range keys {
+		ch <- prometheus.MustNewConstMetric(
+			keyExpiryDesc,
+			prometheus.GaugeValue,
+			float64(k.Until.Unix()),
+			k.Keyid,
+			k.State,
+		)
+	}
+	if !keysImported.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			pubringAgeDesc,
+			prometheus.GaugeValue,
+			time.Since(keysImported).Seconds(),
+		)
+	}
+	if haveStats {
+		ch <- prometheus.MustNewConstMetric(
+			mlist2AgeDesc,
+			prometheus.GaugeValue,
+			time.Since(statsGenerated).Seconds(),
+		)
+	}
+}
+
+// metricsHandler returns an HTTP handler that serves the remailer's metrics
+// in the Prometheus exposition format.
+func metricsHandler(secret *keymgr.Secring) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		remailerCollector{secret: secret},
+		batchSizes,
+		smtpDeliveries,
+		smtpLatency,
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return mux
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	testPoolDirs(t)
+	dir := t.TempDir()
+	Pubring = keymgr.NewPubring(
+		path.Join(dir, "pubring.mix"),
+		path.Join(dir, "mlist2.txt"),
+	)
+	secret := keymgr.NewSecring(
+		path.Join(dir, "secring.mix"),
+		path.Join(dir, "key.txt"),
+	)
+	secret.SetValidity(14, 28)
+	pub, sec := packet.GenerateKey()
+	keyid := secret.Insert(pub, sec)
+	err := os.WriteFile(path.Join(cfg.Files.Pooldir, "m1"), []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = new(statistics)
+	stats.inMail = 3
+	stats.reject(errReplay)
+	stats.reset()
+	stats.inMail = 2
+	observeSMTP(time.Now(), errTLSPolicy)
+
+	srv := httptest.NewServer(metricsHandler(secret))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected=200, Got=%d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// Counters aren't affected by the daily reset
+		"yamn_mail_received_total 5",
+		`yamn_decode_failures_total{reason="replay"} 1`,
+		`yamn_pool_messages{prefix="m",type="outbound"} 1`,
+		`yamn_pool_bytes{prefix="m",type="outbound"} 3`,
+		`yamn_secret_key_expiry_timestamp_seconds{keyid="` + keyid + `",state="active"}`,
+		`yamn_smtp_deliveries_total{outcome="tls_policy"} 1`,
+		"yamn_smtp_delivery_duration_seconds_count",
+		"yamn_pool_batch_size_count",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics don't contain: %s", want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/crandom"
+)
+
+// MixStrategy decides which messages in the outbound pool should be sent.
+// Strategies are given the pool contents, rather than reading the pool
+// directory, so they can be tested in isolation.
+type MixStrategy interface {
+	// Batch returns the filenames of the pool messages to send at time now
+	Batch(pool []poolMessage, now time.Time) []string
+}
+
+// poolMessage describes a message waiting in the outbound pool
+type poolMessage struct {
+	name    string    // Pool filename
+	pooled  time.Time // When the message entered the pool
+	release time.Time // Sender-chosen release time (zero if not held)
+	next    time.Time // Earliest retry of a failed delivery
+}
+
+// poolContents returns the outbound messages in the pool
+func poolContents() (pool []poolMessage, err error) {
+	filenames, err := readDir(cfg.Files.Pooldir, "m")
+	if err != nil {
+		return
+	}
+	for _, filename := range filenames {
+		fqfn := path.Join(cfg.Files.Pooldir, filename)
+		fi, err := os.Stat(fqfn)
+		if err != nil {
+			// The file may have been sent since the dir was read
+			continue
+		}
+		m := poolMessage{name: filename, pooled: fi.ModTime()}
+		_, h, err := readPoolFile(fqfn)
+		if err != nil {
+			// Malformed messages are dealt with when mailed.  Don't
+			// hold them here.
+			log.Warnf("%s: %s", filename, err)
+		}
+		m.release = h.release
+		m.next = h.next
+		pool = append(pool, m)
+	}
+	return
+}
+
+// dueMessages returns the pool messages that are neither held by the sender
+// nor waiting to retry a failed delivery at time now.  Messages that aren't
+// due are invisible to the mix strategy so they neither count towards the pool
+// size nor get sent early.
+func dueMessages(pool []poolMessage, now time.Time) (due []poolMessage) {
+	for _, m := range pool {
+		if m.release.After(now) || m.next.After(now) {
+			continue
+		}
+		due = append(due, m)
+	}
+	return
+}
+
+// poolNames returns a randomly ordered list of pool filenames
+func poolNames(pool []poolMessage) (names []string) {
+	for _, m := range pool {
+		names = append(names, m.name)
+	}
+	crandom.Shuffle(names)
+	return
+}
+
+// newMixStrategy returns the MixStrategy defined in the pool config
+func newMixStrategy() (MixStrategy, error) {
+	switch cfg.Pool.Type {
+	case "binomial":
+		return &binomialPool{
+			size:    cfg.Pool.Size,
+			minSend: cfg.Pool.MinSend,
+			rate:    cfg.Pool.Rate,
+		}, nil
+	case "dynamic":
+		return &dynamicPool{size: cfg.Pool.Size, rate: cfg.Pool.Rate}, nil
+	case "threshold":
+		return &thresholdPool{threshold: cfg.Pool.Size}, nil
+	case "stopgo":
+		return newStopAndGoPool(time.Duration(cfg.Pool.Delay) * time.Minute), nil
+	}
+	return nil, fmt.Errorf("%s: Unknown pool type", cfg.Pool.Type)
+}
+
+// binomialPool sends a batch of messages selected from the pool using a
+// Probability B/P method of selecting each message.
+type binomialPool struct {
+	size    int // Minimum messages to keep in pool
+	minSend int // Minimum number of messages to consider sending
+	rate    int // Percentage of Pool in the batch
+}
+
+// batchSize takes a Pool size and returns a corresponding batch size.
+func (b *binomialPool) batchSize(poolSize int) int {
+	if poolSize < (b.size + b.minSend) {
+		return 0
+	}
+	sendable := poolSize - b.size
+	rate := float32(b.rate) / 100
+	maxSend := max(1, int(float32(poolSize)*rate))
+	return min(sendable, maxSend)
+}
+
+// Batch returns a subset of the pool, shuffled and then filtered by a biased
+// coin-toss.
+func (b *binomialPool) Batch(pool []poolMessage, now time.Time) (batch []string) {
+	poolSize := len(pool)
+	batchSize := b.batchSize(poolSize)
+	if batchSize == 0 {
+		log.Tracef("Binomial Mix Pool: Size=%d", poolSize)
+		// If the batch is empty, don't bother to process it.
+		return
+	}
+	// Shuffle the filenames as we're only going to consider a subset in the
+	// following loop.
+	names := poolNames(pool)
+	// Multiply probability by 255 as dice() returns 0-255.
+	prob := int((float32(batchSize) / float32(poolSize)) * 255)
+	// Test each pool filename against a biased coin-toss
+	for _, s := range names[:batchSize] {
+		if prob >= crandom.Dice() {
+			batch = append(batch, s)
+		}
+	}
+	log.Tracef(
+		"Binomial Mix Pool: Size=%d, Batch=%d, Prob=%d/255, Sending=%d",
+		poolSize,
+		batchSize,
+		prob,
+		len(batch),
+	)
+	return
+}
+
+// dynamicPool is a Mixmaster-style timed dynamic pool.  Each time it's
+// called, it sends a random selection of rate% of the pool while retaining
+// at least size messages.
+type dynamicPool struct {
+	size int // Minimum messages to keep in pool
+	rate int // Percentage of Pool to send
+}
+
+// Batch returns a random selection of min(poolSize - size, poolSize * rate%)
+// messages.
+func (d *dynamicPool) Batch(pool []poolMessage, now time.Time) (batch []string) {
+	poolSize := len(pool)
+	if poolSize <= d.size {
+		log.Tracef("Dynamic Mix Pool: Size=%d", poolSize)
+		return
+	}
+	batchSize := min(poolSize-d.size, max(1, poolSize*d.rate/100))
+	batch = poolNames(pool)[:batchSize]
+	log.Tracef("Dynamic Mix Pool: Size=%d, Sending=%d", poolSize, batchSize)
+	return
+}
+
+// thresholdPool accumulates messages until the pool reaches threshold and
+// then sends them all.
+type thresholdPool struct {
+	threshold int // Number of messages that triggers a flush
+}
+
+// Batch returns the entire pool once it reaches the threshold.
+func (t *thresholdPool) Batch(pool []poolMessage, now time.Time) (batch []string) {
+	if len(pool) < t.threshold {
+		log.Tracef("Threshold Mix Pool: Size=%d", len(pool))
+		return
+	}
+	batch = poolNames(pool)
+	log.Tracef("Threshold Mix Pool: Sending=%d", len(batch))
+	return
+}
+
+// stopAndGoPool delays each message independently by a random, exponentially
+// distributed, period.  Release times are held in memory so they're
+// redrawn if the remailer restarts.
+type stopAndGoPool struct {
+	release map[string]time.Time // Release time for each pool message
+	delay   func() time.Duration // Source of per-message delays
+}
+
+// newStopAndGoPool returns a stopAndGoPool with delays averaging mean
+func newStopAndGoPool(mean time.Duration) *stopAndGoPool {
+	return &stopAndGoPool{
+		release: make(map[string]time.Time),
+		delay: func() time.Duration {
+			return time.Duration(crandom.ExpFloat64() * float64(mean))
+		},
+	}
+}
+
+// Batch returns every message whose release time has passed.
+func (s *stopAndGoPool) Batch(pool []poolMessage, now time.Time) (batch []string) {
+	inPool := make(map[string]bool)
+	for _, m := range pool {
+		inPool[m.name] = true
+		release, known := s.release[m.name]
+		if !known {
+			release = m.pooled.Add(s.delay())
+			s.release[m.name] = release
+		}
+		if !now.Before(release) {
+			batch = append(batch, m.name)
+		}
+	}
+	// Forget messages that are no longer in the pool
+	for name := range s.release {
+		if !inPool[name] {
+			delete(s.release, name)
+		}
+	}
+	log.Tracef("Stop-and-Go Mix Pool: Size=%d, Sending=%d", len(pool), len(batch))
+	return
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testPool returns a pool of n messages, all pooled at time t
+func testPool(n int, t time.Time) (pool []poolMessage) {
+	for i := 0; i < n; i++ {
+		pool = append(pool, poolMessage{name: fmt.Sprintf("m%02d", i), pooled: t})
+	}
+	return
+}
+
+func TestBinomialPool(t *testing.T) {
+	b := &binomialPool{size: 5, minSend: 5, rate: 65}
+	now := time.Now()
+	if batch := b.Batch(testPool(9, now), now); len(batch) != 0 {
+		t.Errorf("Expected no messages below size+minSend, got %d", len(batch))
+	}
+	tests := []struct {
+		poolSize  int
+		batchSize int
+	}{
+		{10, 5},
+		{20, 13},
+		{100, 65},
+	}
+	for _, test := range tests {
+		if got := b.batchSize(test.poolSize); got != test.batchSize {
+			t.Errorf("Pool=%d: Expected batch of %d, got %d", test.poolSize, test.batchSize, got)
+		}
+		batch := b.Batch(testPool(test.poolSize, now), now)
+		if len(batch) > test.batchSize {
+			t.Errorf("Pool=%d: Sent %d exceeds batch of %d", test.poolSize, len(batch), test.batchSize)
+		}
+	}
+}
+
+func TestDynamicPool(t *testing.T) {
+	d := &dynamicPool{size: 5, rate: 65}
+	now := time.Now()
+	if batch := d.Batch(testPool(5, now), now); len(batch) != 0 {
+		t.Errorf("Expected no messages at minimum pool size, got %d", len(batch))
+	}
+	if batch := d.Batch(testPool(8, now), now); len(batch) != 3 {
+		t.Errorf("Expected to retain 5 messages, sent %d of 8", len(batch))
+	}
+	batch := d.Batch(testPool(100, now), now)
+	if len(batch) != 65 {
+		t.Errorf("Expected to send 65%% of 100 messages, sent %d", len(batch))
+	}
+	unique := make(map[string]bool)
+	for _, name := range batch {
+		unique[name] = true
+	}
+	if len(unique) != len(batch) {
+		t.Error("Dynamic pool batch contains duplicate messages")
+	}
+}
+
+func TestThresholdPool(t *testing.T) {
+	p := &thresholdPool{threshold: 10}
+	now := time.Now()
+	if batch := p.Batch(testPool(9, now), now); len(batch) != 0 {
+		t.Errorf("Expected no messages below threshold, got %d", len(batch))
+	}
+	if batch := p.Batch(testPool(10, now), now); len(batch) != 10 {
+		t.Errorf("Expected entire pool at threshold, got %d", len(batch))
+	}
+}
+
+func TestStopAndGoPool(t *testing.T) {
+	s := newStopAndGoPool(time.Hour)
+	// Message n is delayed by n minutes
+	var n int
+	s.delay = func() time.Duration {
+		d := time.Duration(n) * time.Minute
+		n++
+		return d
+	}
+	start := time.Now()
+	pool := testPool(10, start)
+	if batch := s.Batch(pool, start.Add(90*time.Second)); len(batch) != 2 {
+		t.Errorf("Expected 2 messages released after 90s, got %d", len(batch))
+	}
+	// Delays shouldn't be redrawn on subsequent calls
+	if batch := s.Batch(pool, start.Add(90*time.Second)); len(batch) != 2 {
+		t.Errorf("Expected release times to be retained, got %d", len(batch))
+	}
+	// Messages that leave the pool are forgotten
+	if batch := s.Batch(pool[5:], start.Add(10*time.Minute)); len(batch) != 5 {
+		t.Errorf("Expected all 5 remaining messages released, got %d", len(batch))
+	}
+	if len(s.release) != 5 {
+		t.Errorf("Expected 5 release times retained, got %d", len(s.release))
+	}
+	// The default delay source should produce non-negative delays
+	s = newStopAndGoPool(time.Minute)
+	for i := 0; i < 100; i++ {
+		if d := s.delay(); d < 0 {
+			t.Fatalf("Negative delay: %s", d)
+		}
+	}
+}
+
+func TestDueMessages(t *testing.T) {
+	now := time.Now()
+	pool := testPool(5, now)
+	pool[1].release = now.Add(-time.Minute)
+	pool[2].release = now.Add(time.Minute)
+	pool[3].release = now
+	pool[4].next = now.Add(time.Minute)
+	due := dueMessages(pool, now)
+	if len(due) != 3 {
+		t.Fatalf("Expected 3 due messages, got %d", len(due))
+	}
+	for _, m := range due {
+		if m.name == pool[2].name || m.name == pool[4].name {
+			t.Errorf("%s is due before its release or retry time", m.name)
+		}
+	}
+}
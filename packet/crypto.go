@@ -0,0 +1,32 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// aesCtr does encrypt and decrypt of aes_ctr mode
+func aesCtr(in, key, iv []byte) (out []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out = make([]byte, len(in))
+	stream := cipher.NewCTR(block, iv)
+	stream.XORKeyStream(out, in)
+	return
+}
+
+// aesGcm returns an AES-GCM AEAD for the given key.  The nonce is supplied by
+// the caller as part of the v3 Final header.
+func aesGcm(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
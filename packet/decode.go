@@ -0,0 +1,201 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned when a packet is malformed.  These are wrapped with
+// additional context so should be tested with errors.Is.
+var (
+	ErrBadVersion = errors.New("unsupported packet version")
+	ErrBadLength  = errors.New("incorrect length")
+	ErrBodyLength = errors.New("body length out of range")
+	ErrBadChunk   = errors.New("invalid chunk numbering")
+	ErrPacketType = errors.New("unknown packet type")
+)
+
+// Errors returned when a well-formed packet is rejected.
+var (
+	ErrUnknownKeyID = errors.New("unknown recipient keyid")
+	ErrHeaderAuth   = errors.New("header authentication failed")
+	ErrAntiTag      = errors.New("anti-tag digest mismatch")
+	ErrBodyAuth     = errors.New("body authentication failed")
+)
+
+// SecretKeys is implemented by anything that can return a Secret Key for a
+// given hex encoded keyid.  keymgr.Secring satisfies this interface.
+type SecretKeys interface {
+	GetSK(keyid string) ([]byte, error)
+}
+
+// Decoder decodes YAMN packets addressed to the holder of a secret keyring.
+type Decoder struct {
+	keys SecretKeys
+}
+
+// NewDecoder returns a Decoder that looks up Secret Keys in keys.
+func NewDecoder(keys SecretKeys) *Decoder {
+	return &Decoder{keys: keys}
+}
+
+// Hop is the result of decoding a packet.  It will either be an
+// *Intermediate or an *Exit.
+type Hop interface {
+	Version() int
+	PacketID() []byte
+	Age() int
+	Delay() time.Duration
+}
+
+// hopHeader provides the Hop methods common to all decoded packet types.
+type hopHeader struct {
+	data *slotData
+}
+
+// Version returns the packet version of the decoded header.
+func (h hopHeader) Version() int {
+	return int(h.data.version)
+}
+
+// PacketID returns the Packet-ID from the decoded Slot Data.
+func (h hopHeader) PacketID() []byte {
+	return h.data.getPacketID()
+}
+
+// Age returns the age of the packet's timestamp in days.
+func (h hopHeader) Age() int {
+	return h.data.ageTimestamp()
+}
+
+// Delay returns how long the sender asked this hop to hold the packet.  It's
+// always zero prior to v4.
+func (h hopHeader) Delay() time.Duration {
+	return h.data.getDelay()
+}
+
+// Intermediate is a decoded packet that needs to be forwarded to another
+// remailer.
+type Intermediate struct {
+	hopHeader
+	NextHop string // Address of the next hop remailer
+	Packet  []byte // The packet to send to NextHop
+}
+
+// Exit is a decoded packet where this remailer is the final hop.
+type Exit struct {
+	hopHeader
+	Final *Final // The decoded Final hop header
+	Body  []byte // The decrypted payload body
+}
+
+// Decode decrypts the top header of a packet and returns the resulting
+// Intermediate or Exit hop.
+func (d *Decoder) Decode(packet []byte) (hop Hop, err error) {
+	// At this point, packet should always be MessageBytes in length
+	err = lenCheck(len(packet), MessageBytes)
+	if err != nil {
+		return
+	}
+	m, err := newDecMessage(packet)
+	if err != nil {
+		return
+	}
+	// Extract the top header
+	header, err := newDecodeHeader(m.getHeader())
+	if err != nil {
+		return
+	}
+	recipientKeyID := header.getRecipientKeyID()
+	recipientSK, err := d.keys.GetSK(recipientKeyID)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrUnknownKeyID, err)
+		return
+	}
+	err = header.setRecipientSK(recipientSK)
+	if err != nil {
+		return
+	}
+	slotDataBytes, packetVersion, err := header.decode()
+	if err != nil {
+		return
+	}
+	switch packetVersion {
+	case 2, 3, 4:
+		// Versions 2 and 3 only differ in the Exit hop body encryption.
+		// Version 4 adds a delay to the Slot Data.
+		hop, err = decodeV2(m, slotDataBytes)
+	default:
+		err = fmt.Errorf("%w: %d", ErrBadVersion, packetVersion)
+	}
+	return
+}
+
+// decodeV2 decodes the Slot Data and payload of a version 2, 3 or 4 packet.
+func decodeV2(m *decMessage, slotDataBytes []byte) (hop Hop, err error) {
+	// Convert the raw Slot Data Bytes to meaningful slotData.
+	slotData, err := decodeSlotData(slotDataBytes)
+	if err != nil {
+		return
+	}
+	var tagOK bool
+	if slotData.getPacketType() == 2 {
+		// Reply Blocks are created before the body exists so the
+		// digest on Reply hops only covers the headers.
+		tagOK = m.testHeaderTag(slotData.getTagHash())
+	} else {
+		tagOK = m.testAntiTag(slotData.getTagHash())
+	}
+	if !tagOK {
+		err = ErrAntiTag
+		return
+	}
+	switch slotData.getPacketType() {
+	case 0, 2:
+		m.shiftHeaders()
+		// Decode Intermediate
+		var inter *slotIntermediate
+		inter, err = decodeIntermediate(slotData.packetInfo)
+		if err != nil {
+			return
+		}
+		err = m.decryptAll(slotData.aesKey, inter.aesIV12)
+		if err != nil {
+			return
+		}
+		hop = &Intermediate{
+			hopHeader: hopHeader{data: slotData},
+			NextHop:   inter.getNextHop(),
+			Packet:    m.getPayload(),
+		}
+	case 1:
+		// Decode Exit
+		var final *Final
+		final, err = decodeFinal(slotData.packetInfo, int(slotData.version))
+		if err != nil {
+			return
+		}
+		var body []byte
+		if slotData.version >= 3 {
+			body, err = m.openBody(slotData.getAesKey(), final)
+		} else {
+			body, err = m.decryptBody(
+				slotData.getAesKey(),
+				final.getAesIV(),
+				final.BodyBytes(),
+			)
+		}
+		if err != nil {
+			return
+		}
+		hop = &Exit{
+			hopHeader: hopHeader{data: slotData},
+			Final:     final,
+			Body:      body,
+		}
+	default:
+		err = fmt.Errorf("%w: %d", ErrPacketType, slotData.getPacketType())
+	}
+	return
+}
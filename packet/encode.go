@@ -0,0 +1,232 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+)
+
+// Encoder constructs YAMN packets for a resolved chain of remailers.
+type Encoder struct {
+	chain   []keymgr.Remailer // Entry remailer first, Exit remailer last
+	final   *Final            // Describes the Exit hop
+	version int               // Packet version to encode
+	delays  []time.Duration   // Per-hop delays (v4)
+}
+
+// NewEncoder returns an Encoder for the given chain and Final hop
+// descriptor.  The first remailer in the chain is the entry hop and the last
+// is the Exit.  The highest packet version supported by every remailer in the
+// chain will be encoded.
+func NewEncoder(chain []keymgr.Remailer, final *Final) (e *Encoder, err error) {
+	err = validateChain(chain, MaxChainLength)
+	if err != nil {
+		return
+	}
+	if final == nil {
+		final = NewFinal()
+	}
+	e = &Encoder{
+		chain:   append(chain[:0:0], chain...),
+		final:   final,
+		version: chainVersion(chain),
+	}
+	return
+}
+
+// validateChain tests that a chain can be encoded.
+func validateChain(chain []keymgr.Remailer, maxLength int) (err error) {
+	if len(chain) == 0 {
+		err = errors.New("cannot encode to an empty chain")
+		return
+	}
+	if len(chain) > maxLength {
+		err = fmt.Errorf(
+			"specified chain length (%d) exceeds maximum chain length (%d)",
+			len(chain),
+			maxLength,
+		)
+		return
+	}
+	for _, remailer := range chain {
+		if len(remailer.Keyid) != 16 || len(remailer.PK) != 32 {
+			err = fmt.Errorf("%s: Invalid public key", remailer.Address)
+			return
+		}
+		if len(remailer.Address) > 52 {
+			err = fmt.Errorf("%s: Address exceeds 52 chars", remailer.Address)
+			return
+		}
+	}
+	return
+}
+
+// chainVersion returns the highest packet version supported by every
+// remailer in a chain.
+func chainVersion(chain []keymgr.Remailer) (version int) {
+	for _, v := range Versions {
+		for _, remailer := range chain {
+			if !remailer.SupportsVersion(v) {
+				return
+			}
+		}
+		version = v
+	}
+	return
+}
+
+// Version returns the packet version the Encoder will produce.
+func (e *Encoder) Version() int {
+	return e.version
+}
+
+// SetDelays defines how long each hop in the chain should hold the packet
+// before forwarding it.  Delays are ordered as the chain and are rounded to
+// the nearest minute.  Delays require every remailer in the chain to support
+// v4 packets.
+func (e *Encoder) SetDelays(delays []time.Duration) (err error) {
+	if e.version < 4 {
+		err = fmt.Errorf(
+			"%w: per-hop delays require v4, chain supports v%d",
+			ErrBadVersion,
+			e.version,
+		)
+		return
+	}
+	if len(delays) != len(e.chain) {
+		err = fmt.Errorf(
+			"%d delays specified for a chain of %d hops",
+			len(delays),
+			len(e.chain),
+		)
+		return
+	}
+	for _, d := range delays {
+		if d < 0 || d > MaxDelay {
+			err = fmt.Errorf("delay (%s) out of range (0-%s)", d, MaxDelay)
+			return
+		}
+	}
+	e.delays = append(delays[:0:0], delays...)
+	return
+}
+
+// delay returns the delay for the hop at position n in the chain
+func (e *Encoder) delay(n int) time.Duration {
+	if e.delays == nil {
+		return 0
+	}
+	return e.delays[n]
+}
+
+// Encode encodes a plaintext fragment into a YAMN packet.  The returned
+// packet is always MessageBytes in length and should be sent to the first
+// remailer in the Encoder's chain.
+func (e *Encoder) Encode(plain []byte) (packet []byte, err error) {
+	if len(plain) > BodyBytes {
+		err = fmt.Errorf(
+			"payload (%d) exceeds max length (%d)",
+			len(plain),
+			BodyBytes,
+		)
+		return
+	}
+	// Take a copy of the Final so that multiple encodings don't interfere
+	// with one another.
+	final := *e.final
+	final.version = uint8(e.version)
+	chain := append(e.chain[:0:0], e.chain...)
+	m := newEncMessage()
+	m.setChainLength(len(chain))
+	length := m.setPlainText(plain)
+	// Pop the exit remailer from the chain
+	hop := popRemailer(&chain)
+	// hopNum tracks the position of hop in the chain
+	hopNum := len(chain)
+	// Insert the plain message length into the Final Hop header.
+	final.setBodyBytes(length)
+	slotData := newSlotData()
+	slotData.setVersion(e.version)
+	slotData.setDelay(e.delay(hopNum))
+	// Identify this hop as Packet-Type 1 (Exit).
+	slotData.setExit()
+	// For exit hops, the AES key can be entirely random.
+	slotData.setAesKey(crandom.Randbytes(32))
+	// Override the random PacketID so that multi-copy messages all share a
+	// common Exit PacketID.
+	slotData.setPacketID(final.getPacketID())
+	// Only the body needs to be encrypted during Exit encoding.  At all other
+	// hops, the entire header stack will also need encrypting.  In v3, the
+	// authentication tag is stored in the Final so this must happen before
+	// the Final is encoded.
+	if e.version >= 3 {
+		m.sealBody(slotData.aesKey, &final)
+	} else {
+		m.encryptBody(slotData.aesKey, final.aesIV)
+	}
+	// Encode the (final) Packet Info and store it in the Slot Data.
+	slotData.setPacketInfo(final.encode())
+	// Create a new Header.
+	header := newEncodeHeader()
+	// Tell the header function what KeyID and PK to NaCl encrypt with.
+	header.setRecipient(hop.Keyid, hop.PK)
+	// Shift all the header down by headerBytes
+	m.shiftHeaders()
+	// We've already popped an entry from the Chain so were testing for
+	// length greater than zero rather than 1.
+	if len(chain) > 0 {
+		// Single hop chains don't require deterministic headers.  All
+		// longer chains do.
+		m.deterministic(0)
+	}
+	// Set the Anti-tag hash in the slotData.
+	slotData.setTagHash(m.getAntiTag())
+	// Encode the slot data into Byte form.
+	slotDataBytes := slotData.encode()
+	// Encode the header and insert it into the payload.
+	m.insertHeader(header.encode(slotDataBytes))
+
+	// That concludes Exit hop compilation.  Now for intermediates.
+
+	interHops := m.getIntermediateHops()
+	for interHop := 0; interHop < interHops; interHop++ {
+		inter := newSlotIntermediate()
+		inter.setPartialIV(m.getPartialIV(interHop))
+		// hop still contains the previous iteration (or exit) remailer.
+		inter.setNextHop(hop.Address)
+		// Pop another remailer from the left side of the Chain
+		hop = popRemailer(&chain)
+		hopNum--
+		// Create new Slot Data
+		slotData = newSlotData()
+		slotData.setVersion(e.version)
+		slotData.setDelay(e.delay(hopNum))
+		slotData.setAesKey(m.getKey(interHop))
+		slotData.setPacketInfo(inter.encode())
+		m.encryptAll(interHop)
+		m.shiftHeaders()
+		m.deterministic(interHop + 1)
+		slotData.setTagHash(m.getAntiTag())
+		slotDataBytes = slotData.encode()
+		header = newEncodeHeader()
+		header.setRecipient(hop.Keyid, hop.PK)
+		m.insertHeader(header.encode(slotDataBytes))
+	}
+	if len(chain) != 0 {
+		err = errors.New("after encoding, chain was not empty")
+		return
+	}
+	packet = m.getPayload()
+	return
+}
+
+// popRemailer takes a pointer to a Remailer slice and pops the last element
+func popRemailer(s *[]keymgr.Remailer) (element keymgr.Remailer) {
+	slice := *s
+	element, slice = slice[len(slice)-1], slice[:len(slice)-1]
+	*s = slice
+	return
+}
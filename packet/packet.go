@@ -1,4 +1,5 @@
-package main
+// Package packet implements encoding and decoding of YAMN packets.
+package packet
 
 import (
 	"bytes"
@@ -7,6 +8,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -17,18 +19,32 @@ import (
 )
 
 const (
-	maxChainLength  = 10
+	MaxChainLength  = 10  // Maximum number of hops in a chain
 	headerBytes     = 256 // An entire header slot
 	encHeadBytes    = 160 // The encrypted component of a header
 	encDataBytes    = 64  // Exit / Intermediate header component
-	headersBytes    = headerBytes * maxChainLength
+	headersBytes    = headerBytes * MaxChainLength
 	encHeadersBytes = headersBytes - headerBytes
-	bodyBytes       = 17920
-	messageBytes    = headersBytes + bodyBytes
+	BodyBytes       = 17920                    // Size of the payload body
+	MessageBytes    = headersBytes + BodyBytes // Size of a complete packet
 )
 
-// Generate a public/private ECC key pair
-func eccGenerate() (pk, sk []byte) {
+// Versions lists the packet versions this library can encode and decode.
+var Versions = []int{2, 3, 4}
+
+// MaxDelay is the longest per-hop delay that can be encoded in a v4 packet.
+const MaxDelay = math.MaxUint16 * time.Minute
+
+// Delivery methods understood by Exit remailers
+const (
+	DeliverSMTP  = 0
+	DeliverReply = 1 // Attach the body to a Reply Block and forward it
+	DeliverPing  = 2 // A ping returning to the pinger that sent it
+	DeliverDummy = 255
+)
+
+// GenerateKey creates a public/private ECC key pair
+func GenerateKey() (pk, sk []byte) {
 	pka, ska, err := box.GenerateKey(rand.Reader)
 	if err != nil {
 		panic(err)
@@ -116,16 +132,16 @@ type decodeHeader struct {
 	recipientSK  [32]byte
 }
 
-func newDecodeHeader(b []byte) *decodeHeader {
-	err := lenCheck(len(b), headerBytes)
+func newDecodeHeader(b []byte) (h *decodeHeader, err error) {
+	err = lenCheck(len(b), headerBytes)
 	if err != nil {
-		panic(err)
+		return
 	}
-	h := new(decodeHeader)
+	h = new(decodeHeader)
 	h.header = make([]byte, 256)
 	copy(h.header, b)
 	h.gotRecipient = false
-	return h
+	return
 }
 
 // getRecipientKeyID returns the encoded keyid as a string.  This is required
@@ -137,19 +153,20 @@ func (h *decodeHeader) getRecipientKeyID() (keyid string) {
 
 // setRecipientSK defines the Secret Key that will be used to decrypt the
 // Encrypted Header component.
-func (h *decodeHeader) setRecipientSK(recipientSK []byte) {
-	err := lenCheck(len(recipientSK), 32)
+func (h *decodeHeader) setRecipientSK(recipientSK []byte) (err error) {
+	err = lenCheck(len(recipientSK), 32)
 	if err != nil {
-		panic(err)
+		return
 	}
 	copy(h.recipientSK[:], recipientSK)
 	h.gotRecipient = true
+	return
 }
 
 func (h *decodeHeader) decode() (data []byte, version int, err error) {
 	if !h.gotRecipient {
 		err = errors.New("cannot decode header until recipient defined")
-		panic(err)
+		return
 	}
 	// Length to decode should be lenEndBytes plus the NaCl Box overhead
 	var senderPK [32]byte
@@ -164,7 +181,7 @@ func (h *decodeHeader) decode() (data []byte, version int, err error) {
 		&h.recipientSK,
 	)
 	if !auth {
-		err = errors.New("authentication failed decrypting slot data")
+		err = ErrHeaderAuth
 		return
 	}
 	// Version number is the first byte of decrypted data
@@ -185,8 +202,19 @@ Encrypted data
 [ Padding		 11 Bytes ]
 Total	160 Bytes
 
-Packet Type: 0=Intermediate 1=Exit
+Packet Type: 0=Intermediate 1=Exit 2=Reply
 Delivery protocol: 0=SMTP
+
+Version 4 packets carry a per-hop delay in the padding.  The hop holds the
+packet in its pool for this many minutes before forwarding or delivering it.
+Slot Data is shared by Intermediate and Exit hops so the delay applies to
+both.
+
+Encrypted data (v4)
+[ As v2/v3		149 Bytes ]
+[ Delay (minutes)	  2 Bytes ]
+[ Padding		  9 Bytes ]
+Total	160 Bytes
 */
 type slotData struct {
 	version       uint8
@@ -200,6 +228,7 @@ type slotData struct {
 	packetInfo    []byte
 	gotTagHash    bool // Test if Anti-tag hash has been defined
 	tagHash       []byte
+	delay         uint16 // Minutes to hold the packet (v4)
 }
 
 func newSlotData() *slotData {
@@ -210,7 +239,7 @@ func newSlotData() *slotData {
 	ts -= int64(crandom.Dice() % 4)
 	binary.LittleEndian.PutUint16(timestamp, uint16(ts))
 	return &slotData{
-		version:    2, // This packet format is v2
+		version:    2, // Default packet format is v2
 		packetType: 0,
 		protocol:   0,
 		// packetID is random for intermediate hops but needs to be
@@ -225,6 +254,12 @@ func newSlotData() *slotData {
 	}
 }
 
+// setVersion overrides the default packet version (2).  Versions 2 and 3
+// share a common Slot Data format.  Version 4 adds a delay.
+func (head *slotData) setVersion(version int) {
+	head.version = uint8(version)
+}
+
 // getPacketID returns the Packet-ID from the Slot Data.
 func (head *slotData) getPacketID() []byte {
 	return head.packetID
@@ -240,6 +275,12 @@ func (head *slotData) setExit() {
 	head.packetType = 1
 }
 
+// setReply overrides the default Packet Type (0 = Intermediate) with a Reply
+// Packet Type (Reply = 2).  Reply hops are Intermediates within a Reply Block.
+func (head *slotData) setReply() {
+	head.packetType = 2
+}
+
 func (head *slotData) getAesKey() []byte {
 	return head.aesKey
 }
@@ -279,6 +320,21 @@ func (head *slotData) getTagHash() []byte {
 	return head.tagHash
 }
 
+// setDelay defines how long the hop should hold the packet.  The delay is
+// rounded to the nearest minute and is only encoded in v4 packets.
+func (head *slotData) setDelay(d time.Duration) {
+	if d < 0 || d > MaxDelay {
+		err := fmt.Errorf("delay (%s) out of range (0-%s)", d, MaxDelay)
+		panic(err)
+	}
+	head.delay = uint16(d.Round(time.Minute) / time.Minute)
+}
+
+// getDelay returns how long the hop should hold the packet.
+func (head *slotData) getDelay() time.Duration {
+	return time.Duration(head.delay) * time.Minute
+}
+
 func (head *slotData) setPacketInfo(ei []byte) {
 	err := lenCheck(len(ei), encDataBytes)
 	if err != nil {
@@ -335,22 +391,27 @@ func (head *slotData) encode() []byte {
 	if err != nil {
 		panic(err)
 	}
+	if head.version >= 4 {
+		tmp := make([]byte, 2)
+		binary.LittleEndian.PutUint16(tmp, head.delay)
+		buf.Write(tmp)
+	}
 	buf.WriteString(strings.Repeat("\x00", encHeadBytes-buf.Len()))
 	return buf.Bytes()
 }
 
-func decodeSlotData(b []byte) *slotData {
-	err := lenCheck(len(b), encHeadBytes)
+func decodeSlotData(b []byte) (head *slotData, err error) {
+	err = lenCheck(len(b), encHeadBytes)
 	if err != nil {
-		panic(err)
+		return
 	}
 	// Test the correct libary is being employed for the packet version
 	version := int(b[0])
-	if version != 2 {
-		err := fmt.Errorf("attempt to decode packet v%d with v2 library", version)
-		panic(err)
+	if version < 2 || version > 4 {
+		err = fmt.Errorf("%w: attempt to decode packet v%d with v2-v4 library", ErrBadVersion, version)
+		return
 	}
-	return &slotData{
+	head = &slotData{
 		version:    b[0],
 		packetType: b[1],
 		protocol:   b[2],
@@ -360,6 +421,10 @@ func decodeSlotData(b []byte) *slotData {
 		packetInfo: b[53:117],
 		tagHash:    b[117:149],
 	}
+	if version >= 4 {
+		head.delay = binary.LittleEndian.Uint16(b[149:151])
+	}
+	return
 }
 
 /*
@@ -373,10 +438,28 @@ Enyrypted Final
 [ Padding		 25 Bytes ]
 Total	64 Bytes
 
-Delivery methods: 0=SMTP, 255=Dummy
+Delivery methods: 0=SMTP, 1=Reply, 2=Ping, 255=Dummy
+
+Version 3 (and later) packets replace the AES-CTR encrypted body with AES-GCM.
+The body length and other Final fields are included in the authenticated
+data.
+
+Enyrypted Final (v3)
+[ AES-GCM Nonce		 12 Bytes ]
+[ Chunk num		  1 Byte  ]
+[ Num chunks		  1 Byte  ]
+[ Message ID		 16 Bytes ]
+[ Body length		  4 Bytes ]
+[ Delivery method	  1 Byte  ]
+[ AES-GCM Tag		 16 Bytes ]
+[ Padding		 13 Bytes ]
+Total	64 Bytes
+
+Authenticated data is the first 35 Bytes (everything preceding the Tag).
 */
-type slotFinal struct {
-	aesIV          []byte
+type Final struct {
+	version        uint8  // Not encoded but determines the encoded format
+	aesIV          []byte // 16 Byte IV (v2) or 12 Byte Nonce (v3)
 	chunkNum       uint8
 	numChunks      uint8
 	messageID      []byte
@@ -384,10 +467,12 @@ type slotFinal struct {
 	gotBodyBytes   bool
 	bodyBytes      int
 	deliveryMethod uint8
+	bodyTag        []byte // AES-GCM authentication tag (v3)
 }
 
-func newSlotFinal() *slotFinal {
-	return &slotFinal{
+func NewFinal() *Final {
+	return &Final{
+		version:        2,
 		aesIV:          crandom.Randbytes(16),
 		chunkNum:       1,
 		numChunks:      1,
@@ -398,55 +483,55 @@ func newSlotFinal() *slotFinal {
 	}
 }
 
-func (f *slotFinal) getBodyBytes() int {
+func (f *Final) BodyBytes() int {
 	return f.bodyBytes
 }
 
-func (f *slotFinal) setBodyBytes(length int) {
-	if length > bodyBytes {
-		err := fmt.Errorf("body (%d bytes) exceeds maximum (%d bytes)", length, bodyBytes)
+func (f *Final) setBodyBytes(length int) {
+	if length > BodyBytes {
+		err := fmt.Errorf("body (%d bytes) exceeds maximum (%d bytes)", length, BodyBytes)
 		panic(err)
 	}
 	f.bodyBytes = length
 	f.gotBodyBytes = true
 }
 
-func (f *slotFinal) getAesIV() []byte {
+func (f *Final) getAesIV() []byte {
 	return f.aesIV
 }
 
 // getPacketID returns the packet ID that should be copied into the Slot Data
 // for Exit Hop messages.  When creating mutliple copies, the PacketID needs to
 // be common across all exit packets to prevent duplicate deliveries.
-func (f *slotFinal) getPacketID() []byte {
+func (f *Final) getPacketID() []byte {
 	return f.packetID
 }
 
-func (f *slotFinal) getNumChunks() int {
+func (f *Final) NumChunks() int {
 	return int(f.numChunks)
 }
 
-func (f *slotFinal) setNumChunks(n int) {
+func (f *Final) SetNumChunks(n int) {
 	f.numChunks = uint8(n)
 }
 
-func (f *slotFinal) getMessageID() []byte {
+func (f *Final) MessageID() []byte {
 	return f.messageID
 }
 
-func (f *slotFinal) setDeliveryMethod(n int) {
+func (f *Final) SetDeliveryMethod(n int) {
 	f.deliveryMethod = uint8(n)
 }
 
-func (f *slotFinal) getDeliveryMethod() int {
+func (f *Final) DeliveryMethod() int {
 	return int(f.deliveryMethod)
 }
 
-func (f *slotFinal) getChunkNum() int {
+func (f *Final) ChunkNum() int {
 	return int(f.chunkNum)
 }
 
-func (f *slotFinal) setChunkNum(n int) {
+func (f *Final) SetChunkNum(n int) {
 	if uint8(n) > f.numChunks {
 		err := fmt.Errorf("attempt to set chunk num (%d) greater than defined number of chunks (%d)", n, int(f.numChunks))
 		panic(err)
@@ -454,11 +539,29 @@ func (f *slotFinal) setChunkNum(n int) {
 	f.chunkNum = uint8(n)
 }
 
-func (f *slotFinal) encode() []byte {
+// authData returns the v3 Final fields that are authenticated along with the
+// body.
+func (f *Final) authData() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(f.aesIV[:12])
+	buf.WriteByte(f.chunkNum)
+	buf.WriteByte(f.numChunks)
+	buf.Write(f.messageID)
+	tmp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(tmp, uint32(f.bodyBytes))
+	buf.Write(tmp)
+	buf.WriteByte(f.deliveryMethod)
+	return buf.Bytes()
+}
+
+func (f *Final) encode() []byte {
 	if !f.gotBodyBytes {
 		err := errors.New("cannot encode slot final before body length is defined")
 		panic(err)
 	}
+	if f.version >= 3 {
+		return f.encodeV3()
+	}
 	buf := new(bytes.Buffer)
 	buf.Write(f.aesIV)
 	buf.WriteByte(f.chunkNum)
@@ -476,12 +579,47 @@ func (f *slotFinal) encode() []byte {
 	return buf.Bytes()
 }
 
-func decodeFinal(b []byte) *slotFinal {
-	err := lenCheck(len(b), encDataBytes)
+// encodeV3 encodes a Final in v3 format.  The body must have been sealed
+// before calling this in order to populate the authentication tag.
+func (f *Final) encodeV3() []byte {
+	err := lenCheck(len(f.bodyTag), 16)
+	if err != nil {
+		panic(err)
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(f.authData())
+	buf.Write(f.bodyTag)
+	err = lenCheck(buf.Len(), 51)
 	if err != nil {
 		panic(err)
 	}
-	return &slotFinal{
+	buf.WriteString(strings.Repeat("\x00", encDataBytes-buf.Len()))
+	return buf.Bytes()
+}
+
+// decodeFinal decodes the Packet Info of an Exit hop in the format defined
+// by the packet version.
+func decodeFinal(b []byte, version int) (f *Final, err error) {
+	err = lenCheck(len(b), encDataBytes)
+	if err != nil {
+		return
+	}
+	if version >= 3 {
+		f = &Final{
+			version:        uint8(version),
+			aesIV:          b[:12],
+			chunkNum:       b[12],
+			numChunks:      b[13],
+			messageID:      b[14:30],
+			bodyBytes:      int(binary.LittleEndian.Uint32(b[30:34])),
+			deliveryMethod: b[34],
+			bodyTag:        b[35:51],
+		}
+		err = f.validate()
+		return
+	}
+	f = &Final{
+		version:        2,
 		aesIV:          b[:16],
 		chunkNum:       b[16],
 		numChunks:      b[17],
@@ -489,6 +627,31 @@ func decodeFinal(b []byte) *slotFinal {
 		bodyBytes:      int(binary.LittleEndian.Uint32(b[34:38])),
 		deliveryMethod: b[38],
 	}
+	err = f.validate()
+	return
+}
+
+// validate tests that the decoded Final fields are within sane bounds.
+func (f *Final) validate() (err error) {
+	if f.bodyBytes < 0 || f.bodyBytes > BodyBytes {
+		err = fmt.Errorf(
+			"%w: Stated=%d, Max=%d",
+			ErrBodyLength,
+			f.bodyBytes,
+			BodyBytes,
+		)
+		return
+	}
+	if f.numChunks == 0 || f.chunkNum == 0 || f.chunkNum > f.numChunks {
+		err = fmt.Errorf(
+			"%w: Chunk=%d, Chunks=%d",
+			ErrBadChunk,
+			f.chunkNum,
+			f.numChunks,
+		)
+		return
+	}
+	return
 }
 
 /* Encrypted Intermediate
@@ -572,16 +735,17 @@ func (s *slotIntermediate) encode() []byte {
 	return buf.Bytes()
 }
 
-func decodeIntermediate(b []byte) *slotIntermediate {
-	err := lenCheck(len(b), encDataBytes)
+func decodeIntermediate(b []byte) (s *slotIntermediate, err error) {
+	err = lenCheck(len(b), encDataBytes)
 	if err != nil {
-		panic(err)
+		return
 	}
-	return &slotIntermediate{
+	s = &slotIntermediate{
 		gotAesIV12: true,
 		aesIV12:    b[:12],
 		nextHop:    b[12:],
 	}
+	return
 }
 
 // ----- Deterministic Headers -----
@@ -589,8 +753,8 @@ type encMessage struct {
 	gotPayload       bool   // Test if a Payload has been submitted
 	payload          []byte // The actual Yamn message
 	plainLength      int    // Length of the plain-text bytes
-	keys             [maxChainLength - 1][]byte
-	ivs              [maxChainLength - 1][]byte
+	keys             [MaxChainLength - 1][]byte
+	ivs              [MaxChainLength - 1][]byte
 	chainLength      int // Number of hops in chain
 	intermediateHops int // Number of Intermediate hops
 	padHeaders       int // Number of padding headers
@@ -602,7 +766,7 @@ type encMessage struct {
 func newEncMessage() *encMessage {
 	return &encMessage{
 		gotPayload:  false,
-		payload:     make([]byte, messageBytes),
+		payload:     make([]byte, MessageBytes),
 		chainLength: 0,
 	}
 }
@@ -619,10 +783,10 @@ func (m *encMessage) getPayload() []byte {
 // of AES keys and IVs used to encrypt the intermediate hops.  These have to be
 // predefined as they're required to create deterministic headers.
 func (m *encMessage) setChainLength(chainLength int) {
-	if chainLength > maxChainLength {
+	if chainLength > MaxChainLength {
 		err := fmt.Errorf("specified chain length (%d) exceeds maximum chain length (%d)",
 			chainLength,
-			maxChainLength,
+			MaxChainLength,
 		)
 		panic(err)
 	}
@@ -632,7 +796,7 @@ func (m *encMessage) setChainLength(chainLength int) {
 	}
 	m.chainLength = chainLength
 	m.intermediateHops = chainLength - 1
-	m.padHeaders = maxChainLength - m.chainLength
+	m.padHeaders = MaxChainLength - m.chainLength
 	m.padBytes = m.padHeaders * headerBytes
 	// The padding bytes need to be randomized, otherwise the final
 	// intermediate remailer in the chain can know its position due to the
@@ -650,8 +814,8 @@ func (m *encMessage) setChainLength(chainLength int) {
 // its length in Bytes
 func (m *encMessage) setPlainText(plain []byte) (plainLength int) {
 	plainLength = len(plain)
-	if m.plainLength > bodyBytes {
-		err := fmt.Errorf("payload (%d) exceeds max length (%d)", plainLength, bodyBytes)
+	if m.plainLength > BodyBytes {
+		err := fmt.Errorf("payload (%d) exceeds max length (%d)", plainLength, BodyBytes)
 		panic(err)
 	}
 	// Insert the plain bytes after the headers
@@ -720,6 +884,18 @@ func (m *encMessage) getPartialIV(intermediateHop int) (ivPartial []byte) {
 	return
 }
 
+// getHeaderTag returns a digest of the header stack, excluding the body.  It's
+// used in place of getAntiTag on Reply hops where the body isn't known at
+// encoding time.
+func (m *encMessage) getHeaderTag() []byte {
+	digest, err := blake2s.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	digest.Write(m.payload[headerBytes:headersBytes])
+	return digest.Sum(nil)
+}
+
 // getAntiTag returns a digest for the entire header stack.  It needs to be run
 // before a new header is inserted but after deterministic headers are appended
 // to the bottom of the header stack.
@@ -760,6 +936,30 @@ func (m *encMessage) encryptBody(key, iv []byte) {
 	)
 }
 
+// sealBody encrypts and authenticates the body using AES-GCM.  This is the v3
+// equivalent of encryptBody.  The Final provides the nonce and authenticated
+// data and receives the resulting authentication tag.
+func (m *encMessage) sealBody(key []byte, final *Final) {
+	var err error
+	if !m.gotPayload {
+		err = errors.New("cannot seal payload until it's defined")
+		panic(err)
+	}
+	err = lenCheck(len(key), 32)
+	if err != nil {
+		panic(err)
+	}
+	aead := aesGcm(key)
+	sealed := aead.Seal(
+		nil,
+		final.aesIV[:aead.NonceSize()],
+		m.payload[headersBytes:],
+		final.authData(),
+	)
+	copy(m.payload[headersBytes:], sealed[:BodyBytes])
+	final.bodyTag = sealed[BodyBytes:]
+}
+
 // encryptAll encrypts each Header Slot in the message using a predetermined
 // AES Key and partial (12 byte) IV, plus a 4 byte sequence number base on the
 // Slot number.  Finally, the body is encrypted using the same key and partial
@@ -770,11 +970,11 @@ func (m *encMessage) encryptAll(hop int) {
 	var iv []byte
 	/*
 		* This should run before headers are shifted down *
-		For maxChainLength = 10:-
+		For MaxChainLength = 10:-
 		IVs 0-8 are used to encrypt headers
 		IV 9 is used to encrypt the payload
 	*/
-	for slot := 0; slot < maxChainLength; slot++ {
+	for slot := 0; slot < MaxChainLength; slot++ {
 		sbyte := slot * headerBytes
 		ebyte := (slot + 1) * headerBytes
 		iv = m.getIV(hop, slot)
@@ -783,7 +983,7 @@ func (m *encMessage) encryptAll(hop int) {
 			aesCtr(m.payload[sbyte:ebyte], key, iv),
 		)
 	}
-	iv = m.getIV(hop, maxChainLength)
+	iv = m.getIV(hop, MaxChainLength)
 	copy(
 		m.payload[headersBytes:],
 		aesCtr(m.payload[headersBytes:], key, iv),
@@ -819,7 +1019,7 @@ func (m *encMessage) deterministic(hop int) {
 	}
 	// The top and bottom slots are the slots we're populating during this
 	// cycle.
-	bottomSlot := maxChainLength - 1
+	bottomSlot := MaxChainLength - 1
 	topSlot := bottomSlot - (m.intermediateHops - hop - 1)
 	// Slot in this context is the slot the header will be placed in, on
 	// the current hop.  Not, the slot to encrypt from.
@@ -848,7 +1048,7 @@ func (m *encMessage) deterministic(hop int) {
 // bytes of the payload body.
 func (m *encMessage) debugPacket() {
 	fmt.Println("Encrypt diagnostic")
-	for slot := 0; slot <= maxChainLength; slot++ {
+	for slot := 0; slot <= MaxChainLength; slot++ {
 		sbyte := slot * headerBytes
 		ebyte := sbyte + 20
 		fmt.Printf(
@@ -867,13 +1067,13 @@ type decMessage struct {
 
 // newDecMessage creates a new decMessage object and populates it with the
 // provided message bytes (assumed to be an encrypted message).
-func newDecMessage(encPayload []byte) (dec *decMessage) {
-	err := lenCheck(len(encPayload), messageBytes)
+func newDecMessage(encPayload []byte) (dec *decMessage, err error) {
+	err = lenCheck(len(encPayload), MessageBytes)
 	if err != nil {
-		panic(err)
+		return
 	}
 	dec = new(decMessage)
-	dec.payload = make([]byte, messageBytes)
+	dec.payload = make([]byte, MessageBytes)
 	copy(dec.payload, encPayload)
 	return
 }
@@ -912,17 +1112,36 @@ func (m *decMessage) testAntiTag(tag []byte) bool {
 	return bytes.Equal(tag, digest.Sum(nil))
 }
 
+// testHeaderTag is the Reply hop equivalent of testAntiTag.  The digest only
+// covers the header stack.
+func (m *decMessage) testHeaderTag(tag []byte) bool {
+	digest, err := blake2s.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	digest.Write(m.payload[headerBytes:headersBytes])
+	return bytes.Equal(tag, digest.Sum(nil))
+}
+
 // Decrypt the body with the provided key and IV.  This function should only be
 // called during exit decryption.  At other times, decryptAll should be used.
-func (m *decMessage) decryptBody(key, iv []byte, length int) []byte {
-	var err error
+func (m *decMessage) decryptBody(key, iv []byte, length int) (body []byte, err error) {
 	err = lenCheck(len(key), 32)
 	if err != nil {
-		panic(err)
+		return
 	}
 	err = lenCheck(len(iv), 16)
 	if err != nil {
-		panic(err)
+		return
+	}
+	if length < 0 || length > BodyBytes {
+		err = fmt.Errorf(
+			"%w: Stated=%d, Max=%d",
+			ErrBodyLength,
+			length,
+			BodyBytes,
+		)
+		return
 	}
 
 	copy(
@@ -933,32 +1152,68 @@ func (m *decMessage) decryptBody(key, iv []byte, length int) []byte {
 			iv,
 		),
 	)
-	return m.payload[headersBytes : headersBytes+length]
+	body = m.payload[headersBytes : headersBytes+length]
+	return
+}
+
+// openBody authenticates and decrypts a v3 body using AES-GCM.  This function
+// should only be called during exit decryption of v3 packets.
+func (m *decMessage) openBody(key []byte, final *Final) (body []byte, err error) {
+	err = lenCheck(len(key), 32)
+	if err != nil {
+		return
+	}
+	if final.bodyBytes < 0 || final.bodyBytes > BodyBytes {
+		err = fmt.Errorf(
+			"%w: Stated=%d, Max=%d",
+			ErrBodyLength,
+			final.bodyBytes,
+			BodyBytes,
+		)
+		return
+	}
+	aead := aesGcm(key)
+	sealed := make([]byte, 0, BodyBytes+aead.Overhead())
+	sealed = append(sealed, m.payload[headersBytes:]...)
+	sealed = append(sealed, final.bodyTag...)
+	plain, err := aead.Open(
+		nil,
+		final.aesIV[:aead.NonceSize()],
+		sealed,
+		final.authData(),
+	)
+	if err != nil {
+		err = ErrBodyAuth
+		return
+	}
+	copy(m.payload[headersBytes:], plain)
+	body = m.payload[headersBytes : headersBytes+final.bodyBytes]
+	return
 }
 
 // Decrypt each header in turn using a supplied key and partial IV.  Also
 // decrypt the body using the same key and last IV in the sequence.
-func (m *decMessage) decryptAll(key, partialIV []byte) {
-	var err error
+func (m *decMessage) decryptAll(key, partialIV []byte) (err error) {
 	err = lenCheck(len(key), 32)
 	if err != nil {
-		panic(err)
+		return
 	}
 	err = lenCheck(len(partialIV), 12)
 	if err != nil {
-		panic(err)
+		return
 	}
 	var iv []byte
-	for slot := 0; slot < maxChainLength; slot++ {
+	for slot := 0; slot < MaxChainLength; slot++ {
 		sbyte := slot * headerBytes
 		ebyte := (slot + 1) * headerBytes
 		iv = seqIV(partialIV, slot)
 		copy(m.payload[sbyte:ebyte], aesCtr(m.payload[sbyte:ebyte], key, iv))
 	}
-	// IVs from 0 to maxChainLength-1 have been used for the headers.  The
-	// next IV in sequence (maxChainLength) is used to decrypt the body.
-	iv = seqIV(partialIV, maxChainLength)
+	// IVs from 0 to MaxChainLength-1 have been used for the headers.  The
+	// next IV in sequence (MaxChainLength) is used to decrypt the body.
+	iv = seqIV(partialIV, MaxChainLength)
 	copy(m.payload[headersBytes:], aesCtr(m.payload[headersBytes:], key, iv))
+	return
 }
 
 // debugPacket is only used for debugging purposes.  It outputs the first 20
@@ -966,7 +1221,7 @@ func (m *decMessage) decryptAll(key, partialIV []byte) {
 // bytes of the payload body.
 func (m *decMessage) debugPacket() {
 	fmt.Println("Decrypt diagnostic")
-	for slot := 0; slot <= maxChainLength; slot++ {
+	for slot := 0; slot <= MaxChainLength; slot++ {
 		sbyte := slot * headerBytes
 		ebyte := sbyte + 20
 		fmt.Printf(
@@ -978,3 +1233,11 @@ func (m *decMessage) debugPacket() {
 		)
 	}
 }
+
+// lenCheck verifies that a slice is of a specified length
+func lenCheck(got, expected int) (err error) {
+	if got != expected {
+		err = fmt.Errorf("%w: Expected=%d, Got=%d", ErrBadLength, expected, got)
+	}
+	return
+}
@@ -0,0 +1,601 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+)
+
+func errTest(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestEpochTimestamp(t *testing.T) {
+	data := newSlotData()
+	age := data.ageTimestamp()
+	if age < 0 || age > 3 {
+		t.Fatalf("Epoch age should be in the range 0-3. Got: %d", age)
+	}
+}
+
+func TestIntermediate(t *testing.T) {
+	inputAesIV12 := []byte("abcdefghijkl")
+	inputNextHop := "mrfoobar@anonymous.invalid"
+	inInter := newSlotIntermediate()
+	inInter.setPartialIV(inputAesIV12)
+	inInter.setNextHop(inputNextHop)
+	outInter, err := decodeIntermediate(inInter.encode())
+	errTest(err)
+	if !bytes.Equal(outInter.aesIV12, inputAesIV12) {
+		t.Fatalf("Intermediate AES IV mismatch: %x", outInter.aesIV12)
+	}
+	if outInter.getNextHop() != inputNextHop {
+		t.Fatalf(
+			"Intermediate nextHop mismatch: %s",
+			outInter.getNextHop(),
+		)
+	}
+}
+
+func TestSlotData(t *testing.T) {
+	inSlotData := newSlotData()
+	inSlotData.setTimestamp()
+	inSlotData.setPacketInfo(make([]byte, 64))
+	inSlotData.setAesKey(crandom.Randbytes(32))
+	inSlotData.setTagHash(make([]byte, 32))
+	outSlotData, err := decodeSlotData(inSlotData.encode())
+	errTest(err)
+	if !bytes.Equal(inSlotData.packetID, outSlotData.packetID) {
+		t.Fatal("PacketID Mismatch")
+	}
+}
+
+func TestNaClEncryptDecrypt(t *testing.T) {
+	inHead := newEncodeHeader()
+	inPlain := crandom.Randbytes(160)
+	recipientPK, _ := GenerateKey()
+	fakeKeyid := crandom.Randbytes(16)
+	inHead.setRecipient(fakeKeyid, recipientPK)
+	inHead.encode(inPlain)
+}
+
+func TestPacket(t *testing.T) {
+	plainText := "Hello world!"
+
+	outExitHead := NewFinal()
+	outExitHead.setBodyBytes(len([]byte(plainText)))
+	payload := make([]byte, BodyBytes)
+	copy(payload, []byte(plainText))
+
+	outHead := newSlotData()
+	outHead.setAesKey(crandom.Randbytes(32))
+	outHead.setTagHash(make([]byte, 32))
+	outHead.setPacketInfo(outExitHead.encode())
+	copy(payload, aesCtr(payload, outHead.aesKey, outExitHead.aesIV))
+
+	inHead, err := decodeSlotData(outHead.encode())
+	errTest(err)
+
+	inExitHead, err := decodeFinal(inHead.packetInfo, 2)
+	errTest(err)
+	if !bytes.Equal(outHead.aesKey, inHead.aesKey) {
+		t.Fatal("AES Key mismatch")
+	}
+	if !bytes.Equal(outExitHead.aesIV, inExitHead.aesIV) {
+		t.Fatal("AES IV mismatch")
+	}
+	copy(payload, aesCtr(payload, inHead.aesKey, inExitHead.aesIV))
+	outText := string(payload[0:inExitHead.bodyBytes])
+	if outText != plainText {
+		t.Fatal("Body encrypt/decrypt mismatch")
+	}
+	if !bytes.Equal(outExitHead.messageID, inExitHead.messageID) {
+		t.Fatal("MessageID mismatch")
+	}
+}
+
+/*
+func TestKeys(t *testing.T) {
+	chainLength := 3
+	k := newAesKeys(chainLength - 1)
+	fmt.Printf("%x\n", k.deterministic(0))
+}
+*/
+
+func TestOneHop(t *testing.T) {
+	encPlain := []byte("Hello World!")
+	exitPK, exitSK := GenerateKey()
+	//interPK, interSK := GenerateKey()
+
+	//Create Exit Header Data
+	encSlotFinal := NewFinal()
+	encSlotFinal.setBodyBytes(len(encPlain))
+	// Create and populate the Slot Data
+	encSlotData := newSlotData()
+	// Tell the Slot Data that this is the exit hop, otherwise it will
+	// default to intermediate.
+	encSlotData.setExit()
+	encSlotData.setAesKey(crandom.Randbytes(32))
+	encSlotData.setPacketInfo(encSlotFinal.encode())
+	encSlotData.setTagHash(make([]byte, 32))
+	encSlotDataBytes := encSlotData.encode()
+
+	fakeRecipientKeyID := make([]byte, 16)
+	encHeader := newEncodeHeader()
+	encHeader.setRecipient(fakeRecipientKeyID, exitPK)
+
+	exitHeader := encHeader.encode(encSlotDataBytes)
+	encBody := make([]byte, BodyBytes)
+	copy(encBody, aesCtr(encPlain, encSlotData.aesKey, encSlotFinal.aesIV))
+
+	// Create a decode struct called exitHead and fill it with the encoded
+	// bytes from encHead
+	decHeader, err := newDecodeHeader(exitHeader)
+	errTest(err)
+	// We're faking the KeyID but this at least proves the function
+	_ = decHeader.getRecipientKeyID()
+	errTest(decHeader.setRecipientSK(exitSK))
+	decSlotDataBytes, version, err := decHeader.decode()
+	if err != nil {
+		t.Fatalf("Header docode failed: %s", err)
+	}
+	if version != 2 {
+		t.Fatalf(
+			"Not a version 2 type packet. Got version: %d",
+			version,
+		)
+	}
+	// Test if the decoded raw Slot Data bytes match the input Slot Data
+	if !bytes.Equal(encSlotDataBytes, decSlotDataBytes) {
+		t.Fatal("Encoded/Decoded Slot Data mismatch")
+	}
+	// Convert the raw Slot Data Bytes to meaningful slotData.
+	decSlotData, err := decodeSlotData(decSlotDataBytes)
+	errTest(err)
+	if decSlotData.packetType != 1 {
+		t.Fatalf(
+			"Expected Packet Type 1 (Exit Hop) but got %d",
+			decSlotData.packetType,
+		)
+	}
+	decSlotFinal, err := decodeFinal(decSlotData.packetInfo, 2)
+	errTest(err)
+
+	decBody := make([]byte, BodyBytes)
+	copy(decBody, aesCtr(encBody, decSlotData.aesKey, decSlotFinal.aesIV))
+	decPlain := decBody[:decSlotFinal.bodyBytes]
+	if !bytes.Equal(encPlain, decPlain) {
+		t.Fatalf(
+			"Body decode mismatch. In=%s, Out=%s",
+			encPlain,
+			decPlain,
+		)
+	}
+}
+func TestMultiHop(t *testing.T) {
+	chainLength := MaxChainLength
+	m := newEncMessage()
+	encPlain := []byte("Hello World!")
+	plainLength := m.setPlainText(encPlain)
+	testPK, testSK := GenerateKey()
+
+	//Create Exit Header Data
+	encFinal := NewFinal()
+	encFinal.setBodyBytes(plainLength)
+	// Create and populate the Slot Data
+	encData := newSlotData()
+	// Tell the Slot Data that this is the exit hop, otherwise it will
+	// default to intermediate.
+	encData.setExit()
+	encData.setAesKey(crandom.Randbytes(32))
+	// Encode the Packet Info and store it in the Slot Data
+	encData.setPacketInfo(encFinal.encode())
+
+	fakeRecipientKeyID := make([]byte, 16)
+	encHeader := newEncodeHeader()
+	encHeader.setRecipient(fakeRecipientKeyID, testPK)
+
+	// Define the chain length
+	m.setChainLength(chainLength)
+	// Populate the message with the encrypted body
+	m.encryptBody(encData.aesKey, encFinal.aesIV)
+	m.shiftHeaders()
+	if chainLength > 1 {
+		m.deterministic(0)
+	}
+	//m.debugPacket()
+	encData.setTagHash(m.getAntiTag())
+	// Encode the Slot Data
+	encDataBytes := encData.encode()
+	// Insert an byte encoded version of the newly created header
+	m.insertHeader(encHeader.encode(encDataBytes))
+	//m.debugPacket()
+
+	// That concludes the exit hop compilation
+
+	//m.debugPacket()
+	interHops := m.getIntermediateHops()
+	for interHop := 0; interHop < interHops; interHop++ {
+		encInter := newSlotIntermediate()
+		encInter.setPartialIV(m.getPartialIV(interHop))
+		encInter.setNextHop("fake@remailer.org")
+		encData = newSlotData()
+		encData.setAesKey(m.getKey(interHop))
+		encData.setPacketInfo(encInter.encode())
+		m.encryptAll(interHop)
+		m.shiftHeaders()
+		m.deterministic(interHop + 1)
+		encData.setTagHash(m.getAntiTag())
+		encDataBytes = encData.encode()
+		encHeader = newEncodeHeader()
+		encHeader.setRecipient(fakeRecipientKeyID, testPK)
+		m.insertHeader(encHeader.encode(encDataBytes))
+	}
+
+	// End of Intermediate hop encoding
+
+	// Kludge to put the previously encrypted payload into a decMessage
+	// struct.
+	d, err := newDecMessage(m.payload)
+	errTest(err)
+
+	var gotExit bool
+	for remailer := 0; remailer < MaxChainLength; remailer++ {
+		// Create a decode struct called exitHead and fill it with the
+		// encoded bytes from encHead
+		decHeader, err := newDecodeHeader(d.getHeader())
+		errTest(err)
+		// We're faking the KeyID but this at least proves the function
+		_ = decHeader.getRecipientKeyID()
+		errTest(decHeader.setRecipientSK(testSK))
+		decDataBytes, version, err := decHeader.decode()
+		if err != nil {
+			t.Fatalf("Header decode failed: %s", err)
+		}
+		if version != 2 {
+			t.Fatalf(
+				"Not a version 2 type packet. Got version: %d",
+				version,
+			)
+		}
+		// Convert the raw Slot Data Bytes to meaningful slotData.
+		decData, err := decodeSlotData(decDataBytes)
+		errTest(err)
+		if !d.testAntiTag(decData.getTagHash()) {
+			d.debugPacket()
+			fmt.Printf("Packet Type: %d\n", decData.packetType)
+			t.Fatalf("Anti-tag fail at remailer: %d\n", remailer)
+		}
+		if decData.packetType == 0 {
+			d.shiftHeaders()
+			// Decode Intermediate
+			decInter, err := decodeIntermediate(decData.packetInfo)
+			errTest(err)
+			errTest(d.decryptAll(decData.aesKey, decInter.aesIV12))
+		} else if decData.packetType == 1 {
+			//d.debugPacket()
+			// Decode Exit
+			gotExit = true
+			decFinal, err := decodeFinal(decData.packetInfo, 2)
+			errTest(err)
+
+			decPlain, err := d.decryptBody(
+				decData.aesKey,
+				decFinal.aesIV,
+				decFinal.bodyBytes,
+			)
+			errTest(err)
+			if !bytes.Equal(encPlain, decPlain) {
+				t.Fatalf(
+					"Body decode mismatch. In=%s, Out=%s",
+					encPlain,
+					decPlain,
+				)
+			}
+		} else {
+			t.Fatalf("Unknown Packet Type: %d", decData.packetInfo)
+		}
+
+		if gotExit {
+			break
+		}
+	}
+	if !gotExit {
+		t.Fatal("Decode loop ended without finding an exit header")
+	}
+}
+
+// fakeSecring implements SecretKeys for testing
+type fakeSecring map[string][]byte
+
+func (f fakeSecring) GetSK(keyid string) ([]byte, error) {
+	sk, exists := f[keyid]
+	if !exists {
+		return nil, fmt.Errorf("%s: Keyid not found in secret keyring", keyid)
+	}
+	return sk, nil
+}
+
+// testChain returns a chain of test remailers and a keyring holding their
+// Secret Keys.
+func testChain(length int) (chain []keymgr.Remailer, secring fakeSecring) {
+	secring = make(fakeSecring)
+	for n := 0; n < length; n++ {
+		pk, sk := GenerateKey()
+		keyid := crandom.Randbytes(16)
+		secring[hex.EncodeToString(keyid)] = sk
+		chain = append(chain, keymgr.Remailer{
+			Address: fmt.Sprintf("test%02d@domain.foo", n),
+			Keyid:   keyid,
+			PK:      pk,
+		})
+	}
+	return
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	for _, version := range Versions {
+		testEncoderDecoder(t, version)
+	}
+}
+
+func testEncoderDecoder(t *testing.T, version int) {
+	encPlain := []byte("Hello World!")
+	chain, secring := testChain(3)
+	encoder, err := NewEncoder(chain, NewFinal())
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %s", err)
+	}
+	// The test chain has no capstrings so only supports v2
+	if encoder.Version() != 2 {
+		t.Fatalf("Expected chain version 2, got %d", encoder.Version())
+	}
+	encoder.version = version
+	packet, err := encoder.Encode(encPlain)
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	decoder := NewDecoder(secring)
+	for n := 0; n < len(chain); n++ {
+		hop, err := decoder.Decode(packet)
+		if err != nil {
+			t.Fatalf("Decode failed at hop %d: %s", n, err)
+		}
+		switch h := hop.(type) {
+		case *Intermediate:
+			if h.NextHop != chain[n+1].Address {
+				t.Fatalf("Expected next hop %s, got %s", chain[n+1].Address, h.NextHop)
+			}
+			packet = h.Packet
+		case *Exit:
+			if h.Version() != version {
+				t.Fatalf("Expected packet version %d, got %d", version, h.Version())
+			}
+			if n != len(chain)-1 {
+				t.Fatalf("Unexpected Exit at hop %d", n)
+			}
+			if !bytes.Equal(encPlain, h.Body) {
+				t.Fatalf("Body decode mismatch. In=%s, Out=%s", encPlain, h.Body)
+			}
+			if h.Final.DeliveryMethod() != DeliverSMTP {
+				t.Fatalf("Expected SMTP delivery, got %d", h.Final.DeliveryMethod())
+			}
+		}
+	}
+	// The packet is encrypted to keys we don't hold
+	_, err = NewDecoder(make(fakeSecring)).Decode(packet)
+	if !errors.Is(err, ErrUnknownKeyID) {
+		t.Fatalf("Expected ErrUnknownKeyID, got: %v", err)
+	}
+}
+
+func TestEncoderChainLength(t *testing.T) {
+	_, err := NewEncoder(nil, NewFinal())
+	if err == nil {
+		t.Fatal("Expected an error encoding to an empty chain")
+	}
+	chain := make([]keymgr.Remailer, MaxChainLength+1)
+	_, err = NewEncoder(chain, NewFinal())
+	if err == nil {
+		t.Fatal("Expected an error encoding to an excessive chain")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	// A short packet should be rejected before any decryption occurs
+	_, err := NewDecoder(make(fakeSecring)).Decode(make([]byte, 100))
+	if !errors.Is(err, ErrBadLength) {
+		t.Fatalf("Expected ErrBadLength, got: %v", err)
+	}
+	// Body length exceeding the payload size
+	final := NewFinal()
+	final.setBodyBytes(10)
+	b := final.encode()
+	binary.LittleEndian.PutUint32(b[34:38], uint32(BodyBytes+1))
+	_, err = decodeFinal(b, 2)
+	if !errors.Is(err, ErrBodyLength) {
+		t.Fatalf("Expected ErrBodyLength, got: %v", err)
+	}
+	// Chunk number greater than number of chunks
+	b = final.encode()
+	b[16] = 2
+	_, err = decodeFinal(b, 2)
+	if !errors.Is(err, ErrBadChunk) {
+		t.Fatalf("Expected ErrBadChunk, got: %v", err)
+	}
+	// Unsupported version in Slot Data
+	data := newSlotData()
+	data.setAesKey(crandom.Randbytes(32))
+	data.setPacketInfo(make([]byte, encDataBytes))
+	data.setTagHash(make([]byte, 32))
+	b = data.encode()
+	b[0] = 9
+	_, err = decodeSlotData(b)
+	if !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("Expected ErrBadVersion, got: %v", err)
+	}
+}
+
+func TestV3BodyAuth(t *testing.T) {
+	pk, sk := GenerateKey()
+	keyid := crandom.Randbytes(16)
+	secring := fakeSecring{hex.EncodeToString(keyid): sk}
+	chain := []keymgr.Remailer{{Address: "exit@domain.foo", Keyid: keyid, PK: pk}}
+	encoder, err := NewEncoder(chain, NewFinal())
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %s", err)
+	}
+	encoder.version = 3
+	packet, err := encoder.Encode([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	// Flip a bit in the body of a single-hop packet.  The anti-tag digest
+	// covers the body so decode the layers by hand to prove the AEAD also
+	// catches the change.
+	packet[MessageBytes-1] ^= 0x01
+	m, err := newDecMessage(packet)
+	errTest(err)
+	header, err := newDecodeHeader(m.getHeader())
+	errTest(err)
+	errTest(header.setRecipientSK(sk))
+	slotDataBytes, _, err := header.decode()
+	errTest(err)
+	data, err := decodeSlotData(slotDataBytes)
+	errTest(err)
+	final, err := decodeFinal(data.packetInfo, 3)
+	errTest(err)
+	_, err = m.openBody(data.aesKey, final)
+	if !errors.Is(err, ErrBodyAuth) {
+		t.Fatalf("Expected ErrBodyAuth, got: %v", err)
+	}
+	// And the full decoder should also reject it
+	_, err = NewDecoder(secring).Decode(packet)
+	if err == nil {
+		t.Fatal("Expected Decode to reject a modified packet")
+	}
+}
+
+func TestHopDelays(t *testing.T) {
+	chain, secring := testChain(3)
+	encoder, err := NewEncoder(chain, NewFinal())
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %s", err)
+	}
+	delays := []time.Duration{time.Minute, 0, 90 * time.Minute}
+	err = encoder.SetDelays(delays)
+	if !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("Expected ErrBadVersion on a v2 chain, got: %v", err)
+	}
+	encoder.version = 4
+	err = encoder.SetDelays(delays[:2])
+	if err == nil {
+		t.Fatal("Expected an error when delays don't match the chain")
+	}
+	err = encoder.SetDelays([]time.Duration{0, 0, MaxDelay + time.Hour})
+	if err == nil {
+		t.Fatal("Expected an error for an excessive delay")
+	}
+	err = encoder.SetDelays(delays)
+	if err != nil {
+		t.Fatalf("SetDelays failed: %s", err)
+	}
+	packet, err := encoder.Encode([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	decoder := NewDecoder(secring)
+	for n := range chain {
+		hop, err := decoder.Decode(packet)
+		if err != nil {
+			t.Fatalf("Decode failed at hop %d: %s", n, err)
+		}
+		if hop.Delay() != delays[n] {
+			t.Errorf("Hop %d: Expected delay of %s, got %s", n, delays[n], hop.Delay())
+		}
+		if inter, ok := hop.(*Intermediate); ok {
+			packet = inter.Packet
+		}
+	}
+}
+
+func TestReplyBlock(t *testing.T) {
+	replyTo := "sender@domain.foo"
+	reply := []byte("Hello Sender!")
+	chain, secring := testChain(3)
+	block, secret, err := NewReplyBlock(chain, replyTo)
+	if err != nil {
+		t.Fatalf("NewReplyBlock failed: %s", err)
+	}
+	// Pass both halves through their encoded forms
+	block, err = DecodeReplyBlock(block.Bytes())
+	errTest(err)
+	secret, err = DecodeReplySecret(secret.Bytes())
+	errTest(err)
+	if block.FirstHop() != chain[0].Address {
+		t.Fatalf("Expected first hop %s, got %s", chain[0].Address, block.FirstHop())
+	}
+	packet, err := block.Attach(reply)
+	if err != nil {
+		t.Fatalf("Attach failed: %s", err)
+	}
+	decoder := NewDecoder(secring)
+	for n := 0; n < len(chain); n++ {
+		hop, err := decoder.Decode(packet)
+		if err != nil {
+			t.Fatalf("Decode failed at hop %d: %s", n, err)
+		}
+		inter, ok := hop.(*Intermediate)
+		if !ok {
+			t.Fatalf("Expected Intermediate at hop %d, got %T", n, hop)
+		}
+		nextHop := replyTo
+		if n < len(chain)-1 {
+			nextHop = chain[n+1].Address
+		}
+		if inter.NextHop != nextHop {
+			t.Fatalf("Expected next hop %s, got %s", nextHop, inter.NextHop)
+		}
+		packet = inter.Packet
+	}
+	id, err := ReplyID(packet)
+	errTest(err)
+	if !bytes.Equal(id, secret.ID()) {
+		t.Fatalf("Reply ID mismatch. Got=%x, Wanted=%x", id, secret.ID())
+	}
+	got, err := secret.Open(packet)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatalf("Reply mismatch. In=%s, Out=%s", reply, got)
+	}
+	// A modified body should fail authentication
+	packet[MessageBytes-1] ^= 0x01
+	_, err = secret.Open(packet)
+	if !errors.Is(err, ErrBodyAuth) {
+		t.Fatalf("Expected ErrBodyAuth, got: %v", err)
+	}
+}
+
+func TestReplyBlockChainLength(t *testing.T) {
+	// The Reply ID header reduces the maximum chain length by one
+	chain, _ := testChain(MaxChainLength)
+	_, _, err := NewReplyBlock(chain, "sender@domain.foo")
+	if err == nil {
+		t.Fatal("Expected an error for an excessive reply chain length")
+	}
+	_, _, err = NewReplyBlock(chain[1:], "sender@domain.foo")
+	if err != nil {
+		t.Fatalf("Unexpected error on a maximum length reply chain: %s", err)
+	}
+}
@@ -0,0 +1,291 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+)
+
+/*
+Single-Use Reply Blocks (SURBs) allow a recipient to reply to an anonymous
+sender.  The sender creates a Reply Block containing a pre-built header stack
+for a chain of remailers that ends at the sender's own address.  Every hop in
+the stack is a Reply hop (Packet Type 2), an Intermediate that forwards to the
+next address.  The final Reply hop forwards to the sender.
+
+As the body doesn't exist when the Reply Block is created, Reply hops compute
+their anti-tag digest over the header stack only.  The body is instead
+protected end-to-end by AES-GCM using a key contained in the Reply Block.
+
+Encoded Reply Block
+[ First hop address	 52 Bytes ]
+[ Header stack		2560 Bytes ]
+[ Body key		 32 Bytes ]
+Total	2644 Bytes
+
+The creator of a Reply Block retains a Reply Secret.  This contains the AES
+keys and partial IVs used by each hop to (de)crypt the body, allowing the
+creator to strip those layers from a delivered reply.
+
+Encoded Reply Secret
+[ Reply ID		 16 Bytes ]
+[ Body key		 32 Bytes ]
+[ Number of hops	  1 Byte  ]
+[ Hop keys		 44 Bytes ] * Number of hops
+Total	49 + (44 * Number of hops) Bytes
+
+Hop keys are a 32 Byte AES key followed by a 12 Byte partial IV.
+
+The Reply ID is the first 16 Bytes of the bottom header in the stack.  When a
+reply is delivered, it becomes the top header and is used by the creator to
+look up the corresponding Reply Secret.
+
+Reply Body
+[ AES-GCM Nonce		 12 Bytes ]
+[ Reply length		  4 Bytes ] Encrypted
+[ Reply + padding	17888 Bytes ] Encrypted
+[ AES-GCM Tag		 16 Bytes ]
+Total	17920 Bytes
+*/
+
+const (
+	ReplyBlockBytes = 52 + headersBytes + 32 // Size of an encoded Reply Block
+	MaxReplyBytes   = BodyBytes - 32         // Maximum length of a reply
+	replyIDBytes    = 16
+)
+
+// ReplyBlock is a pre-built header stack that routes a reply back to its
+// creator.
+type ReplyBlock struct {
+	firstHop []byte // Address of the first remailer in the Reply chain
+	headers  []byte // The encoded header stack
+	key      []byte // AES-GCM key used to encrypt the reply body
+}
+
+// ReplySecret holds the keys required by the creator of a ReplyBlock to
+// decrypt a reply.
+type ReplySecret struct {
+	id   []byte
+	key  []byte
+	keys [][]byte // AES key used by each hop to (de)crypt the body
+	ivs  [][]byte // Partial IV used by each hop to (de)crypt the body
+}
+
+// NewReplyBlock creates a ReplyBlock for the given chain.  The first remailer
+// in the chain is the entry hop and the last will forward the reply to
+// replyTo.  The returned ReplySecret must be retained in order to read the
+// reply.
+func NewReplyBlock(
+	chain []keymgr.Remailer,
+	replyTo string,
+) (block *ReplyBlock, secret *ReplySecret, err error) {
+	// The Reply ID header occupies one slot in the stack
+	err = validateChain(chain, MaxChainLength-1)
+	if err != nil {
+		return
+	}
+	if len(replyTo) > 52 {
+		err = fmt.Errorf("%s: Address exceeds 52 chars", replyTo)
+		return
+	}
+	version := chainVersion(chain)
+	chain = append(chain[:0:0], chain...)
+	m := newEncMessage()
+	m.setChainLength(len(chain) + 1)
+	// Construct the header that identifies the Reply to its creator.  This
+	// is never decrypted so its content (after the ID) is random.
+	id := crandom.Randbytes(replyIDBytes)
+	m.shiftHeaders()
+	m.deterministic(0)
+	m.insertHeader(append(id, crandom.Randbytes(headerBytes-replyIDBytes)...))
+	nextHop := replyTo
+	interHops := m.getIntermediateHops()
+	for interHop := 0; interHop < interHops; interHop++ {
+		inter := newSlotIntermediate()
+		inter.setPartialIV(m.getPartialIV(interHop))
+		inter.setNextHop(nextHop)
+		hop := popRemailer(&chain)
+		slotData := newSlotData()
+		slotData.setVersion(version)
+		slotData.setReply()
+		slotData.setAesKey(m.getKey(interHop))
+		slotData.setPacketInfo(inter.encode())
+		m.encryptAll(interHop)
+		m.shiftHeaders()
+		m.deterministic(interHop + 1)
+		slotData.setTagHash(m.getHeaderTag())
+		header := newEncodeHeader()
+		header.setRecipient(hop.Keyid, hop.PK)
+		m.insertHeader(header.encode(slotData.encode()))
+		nextHop = hop.Address
+	}
+	if len(chain) != 0 {
+		err = errors.New("after encoding, chain was not empty")
+		return
+	}
+	key := crandom.Randbytes(32)
+	block = &ReplyBlock{
+		firstHop: []byte(nextHop + strings.Repeat("\x00", 52-len(nextHop))),
+		headers:  append([]byte(nil), m.getPayload()[:headersBytes]...),
+		key:      key,
+	}
+	secret = &ReplySecret{
+		id:  id,
+		key: key,
+	}
+	for interHop := 0; interHop < interHops; interHop++ {
+		secret.keys = append(secret.keys, m.getKey(interHop))
+		secret.ivs = append(secret.ivs, m.getPartialIV(interHop))
+	}
+	return
+}
+
+// FirstHop returns the address of the remailer an attached reply should be
+// sent to.
+func (b *ReplyBlock) FirstHop() string {
+	return strings.TrimRight(string(b.firstHop), "\x00")
+}
+
+// Bytes returns the encoded ReplyBlock.
+func (b *ReplyBlock) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(b.firstHop)
+	buf.Write(b.headers)
+	buf.Write(b.key)
+	return buf.Bytes()
+}
+
+// DecodeReplyBlock converts an encoded ReplyBlock back to its component parts.
+func DecodeReplyBlock(b []byte) (block *ReplyBlock, err error) {
+	err = lenCheck(len(b), ReplyBlockBytes)
+	if err != nil {
+		return
+	}
+	block = &ReplyBlock{
+		firstHop: b[:52],
+		headers:  b[52 : 52+headersBytes],
+		key:      b[52+headersBytes:],
+	}
+	return
+}
+
+// Attach encrypts a reply and attaches it to the ReplyBlock.  The returned
+// packet should be sent to the ReplyBlock's FirstHop.
+func (b *ReplyBlock) Attach(reply []byte) (packet []byte, err error) {
+	if len(reply) > MaxReplyBytes {
+		err = fmt.Errorf(
+			"reply (%d) exceeds max length (%d)",
+			len(reply),
+			MaxReplyBytes,
+		)
+		return
+	}
+	aead := aesGcm(b.key)
+	nonce := crandom.Randbytes(aead.NonceSize())
+	plain := make([]byte, BodyBytes-len(nonce)-aead.Overhead())
+	binary.LittleEndian.PutUint32(plain, uint32(len(reply)))
+	copy(plain[4:], reply)
+	packet = make([]byte, 0, MessageBytes)
+	packet = append(packet, b.headers...)
+	packet = append(packet, nonce...)
+	packet = aead.Seal(packet, nonce, plain, nil)
+	err = lenCheck(len(packet), MessageBytes)
+	return
+}
+
+// ID returns the Reply ID that identifies replies to the ReplyBlock
+// associated with this ReplySecret.
+func (s *ReplySecret) ID() []byte {
+	return s.id
+}
+
+// Bytes returns the encoded ReplySecret.
+func (s *ReplySecret) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(s.id)
+	buf.Write(s.key)
+	buf.WriteByte(uint8(len(s.keys)))
+	for n := range s.keys {
+		buf.Write(s.keys[n])
+		buf.Write(s.ivs[n])
+	}
+	return buf.Bytes()
+}
+
+// DecodeReplySecret converts an encoded ReplySecret back to its component
+// parts.
+func DecodeReplySecret(b []byte) (secret *ReplySecret, err error) {
+	if len(b) < replyIDBytes+33 {
+		err = fmt.Errorf("%w: reply secret is truncated", ErrBadLength)
+		return
+	}
+	hops := int(b[replyIDBytes+32])
+	err = lenCheck(len(b), replyIDBytes+33+hops*44)
+	if err != nil {
+		return
+	}
+	secret = &ReplySecret{
+		id:  b[:replyIDBytes],
+		key: b[replyIDBytes : replyIDBytes+32],
+	}
+	for n := 0; n < hops; n++ {
+		sbyte := replyIDBytes + 33 + n*44
+		secret.keys = append(secret.keys, b[sbyte:sbyte+32])
+		secret.ivs = append(secret.ivs, b[sbyte+32:sbyte+44])
+	}
+	return
+}
+
+// ReplyID returns the Reply ID of a delivered reply.  This identifies the
+// ReplySecret required to Open it.
+func ReplyID(packet []byte) (id []byte, err error) {
+	err = lenCheck(len(packet), MessageBytes)
+	if err != nil {
+		return
+	}
+	id = packet[:replyIDBytes]
+	return
+}
+
+// Open strips the hop encryption layers from a delivered reply and returns
+// the authenticated reply.
+func (s *ReplySecret) Open(packet []byte) (reply []byte, err error) {
+	id, err := ReplyID(packet)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(id, s.id) {
+		err = errors.New("reply ID does not match reply secret")
+		return
+	}
+	// Each hop decrypted the body with its own key and IV.  Redoing that
+	// with the same keys and IVs returns the body to its sealed state.
+	body := packet[headersBytes:]
+	for n := range s.keys {
+		body = aesCtr(body, s.keys[n], seqIV(s.ivs[n], MaxChainLength))
+	}
+	aead := aesGcm(s.key)
+	nonceSize := aead.NonceSize()
+	plain, err := aead.Open(nil, body[:nonceSize], body[nonceSize:], nil)
+	if err != nil {
+		err = ErrBodyAuth
+		return
+	}
+	length := int(binary.LittleEndian.Uint32(plain))
+	if length > len(plain)-4 {
+		err = fmt.Errorf(
+			"%w: Stated=%d, Max=%d",
+			ErrBodyLength,
+			length,
+			len(plain)-4,
+		)
+		return
+	}
+	reply = plain[4 : 4+length]
+	return
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
+	"github.com/crooks/yamn/pinger"
+	"github.com/luksen/maildir"
+)
+
+// runPinger periodically sends pings through every known remailer and
+// publishes the results as mlist2.txt and pubring.mix files.  Pings are
+// encrypted to the pinger's own key so it needs a Secret Keyring, just like a
+// remailer.  If run with --daemon, this will loop forever.
+func runPinger() (err error) {
+	err = usePingerDir()
+	if err != nil {
+		return
+	}
+	createDirs()
+	err = os.MkdirAll(cfg.Files.Keydir, 0700)
+	if err != nil {
+		return
+	}
+	secret := newSecring()
+	if purgeSecring(secret) == 0 {
+		generateKeypair(secret)
+	} else {
+		refreshPubkey(secret)
+	}
+	log.Tracef("Opening Ping Log: %s", cfg.Files.PingDB)
+	pings, err := pinger.Open(cfg.Files.PingDB)
+	if err != nil {
+		return
+	}
+	defer pings.Close()
+
+	interval := time.Duration(cfg.Pinger.Interval) * time.Minute
+	var lastRound time.Time
+	runAsDaemon := flag.Daemon
+	if runAsDaemon {
+		log.Infof("Starting YAMN pinger: %s", cfg.Remailer.Name)
+	}
+	for {
+		assertIsPath(cfg.Files.Pooldir)
+		// Collect returned pings from the Maildir
+		collectPings(secret, pings)
+		if time.Since(lastRound) > interval {
+			err = pingRound(pings)
+			if err != nil {
+				log.Warnf("Ping round failed: %s", err)
+			}
+			lastRound = time.Now()
+		}
+		if !runAsDaemon {
+			break
+		}
+		time.Sleep(60 * time.Second)
+	}
+	return
+}
+
+// usePingerDir points the keyring, key, Maildir and pool paths at the
+// PingerDir so the pinger can't disturb a remailer sharing its config.
+func usePingerDir() (err error) {
+	paths := []struct {
+		file *string
+		name string
+	}{
+		{&cfg.Files.Secring, "secring.mix"},
+		{&cfg.Files.Pubkey, "key.txt"},
+		{&cfg.Files.Maildir, "Maildir"},
+		{&cfg.Files.Pooldir, "pool"},
+	}
+	for _, p := range paths {
+		pingerPath := path.Join(cfg.Files.PingerDir, p.name)
+		if path.Clean(*p.file) == pingerPath {
+			err = fmt.Errorf(
+				"%s is also used by the remailer. Set a different PingerDir",
+				pingerPath,
+			)
+			return
+		}
+		*p.file = pingerPath
+	}
+	return
+}
+
+// pingRound aggregates the known remailer keys, pings every remailer and
+// publishes the resulting stats.
+func pingRound(pings *pinger.Log) (err error) {
+	err = aggregateKeys()
+	if err != nil {
+		return
+	}
+	// Pings are encrypted to the pinger's own published key
+	self := keymgr.NewPubring(cfg.Files.Pubkey, "")
+	err = self.ImportPubring()
+	if err != nil {
+		return
+	}
+	me, err := self.Get(cfg.Remailer.Address)
+	if err != nil {
+		return
+	}
+	// Only this round's pings are sent so nothing else in the pool can
+	// bypass the mix.
+	var sent []string
+	remailers := Pubring.Remailers()
+	for _, r := range remailers {
+		sent = appendPing(sent, sendPing(pings, []keymgr.Remailer{r, me}))
+	}
+	// Chain pings are sent through random pairs of remailers
+	if len(remailers) > 1 {
+		for n := 0; n < cfg.Pinger.ChainPings; n++ {
+			first := remailers[crandom.RandomInt(len(remailers))]
+			second := remailers[crandom.RandomInt(len(remailers))]
+			if first.Address == second.Address {
+				continue
+			}
+			sent = appendPing(sent, sendPing(pings, []keymgr.Remailer{first, second, me}))
+		}
+	}
+	deliverBatch(sent)
+	_, expired, err := pings.Expire(pinger.HistDays * 24 * time.Hour)
+	if err != nil {
+		return
+	}
+	log.Tracef("Expired %d pings from the Ping Log", expired)
+	return writePingStats(pings, remailers)
+}
+
+// aggregateKeys reads every key in the Keydir and writes the current key for
+// each remailer to the pubring.
+func aggregateKeys() (err error) {
+	files, err := readDir(cfg.Files.Keydir, "")
+	if err != nil {
+		return
+	}
+	Pubring = keymgr.NewPubring(cfg.Files.Pubring, cfg.Files.Mlist2)
+	for _, f := range files {
+		err = Pubring.ImportKeyFile(path.Join(cfg.Files.Keydir, f))
+		if err != nil {
+			log.Warnf("%s: Key import failed: %s", f, err)
+		}
+	}
+	log.Infof("Aggregated %d remailer keys", Pubring.Count())
+	err = Pubring.WritePubring(cfg.Files.Pubring)
+	return
+}
+
+// appendPing adds the pool filename of a ping to sent, unless sending failed
+func appendPing(sent []string, filename string) []string {
+	if filename == "" {
+		return sent
+	}
+	return append(sent, filename)
+}
+
+// sendPing records a new ping and encodes it through chain.  The last
+// remailer in chain is the pinger.  The pool filename of the ping is
+// returned, or an empty string if it couldn't be sent.
+func sendPing(pings *pinger.Log, chain []keymgr.Remailer) (filename string) {
+	var names []string
+	for _, r := range chain[:len(chain)-1] {
+		names = append(names, r.Name())
+	}
+	id, err := pings.Sent(names)
+	if err != nil {
+		log.Warnf("Unable to record ping: %s", err)
+		return
+	}
+	final := packet.NewFinal()
+	final.SetDeliveryMethod(packet.DeliverPing)
+	encoder, err := packet.NewEncoder(chain, final)
+	if err != nil {
+		log.Warnf("%s: Ping encoding failed: %s", strings.Join(names, ","), err)
+		return
+	}
+	body := fmt.Sprintf(
+		"Ping: %s\nChain: %s\nSent: %s\n",
+		hex.EncodeToString(id),
+		strings.Join(names, ","),
+		time.Now().UTC().Format(rfc5322date),
+	)
+	yamnMsg, err := encoder.Encode([]byte(body))
+	if err != nil {
+		log.Warnf("%s: Ping encoding failed: %s", strings.Join(names, ","), err)
+		return
+	}
+	log.Tracef("Sending ping through: %s", strings.Join(names, ","))
+	filename = writeMessageToPool(chain[0].Address, yamnMsg)
+	return
+}
+
+// collectPings reads returned pings from the Maildir and records their
+// arrival in the Ping Log.
+func collectPings(secret *keymgr.Secring, pings *pinger.Log) {
+	dir := maildir.Dir(cfg.Files.Maildir)
+	keys, err := dir.Unseen()
+	if err != nil {
+		log.Warnf("Unable to read Maildir: %s", err)
+		return
+	}
+	decoder := packet.NewDecoder(secret)
+	for _, key := range keys {
+		var mailMsg *mail.Message
+		mailMsg, err = dir.Message(key)
+		if err != nil {
+			log.Warnf("%s: Reading message failed with: %s", key, err)
+			continue
+		}
+		err = collectPing(decoder, pings, mailMsg)
+		if err != nil {
+			log.Info(err)
+		}
+		err = dir.Purge(key)
+		if err != nil {
+			log.Warnf("Cannot delete mail: %s", err)
+		}
+	}
+}
+
+// collectPing decodes a single returned ping and records its arrival.
+func collectPing(
+	decoder *packet.Decoder,
+	pings *pinger.Log,
+	mailMsg *mail.Message,
+) (err error) {
+	msg, err := stripArmor(mailMsg.Body)
+	if err != nil {
+		return
+	}
+	hop, err := decoder.Decode(msg)
+	if err != nil {
+		return
+	}
+	exit, ok := hop.(*packet.Exit)
+	if !ok || exit.Final.DeliveryMethod() != packet.DeliverPing {
+		err = errors.New("received message is not a ping")
+		return
+	}
+	id, err := pingID(exit.Body)
+	if err != nil {
+		return
+	}
+	p, err := pings.Received(id)
+	if err != nil {
+		err = fmt.Errorf("%x: %w", id, err)
+		return
+	}
+	log.Tracef(
+		"Received ping: Chain=%s, Latency=%s",
+		strings.Join(p.Chain, ","),
+		p.Latency().Round(time.Second),
+	)
+	return
+}
+
+// pingID extracts the Ping ID from the body of a ping.
+func pingID(body []byte) (id []byte, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Ping: ") {
+			id, err = hex.DecodeString(line[6:])
+			return
+		}
+	}
+	err = errors.New("no Ping ID found in ping")
+	return
+}
+
+// writePingStats calculates remailer stats from the Ping Log and writes them
+// to the mlist2.txt file.
+func writePingStats(pings *pinger.Log, remailers []keymgr.Remailer) (err error) {
+	all, err := pings.Pings()
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, r := range remailers {
+		names = append(names, r.Name())
+	}
+	now := time.Now()
+	timeout := time.Duration(cfg.Pinger.Timeout) * time.Hour
+	stats := pinger.Remailers(all, names, now, timeout)
+	broken := pinger.BrokenChains(all, stats, now, timeout)
+	log.Infof(
+		"Writing stats for %d remailers (%d broken chains) to %s",
+		len(stats),
+		len(broken),
+		cfg.Files.Mlist2,
+	)
+	err = Pubring.WriteStats(cfg.Files.Mlist2, stats, broken)
+	return
+}
@@ -0,0 +1,139 @@
+// Package pinger records pings sent through remailers and derives the
+// reliability statistics published in mlist2.txt files.
+package pinger
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"github.com/crooks/yamn/crandom"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ErrUnknownPing is returned when a received ping wasn't sent by this pinger
+// or has already been received.
+var ErrUnknownPing = errors.New("unknown ping")
+
+// Ping is a record of a single ping sent through a chain of remailers.
+type Ping struct {
+	Chain    []string  // Names of the remailers the ping was sent through
+	Sent     time.Time // When the ping was sent
+	Received time.Time // When the ping returned (zero if it hasn't)
+}
+
+// Returned tests if a ping has been received.
+func (p Ping) Returned() bool {
+	return !p.Received.IsZero()
+}
+
+// Latency returns the time taken for a ping to return.
+func (p Ping) Latency() time.Duration {
+	return p.Received.Sub(p.Sent)
+}
+
+// Log is a database of sent pings.
+type Log struct {
+	db *leveldb.DB // A level DB instance
+}
+
+// Open opens (or creates) a ping log.
+func Open(filename string) (l *Log, err error) {
+	db, err := leveldb.OpenFile(filename, nil)
+	if err != nil {
+		return
+	}
+	l = &Log{db: db}
+	return
+}
+
+// Close closes the ping log.
+func (l *Log) Close() {
+	l.db.Close()
+}
+
+// put encodes and stores a ping
+func (l *Log) put(id []byte, p Ping) (err error) {
+	buf := new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(p)
+	if err != nil {
+		return
+	}
+	err = l.db.Put(id, buf.Bytes(), nil)
+	return
+}
+
+// Sent records a ping sent through chain and returns the ID that will
+// identify it when it returns.
+func (l *Log) Sent(chain []string) (id []byte, err error) {
+	id = crandom.Randbytes(16)
+	err = l.put(id, Ping{Chain: chain, Sent: time.Now()})
+	return
+}
+
+// Received marks the ping identified by id as returned.
+func (l *Log) Received(id []byte) (p Ping, err error) {
+	b, err := l.db.Get(id, nil)
+	if err == leveldb.ErrNotFound {
+		err = ErrUnknownPing
+		return
+	} else if err != nil {
+		return
+	}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&p)
+	if err != nil {
+		return
+	}
+	if p.Returned() {
+		// Only the first copy of a ping counts
+		err = ErrUnknownPing
+		return
+	}
+	p.Received = time.Now()
+	err = l.put(id, p)
+	return
+}
+
+// Pings returns every ping in the log.
+func (l *Log) Pings() (pings []Ping, err error) {
+	iter := l.db.NewIterator(nil, nil)
+	for iter.Next() {
+		var p Ping
+		err = gob.NewDecoder(bytes.NewReader(iter.Value())).Decode(&p)
+		if err != nil {
+			break
+		}
+		pings = append(pings, p)
+	}
+	iter.Release()
+	if err == nil {
+		err = iter.Error()
+	}
+	return
+}
+
+// Expire deletes pings sent longer ago than age.
+func (l *Log) Expire(age time.Duration) (retained, expired int, err error) {
+	cutoff := time.Now().Add(-age)
+	iter := l.db.NewIterator(nil, nil)
+	for iter.Next() {
+		var p Ping
+		err = gob.NewDecoder(bytes.NewReader(iter.Value())).Decode(&p)
+		if err != nil || p.Sent.Before(cutoff) {
+			// Undecodable entries are also deleted
+			err = l.db.Delete(iter.Key(), nil)
+			if err != nil {
+				break
+			}
+			expired++
+			continue
+		}
+		retained++
+	}
+	iter.Release()
+	if err == nil {
+		err = iter.Error()
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package pinger
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pingdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer l.Close()
+	id, err := l.Sent([]string{"test01"})
+	if err != nil {
+		t.Fatalf("Sent failed: %s", err)
+	}
+	p, err := l.Received(id)
+	if err != nil {
+		t.Fatalf("Received failed: %s", err)
+	}
+	if !p.Returned() || p.Chain[0] != "test01" {
+		t.Fatalf("Unexpected ping record: %+v", p)
+	}
+	// A second copy of the same ping shouldn't count
+	_, err = l.Received(id)
+	if !errors.Is(err, ErrUnknownPing) {
+		t.Fatalf("Expected ErrUnknownPing, got: %v", err)
+	}
+	_, err = l.Received([]byte("0123456789abcdef"))
+	if !errors.Is(err, ErrUnknownPing) {
+		t.Fatalf("Expected ErrUnknownPing, got: %v", err)
+	}
+	pings, err := l.Pings()
+	if err != nil || len(pings) != 1 {
+		t.Fatalf("Expected 1 ping, got %d: %v", len(pings), err)
+	}
+	retained, expired, err := l.Expire(time.Hour)
+	if err != nil || retained != 1 || expired != 0 {
+		t.Fatalf("Unexpected expiry: Retained=%d, Expired=%d, Err=%v", retained, expired, err)
+	}
+}
+
+// ping returns a Ping sent daysAgo that took latency to return.  A zero
+// latency indicates the ping never returned.
+func ping(now time.Time, daysAgo int, latency time.Duration, chain ...string) Ping {
+	sent := now.Add(-time.Duration(daysAgo)*day - time.Hour*12)
+	p := Ping{Chain: chain, Sent: sent}
+	if latency > 0 {
+		p.Received = sent.Add(latency)
+	}
+	return p
+}
+
+func TestRemailers(t *testing.T) {
+	now := time.Now()
+	timeout := 6 * time.Hour
+	pings := []Ping{
+		ping(now, 0, 20*time.Minute, "test01"),
+		ping(now, 0, 0, "test01"),
+		ping(now, 1, 3*time.Minute, "test01"),
+		ping(now, 1, 4*time.Minute, "test01"),
+		ping(now, 1, 2*time.Minute, "test01"),
+		// Too old to be included
+		ping(now, HistDays, time.Minute, "test01"),
+		// Still in flight so ignored
+		{Chain: []string{"test01"}, Sent: now.Add(-time.Minute)},
+		// Chain pings don't count towards remailer stats
+		ping(now, 0, 0, "test01", "test02"),
+	}
+	stats := Remailers(pings, []string{"test01", "test02"}, now, timeout)
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 remailers, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.LatentHist != "??????????03" {
+		t.Errorf("Unexpected latency history: %s", s.LatentHist)
+	}
+	if s.UptimeHist != "??????????+5" {
+		t.Errorf("Unexpected uptime history: %s", s.UptimeHist)
+	}
+	if s.Latent != 4 {
+		t.Errorf("Expected latency of 4 minutes, got %d", s.Latent)
+	}
+	if s.Uptime != 800 {
+		t.Errorf("Expected uptime of 80.0%%, got %d", s.Uptime)
+	}
+	if stats[1].UptimeHist != "????????????" || stats[1].Uptime != 0 {
+		t.Errorf("Expected no data for test02, got %+v", stats[1])
+	}
+}
+
+func TestBrokenChains(t *testing.T) {
+	now := time.Now()
+	timeout := 6 * time.Hour
+	var pings []Ping
+	for n := 0; n < minChainPings; n++ {
+		pings = append(pings, ping(now, n, time.Minute, "test01"))
+		pings = append(pings, ping(now, n, time.Minute, "test02"))
+		pings = append(pings, ping(now, n, 0, "test03"))
+		// test01 -> test02 never works but both are reliable
+		pings = append(pings, ping(now, n, 0, "test01", "test02"))
+		// test02 -> test01 works
+		pings = append(pings, ping(now, n, time.Minute, "test02", "test01"))
+		// test01 -> test03 fails but test03 is unreliable
+		pings = append(pings, ping(now, n, 0, "test01", "test03"))
+	}
+	names := []string{"test01", "test02", "test03"}
+	stats := Remailers(pings, names, now, timeout)
+	broken := BrokenChains(pings, stats, now, timeout)
+	if len(broken) != 1 {
+		t.Fatalf("Expected 1 broken chain, got %d: %v", len(broken), broken)
+	}
+	if broken[0].From != "test01" || broken[0].To != "test02" {
+		t.Errorf("Unexpected broken chain: %+v", broken[0])
+	}
+}
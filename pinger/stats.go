@@ -0,0 +1,202 @@
+package pinger
+
+import (
+	"sort"
+	"time"
+
+	"github.com/crooks/yamn/keymgr"
+)
+
+const (
+	// HistDays is the number of days of history published for each remailer
+	HistDays = 12
+	// minChainPings is the number of resolved chain pings required before
+	// a chain can be declared broken
+	minChainPings = 3
+	// minChainUptime is the uptime (10ths of a %) both remailers must have
+	// for a chain with no returned pings to be declared broken.  Below this,
+	// failures are attributed to the remailers rather than the chain.
+	minChainUptime = 500
+)
+
+const day = 24 * time.Hour
+
+/*
+Latency histories represent the median latency for each day using the
+following scale:
+0 = <5m, 1 = <10m, 2 = <15m, 3 = <30m, 4 = <1h, 5 = <2h, 6 = <4h, 7 = <8h,
+8 = <16h, 9 = 16h+
+
+Uptime histories represent the percentage of pings returned each day in
+tens of percent (0-9) or + for 100%.
+
+In both cases, ? indicates there's no data for the day.
+*/
+var latentScale = []time.Duration{
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+	16 * time.Hour,
+}
+
+// resolved tests if the outcome of a ping is known.  A ping is resolved if
+// it's returned or was sent longer ago than timeout.
+func resolved(p Ping, now time.Time, timeout time.Duration) bool {
+	return p.Returned() || now.Sub(p.Sent) > timeout
+}
+
+// median returns the median of a slice of durations
+func median(d []time.Duration) time.Duration {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	return d[len(d)/2]
+}
+
+// latentChar returns the history character representing a latency
+func latentChar(d time.Duration) byte {
+	for n, limit := range latentScale {
+		if d < limit {
+			return byte('0' + n)
+		}
+	}
+	return '9'
+}
+
+// uptimeChar returns the history character representing a ratio of returned
+// to resolved pings
+func uptimeChar(returned, resolved int) byte {
+	if returned == resolved {
+		return '+'
+	}
+	return byte('0' + (returned*10)/resolved)
+}
+
+// Remailers calculates stats for each of the named remailers from the
+// single-hop pings in pings.  Pings that haven't returned and are younger
+// than timeout are ignored.
+func Remailers(
+	pings []Ping,
+	names []string,
+	now time.Time,
+	timeout time.Duration,
+) (stats []keymgr.Stat) {
+	type history struct {
+		latencies [HistDays][]time.Duration
+		resolved  [HistDays]int
+	}
+	hists := make(map[string]*history)
+	for _, name := range names {
+		hists[name] = new(history)
+	}
+	for _, p := range pings {
+		if len(p.Chain) != 1 || !resolved(p, now, timeout) {
+			continue
+		}
+		h, known := hists[p.Chain[0]]
+		if !known {
+			continue
+		}
+		age := int(now.Sub(p.Sent) / day)
+		if age < 0 || age >= HistDays {
+			continue
+		}
+		// Histories are written with the oldest day first
+		slot := HistDays - 1 - age
+		h.resolved[slot]++
+		if p.Returned() {
+			h.latencies[slot] = append(h.latencies[slot], p.Latency())
+		}
+	}
+	for _, name := range names {
+		h := hists[name]
+		latentHist := make([]byte, HistDays)
+		uptimeHist := make([]byte, HistDays)
+		var all []time.Duration
+		var returned, resolved int
+		for slot := 0; slot < HistDays; slot++ {
+			if h.resolved[slot] == 0 {
+				latentHist[slot] = '?'
+				uptimeHist[slot] = '?'
+				continue
+			}
+			if len(h.latencies[slot]) == 0 {
+				latentHist[slot] = '?'
+			} else {
+				latentHist[slot] = latentChar(median(h.latencies[slot]))
+			}
+			uptimeHist[slot] = uptimeChar(len(h.latencies[slot]), h.resolved[slot])
+			all = append(all, h.latencies[slot]...)
+			returned += len(h.latencies[slot])
+			resolved += h.resolved[slot]
+		}
+		stat := keymgr.Stat{
+			Name:       name,
+			LatentHist: string(latentHist),
+			UptimeHist: string(uptimeHist),
+		}
+		if returned > 0 {
+			stat.Latent = int(median(all).Minutes())
+			stat.Uptime = (returned * 1000) / resolved
+		}
+		stats = append(stats, stat)
+	}
+	return
+}
+
+// BrokenChains identifies pairs of remailers where chain pings have failed,
+// despite both remailers being reliable on their own.  Stats should be the
+// output of Remailers.
+func BrokenChains(
+	pings []Ping,
+	stats []keymgr.Stat,
+	now time.Time,
+	timeout time.Duration,
+) (broken []keymgr.BrokenChain) {
+	type result struct {
+		resolved int
+		returned int
+	}
+	uptime := make(map[string]int)
+	for _, s := range stats {
+		uptime[s.Name] = s.Uptime
+	}
+	chains := make(map[keymgr.BrokenChain]*result)
+	for _, p := range pings {
+		if len(p.Chain) != 2 || !resolved(p, now, timeout) {
+			continue
+		}
+		if now.Sub(p.Sent) >= HistDays*day {
+			continue
+		}
+		chain := keymgr.BrokenChain{From: p.Chain[0], To: p.Chain[1]}
+		r, exists := chains[chain]
+		if !exists {
+			r = new(result)
+			chains[chain] = r
+		}
+		r.resolved++
+		if p.Returned() {
+			r.returned++
+		}
+	}
+	for chain, r := range chains {
+		if r.resolved < minChainPings || r.returned > 0 {
+			continue
+		}
+		if uptime[chain.From] < minChainUptime || uptime[chain.To] < minChainUptime {
+			continue
+		}
+		broken = append(broken, chain)
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].From == broken[j].From {
+			return broken[i].To < broken[j].To
+		}
+		return broken[i].From < broken[j].From
+	})
+	return
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path"
+	"testing"
+
+	"github.com/crooks/yamn/config"
+)
+
+func TestUsePingerDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg = new(config.Config)
+	cfg.Files.Secring = path.Join(dir, "secring.mix")
+	cfg.Files.Pubkey = path.Join(dir, "key.txt")
+	cfg.Files.Maildir = path.Join(dir, "Maildir")
+	cfg.Files.Pooldir = path.Join(dir, "pool")
+	cfg.Files.PingerDir = path.Join(dir, "pinger")
+	err := usePingerDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Files.Pooldir != path.Join(dir, "pinger", "pool") {
+		t.Errorf("Pool not in PingerDir: %s", cfg.Files.Pooldir)
+	}
+	if cfg.Files.Pubkey != path.Join(dir, "pinger", "key.txt") {
+		t.Errorf("Key not in PingerDir: %s", cfg.Files.Pubkey)
+	}
+	// A PingerDir that's also the remailer's dir would share its files
+	cfg.Files.Secring = path.Join(dir, "secring.mix")
+	cfg.Files.PingerDir = dir + "/"
+	if err := usePingerDir(); err == nil {
+		t.Error("Expected an error when the pinger shares the remailer's files")
+	}
+}
@@ -3,24 +3,63 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"net/mail"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	//"github.com/codahale/blake2"
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/config"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
 	"github.com/luksen/maildir"
 )
 
 // serverPoolOutboundSend is intended to be run concurrently with the server
-// daemon.  It sends messages from the pool at timed intervals.
-func serverPoolOutboundSend() {
+// daemon.  It sends messages from the pool at timed intervals.  Closing stop
+// ends the function once the current batch has been sent.  A config received
+// on reload contains new pool and mail settings.
+func serverPoolOutboundSend(stop <-chan struct{}, reload <-chan *config.Config) {
+	sleepFor, strategy := poolSettings()
+	for {
+		pool, err := poolContents()
+		if err != nil {
+			log.Warnf("Unable to access pool: %s", err)
+		}
+		now := time.Now()
+		batch := strategy.Batch(dueMessages(pool, now), now)
+		batchSizes.Observe(float64(len(batch)))
+		deliverBatch(batch)
+		timer := time.NewTimer(sleepFor)
+	wait:
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case newCfg := <-reload:
+				applyPoolConfig(newCfg)
+				sleepFor, strategy = poolSettings()
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+}
+
+// poolSettings returns the pool loop interval and mix strategy, correcting
+// any invalid config settings.
+func poolSettings() (sleepFor time.Duration, strategy MixStrategy) {
 	if cfg.Pool.Loop < 120 {
 		log.Warnf(
 			"Pool loop of %d Seconds is too short. "+
@@ -29,17 +68,14 @@ func serverPoolOutboundSend() {
 		)
 		cfg.Pool.Loop = 120
 	}
-	sleepFor := time.Duration(cfg.Pool.Loop) * time.Second
-	for {
-		// Read dynamic mix of outbound files from the Pool
-		// filenames = dynamicMix()
-		// Read binomialMix of outbound files from the Pool
-		filenames := binomialMix()
-		for _, filename := range filenames {
-			emailPoolFile(filename)
-		}
-		time.Sleep(sleepFor)
+	sleepFor = time.Duration(cfg.Pool.Loop) * time.Second
+	strategy, err := newMixStrategy()
+	if err != nil {
+		log.Warnf("%s.  Using a binomial pool.", err)
+		cfg.Pool.Type = "binomial"
+		strategy, _ = newMixStrategy()
 	}
+	return
 }
 
 // poolOutboundSend flushes the outbound pool.  This should only be performed
@@ -54,25 +90,62 @@ func poolOutboundSend() {
 		err = errors.New("cannot flush pool when running as a daemon")
 		panic(err)
 	}
-	var filenames []string
+	if flag.Remailer {
+		// During normal operation, the pool shouldn't be flushed.
+		log.Warn("Flushing outbound remailer pool")
+	}
+	flushPool()
+}
+
+// flushPool sends every message in the outbound pool.
+func flushPool() {
 	// Read all the pool files
-	filenames, err = readDir(cfg.Files.Pooldir, "m")
+	filenames, err := readDir(cfg.Files.Pooldir, "m")
 	if err != nil {
 		log.Warnf("Reading pool failed: %s", err)
 		return
 	}
-	if flag.Remailer {
-		// During normal operation, the pool shouldn't be flushed.
-		log.Warn("Flushing outbound remailer pool")
+	deliverBatch(filenames)
+}
+
+// deliverBatch emails a batch of pool files using a bounded pool of
+// concurrent workers.  Files are handed to the workers in batch order so a
+// shuffled batch is started in its shuffled order.  SMTP sessions opened
+// during the batch are closed once it completes.
+func deliverBatch(filenames []string) {
+	if len(filenames) == 0 {
+		return
+	}
+	smtpSessions.startBatch()
+	jobs := make(chan string)
+	var sent int64
+	var wg sync.WaitGroup
+	for i := 0; i < min(max(1, cfg.Mail.Workers), len(filenames)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				if emailPoolFile(filename) {
+					atomic.AddInt64(&sent, 1)
+				}
+			}
+		}()
 	}
 	for _, filename := range filenames {
-		emailPoolFile(filename)
+		jobs <- filename
 	}
+	close(jobs)
+	wg.Wait()
+	smtpSessions.closeAll()
+	ingestMu.Lock()
+	stats.outMail += int(sent)
+	ingestMu.Unlock()
 }
 
 // emailPoolFile tries to email a given file from the Pool.  If conditions are
-// met, the file is then deleted.
-func emailPoolFile(filename string) {
+// met, the file is then deleted.  The return value indicates if the file was
+// successfully mailed.
+func emailPoolFile(filename string) (sent bool) {
 	delFlag, err := mailPoolFile(path.Join(cfg.Files.Pooldir, filename))
 	if err != nil {
 		log.Warnf("Pool mailing failed: %s", err)
@@ -80,64 +153,17 @@ func emailPoolFile(filename string) {
 			// If delFlag is true, we delete the file, even though
 			// mailing failed.
 			poolDelete(filename)
+			return
 		}
-	} else {
-		stats.outMail++
-		poolDelete(filename)
-	}
-}
-
-// getBatchSize takes a Pool size and returns a corresponding batch size.  This
-// is intended for use with Binomial Mix Pools.
-func getBatchSize(poolSize int) int {
-	/*
-		poolSize         -  Number of files in the pool
-		cfg.Pool.Size    -  Minimum messages to keep in pool
-		cfg.Pool.MinSend -  Minimum number of messages to consider sending
-		cfg.Pool.Rate    -  Percentage of Pool in the batch
-	*/
-	if poolSize < (cfg.Pool.Size + cfg.Pool.MinSend) {
-		return 0
-	}
-	sendable := poolSize - cfg.Pool.Size
-	rate := float32(cfg.Pool.Rate) / 100
-	maxSend := max(1, int(float32(poolSize)*rate))
-	return min(sendable, maxSend)
-}
-
-// binomialMix returns a batched subset of Pool files to send using a
-// Probability B/P method of selecting each file.
-func binomialMix() (batch []string) {
-	poolFiles, err := readDir(cfg.Files.Pooldir, "m")
-	if err != nil {
-		log.Warnf("Unable to access pool: %s", err)
-		return
-	}
-	poolSize := len(poolFiles)
-	batchSize := getBatchSize(poolSize)
-	if batchSize == 0 {
-		log.Tracef("Binomial Mix Pool: Size=%d", poolSize)
-		// If the batch is empty, don't bother to process it.
-		return
-	}
-	// Shuffle the slice of filenames now as we're only going to consider a
-	// subset in the following loop.
-	crandom.Shuffle(poolFiles)
-	// Multiply probability by 255 as dice() returns 0-255.
-	prob := int((float32(batchSize) / float32(poolSize)) * 255)
-	// Test each pool filename against a biased coin-toss
-	for _, s := range poolFiles[:batchSize] {
-		if prob >= crandom.Dice() {
-			batch = append(batch, s)
+		// Back off before retrying or retire it to the dead letters
+		err = poolRetry(filename, err)
+		if err != nil {
+			log.Warnf("%s: Failed to record delivery attempt: %s", filename, err)
 		}
+		return
 	}
-	log.Tracef(
-		"Binomial Mix Pool: Size=%d, Batch=%d, Prob=%d/255, Sending=%d",
-		poolSize,
-		batchSize,
-		prob,
-		len(batch),
-	)
+	poolDelete(filename)
+	sent = true
 	return
 }
 
@@ -170,40 +196,9 @@ func processMail(secret *keymgr.Secring) (err error) {
 		newMsgs,
 		cfg.Files.Maildir,
 	)
-	// Increment inbound Email counter
-	stats.inMail += newMsgs
-	// Fetch headers for each Maildir key
-	var head mail.Header
 	for _, key := range keys {
-		head, err = dir.Header(key)
-		if err != nil {
-			log.Warnf("%s: Getting headers failed with: %s", key, err)
-			continue
-		}
-		// The Subject determines if the message needs remailer-foo handling
-		subject := strings.TrimSpace(strings.ToLower(head.Get("Subject")))
-		if strings.HasPrefix(subject, "remailer-") {
-			// It's a remailer-foo request
-			err = remailerFoo(subject, head.Get("From"))
-			if err == nil {
-				// Increments stats counter
-				stats.inRemFoo++
-			} else {
-				log.Info(err)
-			}
-			err = dir.Purge(key)
-			if err != nil {
-				log.Warnf(
-					"Cannot delete remailer-foo mail: %s",
-					err,
-				)
-			}
-			// Nothing else to do, move on to the next message
-			continue
-		}
-		// It's not a remailer-foo request so assume a remailer message
 		var mailMsg *mail.Message
-		mailMsg, err := dir.Message(key)
+		mailMsg, err = dir.Message(key)
 		if err != nil {
 			log.Warnf(
 				"%s: Reading message failed with: %s",
@@ -212,18 +207,7 @@ func processMail(secret *keymgr.Secring) (err error) {
 			)
 			continue
 		}
-		var msg []byte
-		// Convert the armored Yamn message to its byte components
-		msg, err = stripArmor(mailMsg.Body)
-		if err != nil {
-			log.Info(err)
-			continue
-		}
-		if msg == nil {
-			log.Warn("Dearmor returned zero bytes")
-			continue
-		}
-		err = decodeMsg(msg, secret)
+		err = ingestMessage(mailMsg, secret)
 		if err != nil {
 			log.Info(err)
 		}
@@ -235,8 +219,51 @@ func processMail(secret *keymgr.Secring) (err error) {
 	return
 }
 
-// processInpool is similar to processMail but reads the Inbound Pool
-func processInpool(prefix string, secret *keymgr.Secring) {
+// ingestMessage processes an inbound email.  Messages with a remailer-foo
+// Subject are requests for remailer information.  All others are expected
+// to contain an armored YAMN packet.  Messages received by the SMTP listener
+// and from the Maildir take the same path.
+func ingestMessage(mailMsg *mail.Message, secret *keymgr.Secring) (err error) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	// Increment inbound Email counter.  Stats are only modified whilst
+	// holding ingestMu.
+	stats.inMail++
+	// The Subject determines if the message needs remailer-foo handling
+	subject := strings.TrimSpace(strings.ToLower(mailMsg.Header.Get("Subject")))
+	if strings.HasPrefix(subject, "remailer-") {
+		// It's a remailer-foo request
+		err = remailerFoo(subject, mailMsg.Header.Get("From"))
+		if err == nil {
+			// Increments stats counter
+			stats.inRemFoo++
+		}
+		return
+	}
+	// It's not a remailer-foo request so assume a remailer message
+	var msg []byte
+	// Convert the armored Yamn message to its byte components
+	msg, err = stripArmor(mailMsg.Body)
+	if err != nil {
+		stats.inDecodeFail++
+		err = fmt.Errorf("%w: %s", errNotYamn, err)
+		return
+	}
+	if msg == nil {
+		err = fmt.Errorf("%w: Dearmor returned zero bytes", errNotYamn)
+		return
+	}
+	err = decodeMsg(msg, secret)
+	if err != nil {
+		stats.reject(err)
+	}
+	return
+}
+
+// processInpool is similar to processMail but reads the Inbound Pool.  It
+// returns the earliest release time of the packets still held in the pool, or
+// a zero time if none are held.
+func processInpool(prefix string, secret *keymgr.Secring) (next time.Time) {
 	poolFiles, err := readDir(cfg.Files.Pooldir, prefix)
 	if err != nil {
 		log.Warnf("Unable to access inbound pool: %s", err)
@@ -246,13 +273,29 @@ func processInpool(prefix string, secret *keymgr.Secring) {
 	processed := 0
 	for _, f := range poolFiles {
 		filename := path.Join(cfg.Files.Pooldir, f)
-		msg := make([]byte, messageBytes)
+		msg := make([]byte, packet.MessageBytes)
 		msg, err = os.ReadFile(filename)
 		if err != nil {
 			log.Warnf("Failed to read %s from pool: %s", f, err)
 			continue
 		}
-		err = decodeMsg(msg, secret)
+		var release time.Time
+		msg, release, err = inboundPacket(msg)
+		if !release.IsZero() {
+			// Not yet due for release
+			if next.IsZero() || release.Before(next) {
+				next = release
+			}
+			continue
+		}
+		ingestMu.Lock()
+		if err == nil {
+			err = decodeMsg(msg, secret)
+		}
+		if err != nil {
+			stats.reject(err)
+		}
+		ingestMu.Unlock()
 		if err != nil {
 			log.Warn(err)
 		}
@@ -263,6 +306,61 @@ func processInpool(prefix string, secret *keymgr.Secring) {
 		log.Tracef("Inbound pool processing complete. Read=%d, Decoded=%d",
 			poolSize, processed)
 	}
+	return
+}
+
+// writeInboundToPool writes a packet addressed to this remailer to the
+// inbound pool.  Packets are normally written raw but those with a release
+// time are armored behind internal headers so processInpool can hold them.
+// The file is written to a temporary name and renamed so that a partially
+// written packet is never seen by processInpool.
+func writeInboundToPool(payload []byte, release time.Time) (err error) {
+	buf := new(bytes.Buffer)
+	if release.IsZero() {
+		buf.Write(payload)
+	} else {
+		writeInternalHeader(buf, newPoolHeader(release))
+		buf.WriteString("\n")
+		armor(buf, payload)
+	}
+	f, err := os.CreateTemp(cfg.Files.Pooldir, "tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	err = os.Rename(f.Name(), randPoolFilename("i"))
+	return
+}
+
+// inboundPacket returns the packet contained in an inbound pool file.  Files
+// with internal headers are held until their release time.  For held files,
+// release is returned instead of the packet.
+func inboundPacket(b []byte) (pkt []byte, release time.Time, err error) {
+	if !bytes.HasPrefix(b, []byte("Yamn-")) {
+		// A raw packet
+		return b, time.Time{}, nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	h, err := parsePoolHeader(msg.Header)
+	if err != nil {
+		return
+	}
+	if h.release.After(time.Now()) {
+		release = h.release
+		return
+	}
+	pkt, err = stripArmor(msg.Body)
+	return
 }
 
 // randPoolFilename returns a random filename with a given prefix.  This should
@@ -295,28 +393,63 @@ func newPoolFile(prefix string) (f *os.File, err error) {
 }
 
 // writeMessageToPool requires a recipient address (another remailer) and a
-// payload (that gets Base64 armored).
-func writeMessageToPool(sendTo string, payload []byte) {
+// payload (that gets Base64 armored).  The pool filename is returned.
+func writeMessageToPool(sendTo string, payload []byte) (filename string) {
+	return holdMessageInPool(sendTo, payload, time.Time{})
+}
+
+// holdMessageInPool is writeMessageToPool for messages that shouldn't be sent
+// before the release time.  A zero release time doesn't hold the message.
+func holdMessageInPool(sendTo string, payload []byte, release time.Time) (filename string) {
 	f, err := newPoolFile("m")
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
 	// Add mail headers to the pool file
-	writeInternalHeader(f)
+	writeInternalHeader(f, newPoolHeader(release))
 	writeMailHeaders(f, sendTo)
 	// Armor the payload
 	armor(f, payload)
+	_, filename = path.Split(f.Name())
+	return
+}
+
+// writeMessageToMbox writes an armored message to w in mbox format.  Each
+// message is preceded by a From_ separator line and followed by a blank line.
+// The armor never produces lines starting with "From " so no escaping is
+// required.
+func writeMessageToMbox(w io.Writer, sendTo string, payload []byte) {
+	fmt.Fprintf(
+		w,
+		"From %s %s\n",
+		cfg.Remailer.Address,
+		time.Now().UTC().Format(time.ANSIC),
+	)
+	writeMailHeaders(w, sendTo)
+	armor(w, payload)
+	w.Write([]byte("\n"))
+}
+
+// clientOutput writes a client message to stdout if --stdout was specified,
+// otherwise it's written to the pool.
+func clientOutput(sendTo string, payload []byte) {
+	if flag.Stdout {
+		writeMessageToMbox(os.Stdout, sendTo, payload)
+		return
+	}
+	writeMessageToPool(sendTo, payload)
 }
 
-// writePlainToPool writes a plaintext file to the pool and returns the filename
-func writePlainToPool(payload []byte, prefix string) (filename string) {
+// writePlainToPool writes a plaintext file to the pool and returns the
+// filename.  A non-zero release time holds the message in the pool until then.
+func writePlainToPool(payload []byte, prefix string, release time.Time) (filename string) {
 	f, err := newPoolFile(prefix)
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
-	writeInternalHeader(f)
+	writeInternalHeader(f, newPoolHeader(release))
 	f.Write(payload)
 	_, filename = path.Split(f.Name())
 	return
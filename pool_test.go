@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/config"
+	"github.com/crooks/yamn/crandom"
+	"github.com/crooks/yamn/packet"
+)
+
+func TestWriteMessageToMbox(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Remailer.Address = "client@domain.foo"
+	payload := crandom.Randbytes(packet.MessageBytes)
+	mbox := new(bytes.Buffer)
+	writeMessageToMbox(mbox, "entry@domain.foo", payload)
+	writeMessageToMbox(mbox, "entry@domain.foo", payload)
+	var separators int
+	for _, line := range strings.Split(mbox.String(), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			separators++
+			if !strings.HasPrefix(line, "From client@domain.foo ") {
+				t.Errorf("Unexpected From_ line: %s", line)
+			}
+		}
+	}
+	if separators != 2 {
+		t.Fatalf("Expected 2 From_ separators, got %d", separators)
+	}
+	// Each message should carry the entry remailer and decode to the payload
+	messages := strings.Split(mbox.String(), "\nFrom ")
+	if !strings.Contains(messages[1], "\nTo: entry@domain.foo\n") {
+		t.Error("Second message has no To header for the entry remailer")
+	}
+	got, err := stripArmor(strings.NewReader(messages[0]))
+	if err != nil {
+		t.Fatalf("stripArmor failed: %s", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Armored payload doesn't match the original")
+	}
+}
+
+func TestDeliverBatch(t *testing.T) {
+	testPoolDirs(t)
+	cfg.Mail.Outfile = true
+	cfg.Mail.Workers = 3
+	cfg.Pool.MaxAge = 28
+	cfg.Remailer.Address = "remailer@domain.foo"
+	var batch []string
+	for i := 0; i < 10; i++ {
+		filename := fmt.Sprintf("m%02d", i)
+		testPoolFile(t, path.Join(cfg.Files.Pooldir, filename), newPoolHeader(time.Time{}))
+		batch = append(batch, filename)
+	}
+	stats.reset()
+	done := make(chan struct{})
+	go func() {
+		deliverBatch(batch)
+		close(done)
+	}()
+	// The admin API and metrics read stats during deliveries
+	a := newAdminServer(nil)
+	for delivering := true; delivering; {
+		select {
+		case <-done:
+			delivering = false
+		default:
+			a.stats()
+		}
+	}
+	if stats.outMail != len(batch) {
+		t.Errorf("Expected %d messages mailed, got %d", len(batch), stats.outMail)
+	}
+	if pool := mustPoolContents(t); len(pool) != 0 {
+		t.Errorf("Expected empty pool after delivery, got %d messages", len(pool))
+	}
+	outfiles, err := readDir(cfg.Files.Pooldir, "outfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outfiles) != len(batch) {
+		t.Errorf("Expected %d delivered messages, got %d", len(batch), len(outfiles))
+	}
+}
+
+func TestInboundHold(t *testing.T) {
+	testPoolDirs(t)
+	payload := crandom.Randbytes(packet.MessageBytes)
+	// Looped packets with a release time are held in the inbound pool
+	release := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, r := range []time.Time{release.Add(time.Hour), release} {
+		err := writeInboundToPool(payload, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The earliest release time is returned so it can be waited for
+	next := processInpool("i", nil)
+	if !next.Equal(release) {
+		t.Errorf("Expected next release at %s, got %s", release, next)
+	}
+	files, err := readDir(cfg.Files.Pooldir, "i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 held packets, got %d", len(files))
+	}
+	b, err := os.ReadFile(path.Join(cfg.Files.Pooldir, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, r, err := inboundPacket(b); r.IsZero() || err != nil {
+		t.Errorf("Expected a held packet, got release=%s, err=%v", r, err)
+	}
+
+	tests := []struct {
+		name    string
+		release time.Time
+	}{
+		{"released", time.Now().Add(-time.Second)},
+		{"raw", time.Time{}},
+	}
+	for _, test := range tests {
+		testPoolDirs(t)
+		err := writeInboundToPool(payload, test.release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := readDir(cfg.Files.Pooldir, "i")
+		if err != nil || len(files) != 1 {
+			t.Fatalf("%s: Expected 1 packet, got %v (%v)", test.name, files, err)
+		}
+		b, err := os.ReadFile(path.Join(cfg.Files.Pooldir, files[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, r, err := inboundPacket(b)
+		if !r.IsZero() || err != nil {
+			t.Errorf("%s: Unexpected release=%s, err=%v", test.name, r, err)
+		}
+		if !bytes.Equal(pkt, payload) {
+			t.Errorf("%s: Packet doesn't match payload", test.name)
+		}
+	}
+}
+
+func TestRemailerFooPooled(t *testing.T) {
+	testPoolDirs(t)
+	cfg.Remailer.Address = "remailer@domain.foo"
+	cfg.Files.Pubring = path.Join(t.TempDir(), "pubring.mix")
+	// Replies are pooled rather than mailed whilst holding ingestMu
+	err := remailerFoo("remailer-conf", "foo@bar.baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := mustPoolContents(t)
+	if len(pool) != 1 {
+		t.Fatalf("Expected 1 pooled reply, got %d", len(pool))
+	}
+	msg, _, err := readPoolFile(path.Join(cfg.Files.Pooldir, pool[0].name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "foo@bar.baz" {
+		t.Errorf("Unexpected recipient: %s", msg.Header.Get("To"))
+	}
+}
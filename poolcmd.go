@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	stdflag "flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// poolFileTypes describes the pool filename prefixes used by newPoolFile
+var poolFileTypes = map[string]string{
+	"m": "outbound",
+	"i": "inbound",
+	"p": "partial",
+}
+
+var errPoolUsage = errors.New("usage: yamn pool list|stats|show|purge|flush-one|dead|requeue [args]")
+
+// pooledFile describes a file in the pool for the pool commands
+type pooledFile struct {
+	name   string     // Pool filename
+	kind   string     // outbound, inbound or partial
+	size   int64      // File size in bytes
+	pooled time.Time  // From Yamn-Pooled-Date, or the file mtime
+	to     string     // Recipient (outbound files only)
+	header poolHeader // Internal headers (not inbound files)
+	err    error      // Error encountered parsing the file
+}
+
+// age returns the age of a pooled file in days
+func (p pooledFile) age() int {
+	return daysAgo(p.pooled)
+}
+
+// poolFileType returns the type of a pool file from its prefix
+func poolFileType(filename string) (kind string, err error) {
+	if filename == "" || strings.ContainsRune(filename, '/') {
+		err = fmt.Errorf("%s: Invalid pool filename", filename)
+		return
+	}
+	kind, known := poolFileTypes[filename[:1]]
+	if !known {
+		err = fmt.Errorf("%s: Not a pool message", filename)
+	}
+	return
+}
+
+// readPooledFile returns the details of a named pool file.  Inbound files are
+// mostly raw packets, without headers, so their age is taken from the file's
+// mtime.
+func readPooledFile(filename string) (p pooledFile, err error) {
+	p.kind, err = poolFileType(filename)
+	if err != nil {
+		return
+	}
+	fqfn := path.Join(cfg.Files.Pooldir, filename)
+	fi, err := os.Stat(fqfn)
+	if err != nil {
+		return
+	}
+	p.name = filename
+	p.size = fi.Size()
+	p.pooled = fi.ModTime()
+	if p.kind == "inbound" {
+		return
+	}
+	msg, h, perr := readPoolFile(fqfn)
+	if perr != nil {
+		p.err = perr
+		return
+	}
+	p.header = h
+	if !h.pooled.IsZero() {
+		p.pooled = h.pooled
+	}
+	p.to = msg.Header.Get("To")
+	return
+}
+
+// readPooledFiles returns the details of every message in the pool, sorted by
+// filename.
+func readPooledFiles() (files []pooledFile, err error) {
+	var names []string
+	for prefix := range poolFileTypes {
+		var prefixed []string
+		prefixed, err = readDir(cfg.Files.Pooldir, prefix)
+		if err != nil {
+			return
+		}
+		names = append(names, prefixed...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := readPooledFile(name)
+		if err != nil {
+			// The file may have been sent since the dir was read
+			continue
+		}
+		files = append(files, p)
+	}
+	return
+}
+
+// poolCommand runs one of the pool management subcommands
+func poolCommand(args []string) (err error) {
+	if len(args) == 0 {
+		return errPoolUsage
+	}
+	switch args[0] {
+	case "list":
+		err = poolList()
+	case "stats":
+		err = poolStats()
+	case "show":
+		if len(args) != 2 {
+			return errPoolUsage
+		}
+		err = poolShow(args[1])
+	case "purge":
+		if len(args) < 2 {
+			return errPoolUsage
+		}
+		err = poolPurge(args[1:])
+	case "flush-one":
+		err = poolFlushOne(args[1:])
+	case "dead":
+		err = listDeadLetters()
+	case "requeue":
+		if len(args) != 2 {
+			return errPoolUsage
+		}
+		err = requeueDeadLetters(args[1])
+	default:
+		err = fmt.Errorf("%s: Unknown pool command. %w", args[0], errPoolUsage)
+	}
+	return
+}
+
+// poolList prints a line for each message in the pool.  Partial chunks are
+// associated with their message if the chunk DB can be opened.
+func poolList() (err error) {
+	files, err := readPooledFiles()
+	if err != nil {
+		return
+	}
+	var chunks map[string]string
+	chunkDB, err := openChunk(cfg.Files.ChunkDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Chunk DB unavailable: %s\n", err)
+		err = nil
+	} else {
+		chunks = chunkDB.Files()
+		chunkDB.Close()
+	}
+	for _, p := range files {
+		fmt.Printf("%-16s %-8s Age=%dd Size=%d", p.name, p.kind, p.age(), p.size)
+		if p.to != "" {
+			fmt.Printf(" To=%s", p.to)
+		}
+		if p.kind == "partial" && chunks[p.name] != "" {
+			fmt.Printf(" %s", chunks[p.name])
+		}
+		if p.err != nil {
+			fmt.Printf(" Error=%q", p.err)
+		}
+		fmt.Println()
+	}
+	return
+}
+
+// poolStats prints a summary of the pool contents by type
+func poolStats() (err error) {
+	files, err := readPooledFiles()
+	if err != nil {
+		return
+	}
+	count := make(map[string]int)
+	bytes := make(map[string]int64)
+	oldest := make(map[string]int)
+	var held, retrying int
+	now := time.Now()
+	for _, p := range files {
+		count[p.kind]++
+		bytes[p.kind] += p.size
+		if p.age() > oldest[p.kind] {
+			oldest[p.kind] = p.age()
+		}
+		if p.header.release.After(now) {
+			held++
+		}
+		if p.header.next.After(now) {
+			retrying++
+		}
+	}
+	for _, kind := range []string{"outbound", "inbound", "partial"} {
+		fmt.Printf(
+			"%-8s Messages=%d Bytes=%d Oldest=%dd\n",
+			kind,
+			count[kind],
+			bytes[kind],
+			oldest[kind],
+		)
+	}
+	fmt.Printf("Held by sender: %d\nAwaiting retry: %d\n", held, retrying)
+	return
+}
+
+// poolShow prints the details of a single pool message
+func poolShow(filename string) (err error) {
+	p, err := readPooledFile(filename)
+	if err != nil {
+		return
+	}
+	fmt.Printf("File: %s\nType: %s\nSize: %d\n", p.name, p.kind, p.size)
+	fmt.Printf("Pooled: %s (%d days)\n", p.pooled.Format("2006-01-02"), p.age())
+	if p.kind == "inbound" {
+		return
+	}
+	if p.err != nil {
+		fmt.Printf("Error: %s\n", p.err)
+		return
+	}
+	fmt.Printf("To: %s\n", p.to)
+	if !p.header.release.IsZero() {
+		fmt.Printf("Release: %s\n", p.header.release.Format(time.RFC3339))
+	}
+	if p.header.attempts > 0 {
+		fmt.Printf("Attempts: %d\n", p.header.attempts)
+		fmt.Printf("Next attempt: %s\n", p.header.next.Format(time.RFC3339))
+		fmt.Printf("Last error: %s\n", p.header.lastErr)
+	}
+	return
+}
+
+// poolPurge deletes the named messages from the pool
+func poolPurge(filenames []string) (err error) {
+	for _, filename := range filenames {
+		_, err = poolFileType(filename)
+		if err != nil {
+			return
+		}
+		err = os.Remove(path.Join(cfg.Files.Pooldir, filename))
+		if err != nil {
+			return
+		}
+		fmt.Printf("Purged %s\n", filename)
+	}
+	return
+}
+
+// poolFlushOne makes a held or retrying outbound message due for sending.  It
+// remains in the pool so the mix strategy decides when it's sent, unless
+// --force is given, in which case it's mailed immediately.
+func poolFlushOne(args []string) (err error) {
+	flags := stdflag.NewFlagSet("flush-one", stdflag.ContinueOnError)
+	force := flags.Bool("force", false, "Send immediately, bypassing the mix")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		return errPoolUsage
+	}
+	filename := flags.Arg(0)
+	kind, err := poolFileType(filename)
+	if err != nil {
+		return
+	}
+	if kind != "outbound" {
+		err = fmt.Errorf("%s: Only outbound messages can be flushed", filename)
+		return
+	}
+	fqfn := path.Join(cfg.Files.Pooldir, filename)
+	msg, h, err := readPoolFile(fqfn)
+	if err != nil {
+		return
+	}
+	h.release = time.Time{}
+	h.next = time.Time{}
+	err = writePoolFile(fqfn, msg, h)
+	if err != nil {
+		return
+	}
+	if !*force {
+		fmt.Printf("%s: Released to the mix\n", filename)
+		return
+	}
+	delFlag, err := mailPoolFile(fqfn)
+	smtpSessions.closeAll()
+	if err != nil {
+		if delFlag {
+			poolDelete(filename)
+		}
+		return
+	}
+	poolDelete(filename)
+	fmt.Printf("%s: Sent\n", filename)
+	return
+}
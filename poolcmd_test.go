@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPoolFileType(t *testing.T) {
+	tests := []struct {
+		filename string
+		kind     string
+		valid    bool
+	}{
+		{"m0123456789abcd", "outbound", true},
+		{"i0123456789abcd", "inbound", true},
+		{"p0123456789abcd", "partial", true},
+		{"outfile-0123", "", false},
+		{"../m0123", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		kind, err := poolFileType(test.filename)
+		if (err == nil) != test.valid || kind != test.kind {
+			t.Errorf("%q: Expected %q (valid=%v), got %q (%v)", test.filename, test.kind, test.valid, kind, err)
+		}
+	}
+}
+
+func TestPoolFlushOne(t *testing.T) {
+	testPoolDirs(t)
+	filename := "mheld"
+	h := newPoolHeader(time.Now().Add(time.Hour))
+	h.attempts = 2
+	h.next = time.Now().Add(time.Hour)
+	testPoolFile(t, path.Join(cfg.Files.Pooldir, filename), h)
+	if due := dueMessages(mustPoolContents(t), time.Now()); len(due) != 0 {
+		t.Fatalf("Expected held message not to be due, got %d", len(due))
+	}
+	err := poolCommand([]string{"flush-one", filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due := dueMessages(mustPoolContents(t), time.Now()); len(due) != 1 {
+		t.Errorf("Expected flushed message to be due, got %d", len(due))
+	}
+	p, err := readPooledFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.to != "foo@bar.baz" || p.header.attempts != 2 {
+		t.Errorf("Flush altered the message: To=%s, Attempts=%d", p.to, p.header.attempts)
+	}
+	// Only outbound messages can be flushed
+	testPoolFile(t, path.Join(cfg.Files.Pooldir, "pchunk"), newPoolHeader(time.Time{}))
+	if err := poolCommand([]string{"flush-one", "pchunk"}); err == nil {
+		t.Error("Expected an error flushing a partial chunk")
+	}
+	err = poolCommand([]string{"purge", filename, "pchunk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool := mustPoolContents(t); len(pool) != 0 {
+		t.Errorf("Expected empty pool after purge, got %d messages", len(pool))
+	}
+}
+
+// mustPoolContents returns the outbound pool contents or fails the test
+func mustPoolContents(t *testing.T) []poolMessage {
+	pool, err := poolContents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/crooks/yamn/keymgr"
+)
+
+// previewChain builds the configured or supplied chain once for each copy of
+// a message and prints the details of every hop.  Nothing is encoded or sent.
+func previewChain() {
+	err := clientPubring()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: Pubring import failed: %s\n", cfg.Files.Pubring, err)
+		os.Exit(1)
+	}
+	spec, err := userChain()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid chain: %s\n", err)
+		os.Exit(1)
+	}
+	copies := flag.Copies
+	if copies == 0 {
+		copies = cfg.Stats.Numcopies
+	}
+	if copies > maxCopies {
+		copies = maxCopies
+	}
+	for n := 1; n <= copies; n++ {
+		var chain []string
+		chain, err = makeChain(spec)
+		if err != nil {
+			reportChainError(err)
+			os.Exit(1)
+		}
+		// As with real messages, all copies share an exit remailer
+		spec.hops[len(spec.hops)-1] = chain[len(chain)-1]
+		fmt.Printf("Chain %d: %s\n", n, strings.Join(chain, ","))
+		for hopNum, hop := range chain {
+			var r keymgr.Remailer
+			r, err = Pubring.Get(hop)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			previewHop(hopNum+1, r, hopNum == len(chain)-1)
+		}
+	}
+	if !Pubring.HaveStats() {
+		fmt.Println("Warning: No stats available for remailers")
+	} else if Pubring.StatsStale(cfg.Stats.StaleHrs) {
+		fmt.Printf(
+			"Warning: Stats are more than %d hours old\n",
+			cfg.Stats.StaleHrs,
+		)
+	}
+}
+
+// previewHop prints the details of a single hop in a chain.  Hops outside the
+// configured selection criteria are flagged as they were either specified by
+// the user or selected with relaxed criteria.
+func previewHop(hopNum int, r keymgr.Remailer, exit bool) {
+	latent := "-"
+	uptime := "-"
+	if Pubring.HaveStats() {
+		latent = fmt.Sprintf("%d:%02d", r.Latent()/60, r.Latent()%60)
+		uptime = fmt.Sprintf("%.1f%%", float32(r.Uptime())/10)
+	}
+	fmt.Printf(
+		"  %d: %-12s %-30s KeyID=%x Caps=%-4s Latency=%-5s Uptime=%-6s Expires=%s\n",
+		hopNum,
+		r.Name(),
+		r.Address,
+		r.Keyid,
+		r.Caps(),
+		latent,
+		uptime,
+		r.Until().Format("2006-01-02"),
+	)
+	if !Pubring.HaveStats() {
+		return
+	}
+	minrel := cfg.Stats.Minrel
+	if exit {
+		minrel = cfg.Stats.Relfinal
+	}
+	if r.Latent() < cfg.Stats.Minlat ||
+		r.Latent() > cfg.Stats.Maxlat ||
+		r.Uptime() < int(minrel*10) {
+		fmt.Println("     Warning: Outside configured latency and uptime criteria")
+	}
+	if exit && r.Middle() {
+		fmt.Println("     Warning: Middleman remailer cannot deliver final messages")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/config"
+	"github.com/crooks/yamn/keymgr"
+)
+
+// reloadConfig re-reads the config file and the keyrings.  The new config is
+// returned so its pool and mail settings can be handed to the pool sender,
+// which applies them between batches.  Other settings, such as file
+// locations, require a restart.
+func reloadConfig(secret *keymgr.Secring) (newCfg *config.Config, err error) {
+	newCfg, err = flag.ParseConfig()
+	if err != nil {
+		return
+	}
+	// Wait for any inbound message being processed
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	err = Pubring.ImportPubring()
+	if err != nil {
+		return
+	}
+	importFamilies()
+	err = secret.ImportSecring()
+	if err != nil {
+		return
+	}
+	log.Infof("Secret keyring contains %d keys", secret.Count())
+	return
+}
+
+// applyPoolConfig applies reloaded pool and mail settings.  It's called by the
+// pool sender between batches so settings never change in the middle of one.
+func applyPoolConfig(newCfg *config.Config) {
+	// remailer-* requests read the pool settings whilst holding ingestMu
+	ingestMu.Lock()
+	cfg.Pool = newCfg.Pool
+	cfg.Mail = newCfg.Mail
+	ingestMu.Unlock()
+	log.Infof("Reloaded pool and mail settings from %s", newCfg.Files.Config)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/config"
+	"github.com/crooks/yamn/keymgr"
+)
+
+func TestReloadConfig(t *testing.T) {
+	testPoolDirs(t)
+	dir := t.TempDir()
+	cfg.Pool.Size = 45
+	cfg.Mail.Workers = 4
+	cfg.Remailer.Name = "unchanged"
+	for _, name := range []string{"pubring.mix", "mlist2.txt", "secring.mix"} {
+		err := os.WriteFile(path.Join(dir, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	Pubring = keymgr.NewPubring(
+		path.Join(dir, "pubring.mix"),
+		path.Join(dir, "mlist2.txt"),
+	)
+	secret := keymgr.NewSecring(
+		path.Join(dir, "secring.mix"),
+		path.Join(dir, "key.txt"),
+	)
+	cfgFile := path.Join(dir, "yamn.yml")
+	yml := "pool:\n  size: 99\nmail:\n  workers: 7\nremailer:\n  name: changed\n"
+	err := os.WriteFile(cfgFile, []byte(yml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag = &config.Flags{Config: cfgFile, Dir: dir}
+
+	newCfg, err := reloadConfig(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Settings are applied by the pool sender
+	if cfg.Pool.Size != 45 {
+		t.Errorf("Pool size changed before being applied. Got=%d", cfg.Pool.Size)
+	}
+	applyPoolConfig(newCfg)
+	if cfg.Pool.Size != 99 {
+		t.Errorf("Pool size not reloaded. Expected=99, Got=%d", cfg.Pool.Size)
+	}
+	if cfg.Mail.Workers != 7 {
+		t.Errorf("Mail workers not reloaded. Expected=7, Got=%d", cfg.Mail.Workers)
+	}
+	// Remailer settings require a restart
+	if cfg.Remailer.Name != "unchanged" {
+		t.Errorf("Remailer name shouldn't reload. Got=%s", cfg.Remailer.Name)
+	}
+}
+
+func TestServerPoolOutboundSendStop(t *testing.T) {
+	testPoolDirs(t)
+	cfg.Pool.Type = "binomial"
+	cfg.Pool.Loop = 120
+	stop := make(chan struct{})
+	reload := make(chan *config.Config, 1)
+	done := make(chan struct{})
+	go func() {
+		serverPoolOutboundSend(stop, reload)
+		close(done)
+	}()
+	newCfg := new(config.Config)
+	newCfg.Pool = cfg.Pool
+	newCfg.Pool.Size = 99
+	reload <- newCfg
+	// The reload is applied whilst the sender waits for its next batch
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ingestMu.Lock()
+		size := cfg.Pool.Size
+		ingestMu.Unlock()
+		if size == 99 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Pool sender didn't apply the reloaded config")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pool sender didn't stop")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// maxRetryDelay caps the exponential backoff between delivery attempts
+const maxRetryDelay = 24 * time.Hour
+
+var (
+	errPoolExpired = errors.New("max pool age exceeded")
+	errPoolHeader  = errors.New("malformed internal header")
+)
+
+// poolHeader contains the Yamn internal headers of a pool file
+type poolHeader struct {
+	pooled   time.Time // When the message entered the pool
+	release  time.Time // Sender-chosen release time (zero if not held)
+	attempts int       // Number of failed delivery attempts
+	next     time.Time // Earliest time for the next delivery attempt
+	lastErr  string    // Error returned by the last delivery attempt
+}
+
+// newPoolHeader returns the internal headers for a newly pooled message
+func newPoolHeader(release time.Time) poolHeader {
+	return poolHeader{pooled: time.Now(), release: release}
+}
+
+// parsePoolHeader extracts the Yamn internal headers from a pool file's mail
+// headers.  Missing headers leave the corresponding fields unset.
+func parsePoolHeader(head mail.Header) (h poolHeader, err error) {
+	if pooled := head.Get("Yamn-Pooled-Date"); pooled != "" {
+		h.pooled, err = time.Parse(shortdate, pooled)
+		if err != nil {
+			err = fmt.Errorf("%w: Yamn-Pooled-Date: %s", errPoolHeader, err)
+			return
+		}
+	}
+	if release := head.Get("Yamn-Release-Date"); release != "" {
+		h.release, err = time.Parse(time.RFC3339, release)
+		if err != nil {
+			err = fmt.Errorf("%w: Yamn-Release-Date: %s", errPoolHeader, err)
+			return
+		}
+	}
+	if attempts := head.Get("Yamn-Attempts"); attempts != "" {
+		h.attempts, err = strconv.Atoi(attempts)
+		if err != nil {
+			err = fmt.Errorf("%w: Yamn-Attempts: %s", errPoolHeader, err)
+			return
+		}
+	}
+	if next := head.Get("Yamn-Next-Attempt"); next != "" {
+		h.next, err = time.Parse(time.RFC3339, next)
+		if err != nil {
+			err = fmt.Errorf("%w: Yamn-Next-Attempt: %s", errPoolHeader, err)
+			return
+		}
+	}
+	h.lastErr = head.Get("Yamn-Last-Error")
+	return
+}
+
+// splitPoolHeader separates the leading Yamn internal headers from the rest of
+// a pool file that isn't a complete mail message, such as a partial chunk.
+func splitPoolHeader(b []byte) (h poolHeader, content []byte, err error) {
+	head := make(mail.Header)
+	content = b
+	for bytes.HasPrefix(content, []byte("Yamn-")) {
+		line := content
+		content = nil
+		if n := bytes.IndexByte(line, '\n'); n >= 0 {
+			line, content = line[:n], line[n+1:]
+		}
+		fields := strings.SplitN(string(line), ":", 2)
+		if len(fields) != 2 {
+			err = fmt.Errorf("%w: %s", errPoolHeader, line)
+			return
+		}
+		head[fields[0]] = []string{strings.TrimSpace(fields[1])}
+	}
+	h, err = parsePoolHeader(head)
+	return
+}
+
+// deleteInternalHeaders removes all the Yamn internal headers from a message
+func deleteInternalHeaders(head mail.Header) {
+	for h := range head {
+		if strings.HasPrefix(h, "Yamn-") {
+			delete(head, h)
+		}
+	}
+}
+
+// readPoolFile reads a pool file and returns the message along with its
+// parsed internal headers.  The file is read into memory so that it can be
+// safely rewritten.
+func readPoolFile(filename string) (msg *mail.Message, h poolHeader, err error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	msg, err = mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	h, err = parsePoolHeader(msg.Header)
+	return
+}
+
+// writePoolFile writes a message, with new internal headers, to filename.  The
+// message is written to a temporary file and renamed so that a partially
+// written file is never seen by the pool.
+func writePoolFile(filename string, msg *mail.Message, h poolHeader) (err error) {
+	f, err := os.CreateTemp(path.Dir(filename), "tmp")
+	if err != nil {
+		return
+	}
+	deleteInternalHeaders(msg.Header)
+	err = writeInternalHeader(f, h)
+	if err == nil {
+		_, err = f.Write(assemble(*msg))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	err = os.Rename(f.Name(), filename)
+	return
+}
+
+// retryDelay returns the delay before the next delivery attempt.  The delay
+// doubles with each failed attempt, up to maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(cfg.Pool.RetryDelay) * time.Minute
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
+
+// poolRetry records a failed delivery attempt in the internal headers of a
+// pool file and schedules the next attempt.  Messages that have exhausted
+// their attempts, or exceeded the maximum pool age, are moved to the dead
+// letter directory.  So are messages with unparseable internal headers as
+// they'd otherwise be retried forever.
+func poolRetry(filename string, sendErr error) (err error) {
+	fqfn := path.Join(cfg.Files.Pooldir, filename)
+	msg, h, err := readPoolFile(fqfn)
+	if errors.Is(err, errPoolHeader) {
+		err = os.MkdirAll(cfg.Files.Deaddir, 0700)
+		if err != nil {
+			return
+		}
+		err = os.Rename(fqfn, path.Join(cfg.Files.Deaddir, filename))
+		if err != nil {
+			return
+		}
+		log.Warnf("%s: Moved to dead letters: %s", filename, sendErr)
+		return
+	} else if err != nil {
+		return
+	}
+	if h.pooled.IsZero() {
+		// Legacy files have no Yamn-Pooled-Date header.  The file's
+		// modification time is the best estimate of its age.
+		var fi os.FileInfo
+		fi, err = os.Stat(fqfn)
+		if err != nil {
+			return
+		}
+		h.pooled = fi.ModTime()
+	}
+	expired := errors.Is(sendErr, errPoolExpired)
+	if expired && h.lastErr != "" {
+		// Keep the last delivery error.  It's more useful than knowing
+		// the message expired.
+		h.lastErr = fmt.Sprintf("%s (%s)", h.lastErr, sendErr)
+	} else {
+		h.lastErr = sendErr.Error()
+	}
+	if !expired {
+		// Expiry isn't a delivery attempt
+		h.attempts++
+	}
+	if h.attempts >= cfg.Pool.MaxAttempts || expired {
+		h.next = time.Time{}
+		err = os.MkdirAll(cfg.Files.Deaddir, 0700)
+		if err != nil {
+			return
+		}
+		err = writePoolFile(path.Join(cfg.Files.Deaddir, filename), msg, h)
+		if err != nil {
+			return
+		}
+		log.Warnf(
+			"%s: Moved to dead letters after %d attempts",
+			filename,
+			h.attempts,
+		)
+		poolDelete(filename)
+		return
+	}
+	h.next = time.Now().Add(retryDelay(h.attempts))
+	err = writePoolFile(fqfn, msg, h)
+	if err != nil {
+		return
+	}
+	log.Infof(
+		"%s: Delivery attempt %d failed.  Next attempt at %s",
+		filename,
+		h.attempts,
+		h.next.Format(time.RFC3339),
+	)
+	return
+}
+
+// listDeadLetters prints a summary of each message in the dead letter
+// directory.
+func listDeadLetters() (err error) {
+	filenames, err := readDir(cfg.Files.Deaddir, "m")
+	if err != nil {
+		return
+	}
+	for _, filename := range filenames {
+		msg, h, err := readPoolFile(path.Join(cfg.Files.Deaddir, filename))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			continue
+		}
+		fmt.Printf(
+			"%s Pooled=%s Attempts=%d To=%s\n  %s\n",
+			filename,
+			h.pooled.Format("2006-01-02"),
+			h.attempts,
+			msg.Header.Get("To"),
+			h.lastErr,
+		)
+	}
+	return
+}
+
+// requeueDeadLetters returns a named message, or all messages if name is
+// "all", from the dead letter directory to the outbound pool.  Requeued
+// messages get a fresh set of delivery attempts.
+func requeueDeadLetters(name string) (err error) {
+	filenames := []string{name}
+	if name == "all" {
+		filenames, err = readDir(cfg.Files.Deaddir, "m")
+		if err != nil {
+			return
+		}
+	} else {
+		_, err = poolFileType(name)
+		if err != nil {
+			return
+		}
+	}
+	for _, filename := range filenames {
+		deadFile := path.Join(cfg.Files.Deaddir, filename)
+		var msg *mail.Message
+		var h poolHeader
+		msg, h, err = readPoolFile(deadFile)
+		if err != nil {
+			return
+		}
+		// Expired messages would immediately return to the dead letters
+		h.pooled = time.Now()
+		h.attempts = 0
+		h.next = time.Time{}
+		h.lastErr = ""
+		err = writePoolFile(randPoolFilename("m"), msg, h)
+		if err != nil {
+			return
+		}
+		err = os.Remove(deadFile)
+		if err != nil {
+			return
+		}
+		fmt.Printf("Requeued %s\n", filename)
+	}
+	return
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/config"
+)
+
+// testPoolDirs points the pool and dead letter directories at a temporary dir
+func testPoolDirs(t *testing.T) {
+	dir := t.TempDir()
+	cfg = new(config.Config)
+	cfg.Files.Pooldir = path.Join(dir, "pool")
+	cfg.Files.Deaddir = path.Join(dir, "dead")
+	cfg.Pool.MaxAttempts = 3
+	cfg.Pool.RetryDelay = 15
+	err := os.Mkdir(cfg.Files.Pooldir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPoolFile writes a pool file with the given internal headers
+func testPoolFile(t *testing.T, filename string, h poolHeader) {
+	buf := new(bytes.Buffer)
+	writeInternalHeader(buf, h)
+	buf.WriteString("To: foo@bar.baz\n\nBody\n")
+	err := os.WriteFile(filename, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadPoolFile(t *testing.T) {
+	testPoolDirs(t)
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name string
+		h    poolHeader
+	}{
+		{"mnew", poolHeader{}},
+		{"mheld", poolHeader{release: now.Add(time.Hour)}},
+		{"mretry", poolHeader{attempts: 2, next: now, lastErr: "550 No\n such user"}},
+	}
+	for _, test := range tests {
+		test.h.pooled = now.Truncate(24 * time.Hour)
+		filename := path.Join(cfg.Files.Pooldir, test.name)
+		testPoolFile(t, filename, test.h)
+		msg, h, err := readPoolFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if msg.Header.Get("To") != "foo@bar.baz" {
+			t.Errorf("%s: Mail headers not preserved", test.name)
+		}
+		if !h.release.Equal(test.h.release) || !h.next.Equal(test.h.next) {
+			t.Errorf("%s: Expected release/next of %s/%s, got %s/%s",
+				test.name, test.h.release, test.h.next, h.release, h.next)
+		}
+		if h.attempts != test.h.attempts {
+			t.Errorf("%s: Expected %d attempts, got %d", test.name, test.h.attempts, h.attempts)
+		}
+		if test.h.lastErr != "" && h.lastErr != "550 No such user" {
+			t.Errorf("%s: Unexpected last error: %q", test.name, h.lastErr)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Pool.RetryDelay = 15
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 15 * time.Minute},
+		{2, 30 * time.Minute},
+		{4, 2 * time.Hour},
+		{20, maxRetryDelay},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.attempts); got != test.delay {
+			t.Errorf("Attempts=%d: Expected %s, got %s", test.attempts, test.delay, got)
+		}
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	testPoolDirs(t)
+	filename := "mretry"
+	testPoolFile(t, path.Join(cfg.Files.Pooldir, filename), newPoolHeader(time.Time{}))
+	sendErr := errors.New("connection refused")
+	for attempt := 1; attempt < cfg.Pool.MaxAttempts; attempt++ {
+		err := poolRetry(filename, sendErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, h, err := readPoolFile(path.Join(cfg.Files.Pooldir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.attempts != attempt || !h.next.After(time.Now()) {
+			t.Errorf("Attempt %d: Got attempts=%d, next=%s", attempt, h.attempts, h.next)
+		}
+	}
+	// The final attempt moves the message to the dead letters
+	err := poolRetry(filename, sendErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(cfg.Files.Pooldir, filename)); err == nil {
+		t.Error("Dead letter remains in the pool")
+	}
+	_, h, err := readPoolFile(path.Join(cfg.Files.Deaddir, filename))
+	if err != nil {
+		t.Fatalf("Dead letter not found: %s", err)
+	}
+	if h.lastErr != sendErr.Error() {
+		t.Errorf("Expected last error of %q, got %q", sendErr, h.lastErr)
+	}
+	// Requeued messages return to the pool with a clean slate
+	err = poolCommand([]string{"requeue", "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := poolContents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 1 || !pool[0].next.IsZero() {
+		t.Errorf("Expected 1 due message in pool, got %v", pool)
+	}
+}
+
+func TestPoolRetryMalformed(t *testing.T) {
+	testPoolDirs(t)
+	filename := "mmalformed"
+	err := os.WriteFile(
+		path.Join(cfg.Files.Pooldir, filename),
+		[]byte("Yamn-Attempts: lots\nTo: foo@bar.baz\n\nBody\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = poolRetry(filename, errors.New("malformed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(cfg.Files.Pooldir, filename)); err == nil {
+		t.Error("Malformed message remains in the pool")
+	}
+	if _, err := os.Stat(path.Join(cfg.Files.Deaddir, filename)); err != nil {
+		t.Errorf("Malformed message not in dead letters: %s", err)
+	}
+}
+
+func TestPoolRetryLegacy(t *testing.T) {
+	testPoolDirs(t)
+	filename := "mlegacy"
+	fqfn := path.Join(cfg.Files.Pooldir, filename)
+	err := os.WriteFile(fqfn, []byte("To: foo@bar.baz\n\nBody\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(fqfn, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = poolRetry(filename, errors.New("connection refused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, h, err := readPoolFile(fqfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pooled date is taken from the mtime rather than being zero
+	if h.pooled.IsZero() || daysAgo(h.pooled) < 1 {
+		t.Errorf("Expected a pooled date in the past, got %s", h.pooled)
+	}
+}
+
+func TestRequeueDeadLettersName(t *testing.T) {
+	testPoolDirs(t)
+	// Names mustn't escape the dead letter directory
+	for _, name := range []string{"", "../pool/m1", "..", "xfoo"} {
+		if err := requeueDeadLetters(name); err == nil {
+			t.Errorf("%q: Expected an invalid filename error", name)
+		}
+	}
+}
+
+func TestPoolRetryExpired(t *testing.T) {
+	testPoolDirs(t)
+	filename := "mexpired"
+	h := newPoolHeader(time.Time{})
+	h.attempts = 1
+	h.lastErr = "550 No such user"
+	testPoolFile(t, path.Join(cfg.Files.Pooldir, filename), h)
+	err := poolRetry(filename, fmt.Errorf("%w: Too old", errPoolExpired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, h, err = readPoolFile(path.Join(cfg.Files.Deaddir, filename))
+	if err != nil {
+		t.Fatalf("Dead letter not found: %s", err)
+	}
+	// The last delivery error is kept alongside the expiry reason
+	if !strings.HasPrefix(h.lastErr, "550 No such user (") ||
+		!strings.Contains(h.lastErr, errPoolExpired.Error()) {
+		t.Errorf("Unexpected last error: %q", h.lastErr)
+	}
+	if h.attempts != 1 {
+		t.Errorf("Expiry shouldn't count as an attempt. Got %d", h.attempts)
+	}
+}
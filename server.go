@@ -5,20 +5,33 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/config"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/idlog"
 	"github.com/crooks/yamn/keymgr"
+	"github.com/crooks/yamn/packet"
 	"github.com/crooks/yamn/quickmail"
 	//"github.com/codahale/blake2"
 )
 
+// Reasons for rejecting an otherwise valid inbound packet
+var (
+	errReplay         = errors.New("packet ID collision")
+	errTooOld         = errors.New("max packet age exceeded")
+	errFutureStamp    = errors.New("packet timestamp is in the future")
+	errDeliveryMethod = errors.New("unsupported delivery method")
+	errRandhopChunks  = errors.New("randhop doesn't support multi-chunk messages")
+	errReplyBlock     = errors.New("invalid reply block")
+)
+
 // Start the server process.  If run with --daemon, this will loop forever.
 func loopServer() (err error) {
 	// Initialize the Public Keyring
@@ -29,16 +42,10 @@ func loopServer() (err error) {
 	// Fetch keyring and stats URLs
 	timedURLFetch(cfg.Urls.Pubring, cfg.Files.Pubring)
 	timedURLFetch(cfg.Urls.Mlist2, cfg.Files.Mlist2)
-	// Initialize the Secret Keyring
-	secret := keymgr.NewSecring(cfg.Files.Secring, cfg.Files.Pubkey)
 	Pubring.ImportPubring()
-	secret.ImportSecring()
-	// Tell the secret keyring some basic info about this remailer
-	secret.SetName(cfg.Remailer.Name)
-	secret.SetAddress(cfg.Remailer.Address)
-	secret.SetExit(cfg.Remailer.Exit)
-	secret.SetValidity(cfg.Remailer.Keylife, cfg.Remailer.Keygrace)
-	secret.SetVersion(version)
+	importFamilies()
+	// Initialize the Secret Keyring
+	secret := newSecring()
 	// Create some dirs if they don't already exist
 	createDirs()
 
@@ -50,6 +57,7 @@ func loopServer() (err error) {
 	// Open the chunk DB
 	log.Tracef("Opening the Chunk DB: %s", cfg.Files.ChunkDB)
 	ChunkDb = OpenChunk(cfg.Files.ChunkDB)
+	defer ChunkDb.Close()
 	ChunkDb.SetExpire(cfg.Remailer.ChunkExpire)
 
 	// Expire old entries in the ID Log
@@ -76,101 +84,236 @@ func loopServer() (err error) {
 
 	log.Infof("Secret keyring contains %d keys", secret.Count())
 
-	// Define triggers for timed events
-	daily := time.Now()
-	hourly := time.Now()
-	dayOfMonth := time.Now().Day()
-	oneDay := time.Duration(dayLength) * time.Second
-
 	// Determine if this is a single run or the start of a Daemon
 	runAsDaemon := cfg.Remailer.Daemon || flag.Daemon
-
-	// Actually start the server loop
-	if runAsDaemon {
-		log.Infof("Starting YAMN server: %s", cfg.Remailer.Name)
-		log.Infof("Detaching Pool processing")
-		go serverPoolOutboundSend()
-	} else {
+	if !runAsDaemon {
 		log.Infof("Performing routine remailer functions for: %s",
 			cfg.Remailer.Name)
+		processInbound(secret)
+		return
 	}
-	for {
-		// Panic if the pooldir doesn't exist
-		assertIsPath(cfg.Files.Pooldir)
-		// Process the inbound Pool
-		processInpool("i", secret)
-		// Process the Maildir
-		processMail(secret)
 
-		// Midnight events
-		if time.Now().Day() != dayOfMonth {
-			log.Info("Performing midnight events")
-			// Remove expired keys from memory and rewrite a
-			// secring file without expired keys.
-			if purgeSecring(secret) == 0 {
-				generateKeypair(secret)
-			}
-			// Expire entries in the ID Log
-			idLogExpire()
-			// Expire entries in the chunker
-			chunkClean()
-			// Report daily throughput and reset to zeros
-			stats.report()
-			stats.reset()
-			// Reset dayOfMonth to today
-			dayOfMonth = time.Now().Day()
+	// Actually start the server loop
+	log.Infof("Starting YAMN server: %s", cfg.Remailer.Name)
+	if cfg.Admin.Enabled {
+		var admin *httpService
+		admin, err = listenHTTP(
+			"Admin API",
+			cfg.Admin.Listen,
+			newAdminServer(secret).handler(),
+		)
+		if err != nil {
+			return
 		}
-		// Daily events
-		if time.Since(daily) > oneDay {
-			log.Info("Performing daily events")
-			// Complain about poor configs
-			nagOperator()
-			// Reset today so we don't do these tasks for the next
-			// 24 hours.
-			daily = time.Now()
+		defer admin.close()
+		go admin.serve()
+	}
+	if cfg.Metrics.Enabled {
+		var metrics *httpService
+		metrics, err = listenHTTP(
+			"Metrics exporter",
+			cfg.Metrics.Listen,
+			metricsHandler(secret),
+		)
+		if err != nil {
+			return
+		}
+		defer metrics.close()
+		go metrics.serve()
+	}
+	var smtpd *smtpServer
+	if cfg.SMTPD.Listen != "" {
+		smtpd, err = listenSMTP(secret)
+		if err != nil {
+			return
 		}
-		// Hourly events
-		if time.Since(hourly) > time.Hour {
-			log.Trace("Performing hourly events")
-			/*
-				The following two conditions try to import new
-				pubring and mlist2 URLs.  If they fail, a
-				warning is logged but no further action is
-				taken.  It's better to have old keys/stats than
-				none.
-			*/
-			// Retrieve Mlist2 and Pubring URLs
-			if cfg.Urls.Fetch {
-				timedURLFetch(
-					cfg.Urls.Pubring,
-					cfg.Files.Pubring,
-				)
-				timedURLFetch(
-					cfg.Urls.Mlist2,
-					cfg.Files.Mlist2,
-				)
+		go smtpd.serve()
+	}
+	log.Infof("Detaching Pool processing")
+	stopPool := make(chan struct{})
+	reloadPool := make(chan *config.Config, 1)
+	poolDone := make(chan struct{})
+	go func() {
+		serverPoolOutboundSend(stopPool, reloadPool)
+		close(poolDone)
+	}()
+	go housekeeping(secret)
+
+	// Process inbound messages as they arrive.  If filesystem
+	// notifications aren't available, fall back to polling.
+	var wake <-chan struct{}
+	poll := pollInterval
+	watcher, werr := watchInbound()
+	if werr != nil {
+		log.Warnf(
+			"Filesystem notifications unavailable. Polling every %s: %s",
+			pollInterval,
+			werr,
+		)
+	} else {
+		defer watcher.close()
+		wake = watcher.wake
+		poll = watchPollInterval
+	}
+	pollTicker := time.NewTicker(poll)
+	defer pollTicker.Stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	// Held inbound packets are processed when they're due
+	var releaseTimer *time.Timer
+	var release <-chan time.Time
+	for {
+		next := processInbound(secret)
+		if releaseTimer != nil {
+			releaseTimer.Stop()
+		}
+		release = nil
+		if !next.IsZero() {
+			releaseTimer = time.NewTimer(time.Until(next))
+			release = releaseTimer.C
+		}
+		select {
+		case <-wake:
+		case <-release:
+		case <-pollTicker.C:
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				log.Info("Received SIGHUP.  Reloading config.")
+				newCfg, err := reloadConfig(secret)
+				if err != nil {
+					log.Warnf("Config reload failed: %s", err)
+				}
+				if newCfg != nil {
+					// Replace any reload the pool sender hasn't
+					// applied yet
+					select {
+					case <-reloadPool:
+					default:
+					}
+					reloadPool <- newCfg
+				}
+				continue
 			}
-			// Test to see if the pubring.mix file has been updated
-			if Pubring.KeyRefresh() {
-				log.Tracef(
-					"Reimporting Public Keyring: %s",
-					cfg.Files.Pubring,
-				)
-				Pubring.ImportPubring()
+			log.Infof("Received %s.  Shutting down.", sig)
+			if smtpd != nil {
+				smtpd.close()
 			}
-			// Report throughput
-			stats.report()
-			hourly = time.Now()
+			// Let the current batch finish sending
+			close(stopPool)
+			<-poolDone
+			// Wait for messages being processed by the SMTP listener
+			// or housekeeping.  The lock is never released so the
+			// DBs can't be used after they're closed.
+			ingestMu.Lock()
+			return
 		}
+	} // End of server loop
+}
 
-		// Break out of the loop if we're not running as a daemon
-		if !runAsDaemon {
-			break
+// processInbound processes the inbound pool and the Maildir.  It returns the
+// time at which the next held inbound packet is due, if there is one.
+func processInbound(secret *keymgr.Secring) (next time.Time) {
+	// Panic if the pooldir doesn't exist
+	assertIsPath(cfg.Files.Pooldir)
+	// Process the inbound Pool
+	next = processInpool("i", secret)
+	// Process the Maildir
+	processMail(secret)
+	return
+}
+
+// housekeeping performs timed events.  Each has its own ticker so they don't
+// depend on the timing of inbound processing.
+func housekeeping(secret *keymgr.Secring) {
+	hourly := time.NewTicker(time.Hour)
+	daily := time.NewTicker(time.Duration(dayLength) * time.Second)
+	midnight := time.NewTimer(untilMidnight(time.Now()))
+	for {
+		select {
+		case <-midnight.C:
+			midnightEvents(secret)
+			midnight.Reset(untilMidnight(time.Now()))
+		case <-daily.C:
+			log.Info("Performing daily events")
+			// Complain about poor configs
+			nagOperator()
+		case <-hourly.C:
+			hourlyEvents()
 		}
+	}
+}
 
-		// And rest a while
-		time.Sleep(60 * time.Second)
-	} // End of server loop
+// untilMidnight returns the duration from now until the next local midnight
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// midnightEvents expires keys, IDs and chunks and reports daily throughput.
+// Inbound processing is suspended whilst they run.
+func midnightEvents(secret *keymgr.Secring) {
+	log.Info("Performing midnight events")
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	// Remove expired keys from memory and rewrite a secring file without
+	// expired keys.
+	if purgeSecring(secret) == 0 {
+		generateKeypair(secret)
+	}
+	// Expire entries in the ID Log
+	idLogExpire()
+	// Expire entries in the chunker
+	chunkClean()
+	// Report daily throughput and reset to zeros
+	stats.report()
+	stats.reset()
+}
+
+// hourlyEvents refreshes the public keyring and stats and reports throughput
+func hourlyEvents() {
+	log.Trace("Performing hourly events")
+	/*
+		The following two conditions try to import new pubring and mlist2
+		URLs.  If they fail, a warning is logged but no further action is
+		taken.  It's better to have old keys/stats than none.
+	*/
+	// Retrieve Mlist2 and Pubring URLs
+	if cfg.Urls.Fetch {
+		timedURLFetch(
+			cfg.Urls.Pubring,
+			cfg.Files.Pubring,
+		)
+		timedURLFetch(
+			cfg.Urls.Mlist2,
+			cfg.Files.Mlist2,
+		)
+	}
+	// The keyring mustn't change whilst inbound messages are using it
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	// Test to see if the pubring.mix file has been updated
+	if Pubring.KeyRefresh() {
+		log.Tracef(
+			"Reimporting Public Keyring: %s",
+			cfg.Files.Pubring,
+		)
+		Pubring.ImportPubring()
+	}
+	// Report throughput
+	stats.report()
+}
+
+// newSecring imports the Secret Keyring and tells it some basic info about
+// this remailer.
+func newSecring() (secret *keymgr.Secring) {
+	secret = keymgr.NewSecring(cfg.Files.Secring, cfg.Files.Pubkey)
+	secret.ImportSecring()
+	secret.SetName(cfg.Remailer.Name)
+	secret.SetAddress(cfg.Remailer.Address)
+	secret.SetExit(cfg.Remailer.Exit)
+	secret.SetValidity(cfg.Remailer.Keylife, cfg.Remailer.Keygrace)
+	secret.SetVersion(version)
+	secret.SetPacketVersions(packet.Versions)
 	return
 }
 
@@ -206,7 +349,7 @@ func purgeSecring(secret *keymgr.Secring) (active int) {
 // generateKeypair creates a new keypair and publishes it
 func generateKeypair(secret *keymgr.Secring) {
 	log.Info("Generating and advertising a new key pair")
-	pub, sec := eccGenerate()
+	pub, sec := packet.GenerateKey()
 	keyidstr := secret.Insert(pub, sec)
 	log.Infof("Generated new keypair with keyid: %s", keyidstr)
 	log.Info("Writing new Public Key to disc")
@@ -331,91 +474,68 @@ func createDirs() {
 // decodeMsg is the actual YAMN message decoder.  It's output is always a
 // pooled file, either in the Inbound or Outbound queue.
 func decodeMsg(rawMsg []byte, secret *keymgr.Secring) (err error) {
-
-	// At this point, rawMsg should always be messageBytes in length
-	err = lenCheck(len(rawMsg), messageBytes)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-
-	d := newDecMessage(rawMsg)
-	// Extract the top header
-	header := newDecodeHeader(d.getHeader())
-	recipientKeyID := header.getRecipientKeyID()
-	recipientSK, err := secret.GetSK(recipientKeyID)
+	hop, err := packet.NewDecoder(secret).Decode(rawMsg)
 	if err != nil {
-		log.Warnf("Failed to ascertain Recipient SK: %s", err)
+		err = fmt.Errorf("packet decode failed: %w", err)
 		return
 	}
-	header.setRecipientSK(recipientSK)
-
-	slotDataBytes, packetVersion, err := header.decode()
-	if err != nil {
-		log.Warnf("Header decode failed: %s", err)
-		return
-	}
-	switch packetVersion {
-	case 2:
-		err = decodeV2(d, slotDataBytes)
+	switch packetVersion := hop.Version(); packetVersion {
+	case 2, 3, 4:
+		// The packet library authenticates the v3 Exit body and decodes
+		// v4 hop delays so, from here on, all versions are processed
+		// identically.
+		err = decodeV2(hop)
 	default:
-		err = fmt.Errorf("cannot decode packet version %d", packetVersion)
+		err = fmt.Errorf("%w: %d", packet.ErrBadVersion, packetVersion)
 	}
 	return
 }
 
-func decodeV2(d *decMessage, slotDataBytes []byte) (err error) {
-	// Convert the raw Slot Data Bytes to meaningful slotData.
-	slotData := decodeSlotData(slotDataBytes)
+func decodeV2(hop packet.Hop) (err error) {
 	// Test uniqueness of packet ID
-	if !IDDb.Unique(slotData.getPacketID()) {
-		err = errors.New("packet ID collision")
-		return
-	}
-	if !d.testAntiTag(slotData.getTagHash()) {
-		log.Warn("Anti-tag digest mismatch")
+	if !IDDb.Unique(hop.PacketID()) {
+		err = errReplay
 		return
 	}
-	if slotData.ageTimestamp() > cfg.Remailer.MaxAge {
-		log.Warnf(
-			"Max packet age in days exceeded. Age=%d, Max=%d",
-			slotData.ageTimestamp(),
+	if hop.Age() > cfg.Remailer.MaxAge {
+		err = fmt.Errorf(
+			"%w: Age=%d, Max=%d",
+			errTooOld,
+			hop.Age(),
 			cfg.Remailer.MaxAge,
 		)
 		return
 	}
-	if slotData.ageTimestamp() < 0 {
-		log.Warn("Packet timestamp is in the future. Rejecting")
+	if hop.Age() < 0 {
+		err = fmt.Errorf("%w: Age=%d", errFutureStamp, hop.Age())
 		return
 	}
-	if slotData.getPacketType() == 0 {
-		d.shiftHeaders()
-		// Decode Intermediate
-		inter := decodeIntermediate(slotData.packetInfo)
-		d.decryptAll(slotData.aesKey, inter.aesIV12)
+	// Sender-chosen delays (v4) hold the message in the pool until release
+	var release time.Time
+	if hop.Delay() > 0 {
+		release = time.Now().Add(hop.Delay())
+		log.Tracef("Holding message in pool until %s", release.Format(time.RFC3339))
+	}
+	switch h := hop.(type) {
+	case *packet.Intermediate:
 		/*
 			The following conditional tests if we are the next hop
 			in addition to being the current hop.  If we are, then
 			it's better to store the message in the inbound pool.
 			This prevents it being emailed back to us.
 		*/
-		if inter.getNextHop() == cfg.Remailer.Address {
+		if h.NextHop == cfg.Remailer.Address {
 			log.Info(
 				"Message loops back to us.",
 				"Storing in pool instead of sending it.")
-			outfileName := randPoolFilename("i")
-			err = ioutil.WriteFile(
-				outfileName,
-				d.getPayload(),
-				0600,
-			)
+			err = writeInboundToPool(h.Packet, release)
 			if err != nil {
 				log.Warnf("Failed to write to pool: %s", err)
 				return
 			}
 			stats.outLoop++
 		} else {
-			writeMessageToPool(inter.getNextHop(), d.getPayload())
+			holdMessageInPool(h.NextHop, h.Packet, release)
 			stats.outYamn++
 			// Decide if we want to inject a dummy
 			if !flag.NoDummy && crandom.Dice() < 55 {
@@ -423,89 +543,90 @@ func decodeV2(d *decMessage, slotDataBytes []byte) (err error) {
 				stats.outDummy++
 			}
 		} // End of local or remote delivery
-	} else if slotData.getPacketType() == 1 {
-		// Decode Exit
-		final := decodeFinal(slotData.packetInfo)
-		if final.getDeliveryMethod() == 255 {
+	case *packet.Exit:
+		final := h.Final
+		if final.DeliveryMethod() == packet.DeliverDummy {
 			log.Trace("Discarding dummy message")
 			stats.inDummy++
 			return
 		}
-		// Decrypt the payload body
-		// This could be done under Delivery Method 0 but, future
-		// delivery methods (other than dummies) will require a
-		// decrypted body.
-		plain := d.decryptBody(
-			slotData.getAesKey(),
-			final.getAesIV(),
-			final.getBodyBytes(),
-		)
 		// Test delivery methods
-		switch final.getDeliveryMethod() {
-		case 0:
+		switch final.DeliveryMethod() {
+		case packet.DeliverSMTP:
 			stats.inYamn++
 			if !cfg.Remailer.Exit {
-				if final.numChunks == 1 {
+				if final.NumChunks() == 1 {
 					// Need to randhop as we're not an exit
 					// remailer
-					randhop(plain)
+					randhop(h.Body, release)
 				} else {
-					log.Warn(
-						"Randhopping doesn't support " +
-							"multi-chunk messages. As " +
-							"per Mixmaster, this " +
-							"message will be dropped.",
+					// As per Mixmaster, this message will be
+					// dropped.
+					err = fmt.Errorf(
+						"%w: Chunks=%d",
+						errRandhopChunks,
+						final.NumChunks(),
 					)
 				}
 				return
 			}
-			smtpMethod(plain, final)
+			err = smtpMethod(h.Body, final, release)
+		case packet.DeliverReply:
+			stats.inYamn++
+			err = replyMethod(h.Body, final, release)
 		default:
-			log.Warnf(
-				"Unsupported Delivery Method: %d",
-				final.getDeliveryMethod(),
+			err = fmt.Errorf(
+				"%w: %d",
+				errDeliveryMethod,
+				final.DeliveryMethod(),
 			)
 			return
 		}
-	} else {
-		log.Warnf(
-			"Unknown Packet Type: %d",
-			slotData.getPacketType(),
-		)
-		return
 	}
 	return
 }
 
-// smtpMethod is concerned with final-hop processing.
-func smtpMethod(plain []byte, final *slotFinal) {
-	var err error
-	if final.getNumChunks() == 1 {
+// smtpMethod is concerned with final-hop processing.  Multi-chunk messages
+// are held until the latest of their chunks' release times.
+func smtpMethod(plain []byte, final *packet.Final, release time.Time) (err error) {
+	if final.NumChunks() == 1 {
 		// If this is a single chunk message, pool it and get out.
-		writePlainToPool(plain, "m")
+		writePlainToPool(plain, "m", release)
 		stats.outPlain++
 		return
 	}
-	// We're an exit and this is a multi-chunk message
-	chunkFilename := writePlainToPool(plain, "p")
+	// We're an exit and this is a multi-chunk message.  Fetch the chunks
+	// info from the DB for the given message ID.
+	chunks := ChunkDb.Get(final.MessageID(), final.NumChunks())
+	// This saves losts of -1's as slices start at 0 and chunks at 1
+	cslot := final.ChunkNum() - 1
+	// A previous chunk with the same Message ID may have claimed a
+	// different number of chunks.
+	if cslot >= len(chunks) {
+		err = fmt.Errorf(
+			"%w: Chunk %d exceeds %d known chunks in MsgID: %x",
+			packet.ErrBadChunk,
+			final.ChunkNum(),
+			len(chunks),
+			final.MessageID(),
+		)
+		return
+	}
+	chunkFilename := writePlainToPool(plain, "p", release)
 	log.Tracef(
 		"Pooled partial chunk. MsgID=%x, Num=%d, "+
 			"Parts=%d, Filename=%s",
-		final.getMessageID(),
-		final.getChunkNum(),
-		final.getNumChunks(),
+		final.MessageID(),
+		final.ChunkNum(),
+		final.NumChunks(),
 		chunkFilename,
 	)
-	// Fetch the chunks info from the DB for the given message ID
-	chunks := ChunkDb.Get(final.getMessageID(), final.getNumChunks())
-	// This saves losts of -1's as slices start at 0 and chunks at 1
-	cslot := final.getChunkNum() - 1
 	// Test that the slot for this chunk is empty
 	if chunks[cslot] != "" {
 		log.Warnf(
 			"Duplicate chunk %d in MsgID: %x",
-			final.chunkNum,
-			final.messageID,
+			final.ChunkNum(),
+			final.MessageID(),
 		)
 	}
 	// Insert the new chunk into the slice
@@ -529,39 +650,90 @@ func smtpMethod(plain []byte, final *slotFinal) {
 		}
 		// Now the message is assembled into the Pool, the DB record
 		// can be deleted
-		ChunkDb.Delete(final.getMessageID())
+		ChunkDb.Delete(final.MessageID())
 		stats.outPlain++
 	} else {
 		// Write the updated chunk status to
 		// the DB
-		ChunkDb.Insert(final.getMessageID(), chunks)
+		ChunkDb.Insert(final.MessageID(), chunks)
 	}
+	return
+}
+
+// replyMethod attaches a reply to the Reply Block that precedes it in the
+// payload and sends the resulting packet to the Reply Block's first hop.  It's
+// held in the pool until the release time.
+func replyMethod(plain []byte, final *packet.Final, release time.Time) (err error) {
+	if final.NumChunks() != 1 {
+		err = fmt.Errorf(
+			"%w: Chunks=%d",
+			errReplyBlock,
+			final.NumChunks(),
+		)
+		return
+	}
+	if len(plain) < packet.ReplyBlockBytes {
+		err = fmt.Errorf(
+			"%w: payload (%d) is shorter than a reply block (%d)",
+			errReplyBlock,
+			len(plain),
+			packet.ReplyBlockBytes,
+		)
+		return
+	}
+	block, err := packet.DecodeReplyBlock(plain[:packet.ReplyBlockBytes])
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errReplyBlock, err)
+		return
+	}
+	// Only forward replies to known remailers.  Without this, Reply Blocks
+	// could be used to send arbitrary content to any address.
+	_, err = Pubring.Get(block.FirstHop())
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errReplyBlock, err)
+		return
+	}
+	yamnMsg, err := block.Attach(plain[packet.ReplyBlockBytes:])
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errReplyBlock, err)
+		return
+	}
+	log.Tracef("Forwarding reply to %s", block.FirstHop())
+	holdMessageInPool(block.FirstHop(), yamnMsg, release)
+	stats.outReply++
+	return
 }
 
 // randhop is a simplified client function that does single-hop encodings
-func randhop(plainMsg []byte) {
+func randhop(plainMsg []byte, release time.Time) {
 	var err error
 	if len(plainMsg) == 0 {
 		log.Info("Zero-byte message during randhop, ignoring it.")
 		return
 	}
 	// Make a single hop chain with a random node
-	inChain := []string{"*"}
-	final := newSlotFinal()
+	final := packet.NewFinal()
 	var chain []string
-	chain, err = makeChain(inChain)
-	if err != nil {
-		log.Warn(err)
+	chain, err = makeChain(randomChain(1))
+	if errors.Is(err, errNoCandidates) || errors.Is(err, errNeedStats) {
+		log.Warnf("No Exit Remailer available for random hop: %s", err)
+		return
+	} else if err != nil {
+		log.Warnf("Random hop failed: %s", err)
 		return
 	}
-	sendTo := chain[0]
 	if len(chain) != 1 {
-		err = fmt.Errorf("randhop chain must be single hop.  Got=%d", len(chain))
-		panic(err)
+		log.Warnf("Randhop chain must be single hop.  Got=%d", len(chain))
+		return
 	}
+	sendTo := chain[0]
 	log.Tracef("Performing a random hop to Exit Remailer: %s.", chain[0])
-	yamnMsg := encodeMsg(plainMsg, chain, *final)
-	writeMessageToPool(sendTo, yamnMsg)
+	yamnMsg, err := encodeMsg(plainMsg, chain, final)
+	if err != nil {
+		log.Warnf("Random hop encoding failed: %s", err)
+		return
+	}
+	holdMessageInPool(sendTo, yamnMsg, release)
 	stats.outRandhop++
 }
 
@@ -593,9 +765,8 @@ func remailerFoo(subject, sender string) (err error) {
 		if !cfg.Remailer.Exit {
 			m.Text(" middle")
 		}
-		packetVersions := []string{"v2"}
-		for _, v := range packetVersions {
-			m.Text(fmt.Sprintf(" %s", v))
+		for _, v := range packet.Versions {
+			m.Text(fmt.Sprintf(" v%d", v))
 		}
 		m.Text("\";\n")
 		m.Text("\nSUPPORTED MIXMASTER (TYPE II) REMAILERS")
@@ -635,10 +806,8 @@ func remailerFoo(subject, sender string) (err error) {
 		log.Infof("Unable to send %s", subject)
 		return
 	}
-	err = mailBytes(msg, []string{sender})
-	if err != nil {
-		log.Warnf("Failed to send %s to %s", subject, sender)
-		return
-	}
+	// The reply is sent from the pool.  Mailing it here would block
+	// inbound processing, which holds ingestMu, until the MTA responds.
+	writePlainToPool(msg, "m", time.Time{})
 	return
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// smtpSessions caches open SMTP sessions so multiple pool messages can be
+// sent to the same relay or MX in a single connection.
+var smtpSessions = newSMTPCache()
+
+// smtpSession is an established (and, where configured, encrypted and
+// authenticated) connection to a remote MTA.
+type smtpSession struct {
+	client *smtp.Client
+	conn   net.Conn
+	addr   string // host:port of the remote MTA
+	sent   int    // Messages sent during the session
+}
+
+// deadline allows the remote MTA smtpTimeout to respond to the commands that
+// follow.  A hung MTA would otherwise block delivery indefinitely.
+func (s *smtpSession) deadline() {
+	s.conn.SetDeadline(time.Now().Add(smtpTimeout))
+}
+
+// dialSMTP connects to a remote MTA and negotiates STARTTLS and AUTH.  With
+// implicitTLS, the session is encrypted from the outset (SMTPS) instead of
+// using STARTTLS.  With startTLS, the session is upgraded whenever the MTA
+// offers STARTTLS, even under the opportunistic TLS policy.
+func dialSMTP(relay, serverAddr string, implicitTLS, startTLS bool) (s *smtpSession, err error) {
+	// MX hostnames are fully qualified but certificate names aren't
+	host := strings.TrimSuffix(relay, ".")
+	conf, err := tlsConfig(host)
+	if err != nil {
+		return
+	}
+	dialer, err := netDialer()
+	if err != nil {
+		return
+	}
+	conn, err := dialer.Dial("tcp", serverAddr)
+	if err != nil {
+		log.Warnf("Dial Error: Server=%s, Error=%s", serverAddr, err)
+		return
+	}
+	// The deadline covers the greeting, STARTTLS and AUTH
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if implicitTLS {
+		tlsConn := tls.Client(conn, conf)
+		if err = tlsConn.Handshake(); err != nil {
+			log.Warnf(
+				"TLS Handshake Error: Server=%s, Error=%s",
+				serverAddr,
+				err,
+			)
+			conn.Close()
+			err = fmt.Errorf("%w: %s", errTLSPolicy, err)
+			return
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, relay)
+	if err != nil {
+		log.Warnf(
+			"SMTP Connection Error: Server=%s, Error=%s",
+			serverAddr,
+			err,
+		)
+		conn.Close()
+		return
+	}
+	// Test if the remote MTA supports STARTTLS
+	if !implicitTLS {
+		ok, _ := client.Extension("STARTTLS")
+		var upgrade bool
+		upgrade, err = useStartTLS(host, ok, startTLS)
+		if err != nil {
+			log.Warnf("SMTP Error: Server=%s, Error=%s", serverAddr, err)
+			client.Close()
+			return
+		}
+		if upgrade {
+			if err = client.StartTLS(conf); err != nil {
+				log.Warnf(
+					"Error performing STARTTLS: Server=%s, Error=%s",
+					serverAddr,
+					err,
+				)
+				client.Close()
+				err = fmt.Errorf("%w: %s", errTLSPolicy, err)
+				return
+			}
+		}
+	}
+	// If AUTH is supported and a UserID and Password are configured, try to
+	// authenticate to the remote MTA.
+	ok, _ := client.Extension("AUTH")
+	if ok && cfg.Mail.Username != "" && cfg.Mail.Password != "" {
+		auth := smtp.PlainAuth(
+			"",
+			cfg.Mail.Username,
+			cfg.Mail.Password,
+			cfg.Mail.SMTPRelay,
+		)
+		if err = client.Auth(auth); err != nil {
+			log.Warnf("Auth Error:  Server=%s, Error=%s", serverAddr, err)
+			client.Close()
+			return
+		}
+	}
+	s = &smtpSession{client: client, conn: conn, addr: serverAddr}
+	return
+}
+
+// send transmits a single message during the session
+func (s *smtpSession) send(sender string, sendTo []string, payload []byte) (err error) {
+	s.deadline()
+	if err = s.client.Mail(sender); err != nil {
+		log.Warnf("SMTP Error: Server=%s, Error=%s", s.addr, err)
+		return
+	}
+
+	for _, addr := range sendTo {
+		if err = s.client.Rcpt(addr); err != nil {
+			log.Warnf("Error: %s\n", err)
+			return
+		}
+	}
+
+	w, err := s.client.Data()
+	if err != nil {
+		log.Warnf("Error: %s\n", err)
+		return
+	}
+
+	_, err = w.Write(payload)
+	if err != nil {
+		log.Warnf("Error: %s\n", err)
+		return
+
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Warnf("Error: %s\n", err)
+		return
+
+	}
+	s.sent++
+	return
+}
+
+// smtpCache holds idle SMTP sessions, keyed by the address of the remote
+// MTA.  A session is removed from the cache while it's in use so each
+// session is only ever used by one delivery worker.  Sessions are only cached
+// during a delivery batch; at other times they're closed after each message.
+type smtpCache struct {
+	mu    sync.Mutex
+	batch bool // A delivery batch is in progress
+	idle  map[string][]*smtpSession
+}
+
+func newSMTPCache() *smtpCache {
+	return &smtpCache{idle: make(map[string][]*smtpSession)}
+}
+
+// get returns an idle session to serverAddr, or nil if there isn't one.
+// Sessions closed by the remote MTA whilst idle are discarded.
+func (c *smtpCache) get(serverAddr string) (s *smtpSession) {
+	for {
+		c.mu.Lock()
+		sessions := c.idle[serverAddr]
+		if len(sessions) == 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		s = sessions[len(sessions)-1]
+		c.idle[serverAddr] = sessions[:len(sessions)-1]
+		c.mu.Unlock()
+		s.deadline()
+		if s.client.Noop() == nil {
+			log.Tracef("Reusing SMTP session to %s", serverAddr)
+			return
+		}
+		s.client.Close()
+	}
+}
+
+// put returns a session to the cache after a successful delivery.  Sessions
+// that have reached the configured message limit, or that are used outside a
+// delivery batch, are closed.
+func (c *smtpCache) put(s *smtpSession) {
+	s.deadline()
+	c.mu.Lock()
+	batch := c.batch
+	c.mu.Unlock()
+	if !batch || s.sent >= cfg.Mail.SessionMessages {
+		s.client.Quit()
+		return
+	}
+	// Reset the session state ready for the next message
+	if err := s.client.Reset(); err != nil {
+		s.client.Close()
+		return
+	}
+	c.mu.Lock()
+	if c.batch {
+		c.idle[s.addr] = append(c.idle[s.addr], s)
+		s = nil
+	}
+	c.mu.Unlock()
+	if s != nil {
+		// The batch ended whilst the session was being reset
+		s.client.Quit()
+	}
+}
+
+// startBatch allows sessions to be cached until closeAll is called
+func (c *smtpCache) startBatch() {
+	c.mu.Lock()
+	c.batch = true
+	c.mu.Unlock()
+}
+
+// closeAll ends every idle session and the delivery batch
+func (c *smtpCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batch = false
+	for addr, sessions := range c.idle {
+		for _, s := range sessions {
+			s.deadline()
+			s.client.Quit()
+		}
+		delete(c.idle, addr)
+	}
+}
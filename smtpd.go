@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/keymgr"
+)
+
+// ingestMu serializes the processing of inbound messages.  Messages can
+// arrive concurrently from the SMTP listener and the server loop.
+var ingestMu sync.Mutex
+
+// errNotYamn indicates an inbound message doesn't contain a YAMN packet
+var errNotYamn = errors.New("not a YAMN message")
+
+// smtpTimeout is the maximum time allowed for each SMTP command, both by the
+// listener and when relaying outbound mail.
+var smtpTimeout = 5 * time.Minute
+
+// smtpServer is a minimal SMTP receiver that only accepts mail for this
+// remailer.  It implements just enough of RFC 5321 to receive messages from
+// other MTAs.
+type smtpServer struct {
+	listener net.Listener
+	tls      *tls.Config // STARTTLS config (nil if not offered)
+	hostname string      // Name used in the greeting
+	address  string      // The only accepted recipient
+	maxSize  int64       // Maximum message size in bytes
+	deliver  func(msg *mail.Message) error
+}
+
+// listenSMTP returns an smtpServer listening on the configured address.
+// Received messages are passed to ingestMessage.
+func listenSMTP(secret *keymgr.Secring) (s *smtpServer, err error) {
+	s = &smtpServer{
+		hostname: cfg.Remailer.Name,
+		address:  cfg.Remailer.Address,
+		maxSize:  int64(cfg.SMTPD.MaxSize) * 1024,
+		deliver: func(msg *mail.Message) error {
+			return ingestMessage(msg, secret)
+		},
+	}
+	if parts := strings.SplitN(s.address, "@", 2); len(parts) == 2 {
+		s.hostname = parts[1]
+	}
+	if cfg.SMTPD.TLSCert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cfg.SMTPD.TLSCert, cfg.SMTPD.TLSKey)
+		if err != nil {
+			return
+		}
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	s.listener, err = net.Listen("tcp", cfg.SMTPD.Listen)
+	return
+}
+
+// serve accepts SMTP connections until the listener is closed
+func (s *smtpServer) serve() {
+	log.Infof("SMTP listener accepting mail on %s", s.listener.Addr())
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warnf("SMTP accept failed: %s", err)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// close stops the listener
+func (s *smtpServer) close() error {
+	return s.listener.Close()
+}
+
+// smtpConn holds the state of a single SMTP connection
+type smtpConn struct {
+	text  *textproto.Conn
+	isTLS bool
+	from  string
+	rcpt  bool
+}
+
+// reply sends an SMTP response
+func (c *smtpConn) reply(code int, msg string) {
+	c.text.PrintfLine("%d %s", code, msg)
+}
+
+// handle conducts an SMTP conversation
+func (s *smtpServer) handle(conn net.Conn) {
+	c := &smtpConn{text: textproto.NewConn(conn)}
+	defer c.text.Close()
+	c.reply(220, s.hostname+" ESMTP YAMN")
+	for {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			c.reply(250, s.hostname)
+		case "EHLO":
+			c.text.PrintfLine("250-%s", s.hostname)
+			if s.tls != nil && !c.isTLS {
+				c.text.PrintfLine("250-STARTTLS")
+			}
+			c.text.PrintfLine("250-8BITMIME")
+			c.text.PrintfLine("250 SIZE %d", s.maxSize)
+		case "STARTTLS":
+			if s.tls == nil || c.isTLS {
+				c.reply(502, "STARTTLS not available")
+				continue
+			}
+			c.reply(220, "Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				log.Infof("SMTP STARTTLS failed: %s", err)
+				return
+			}
+			conn = tlsConn
+			c.text = textproto.NewConn(tlsConn)
+			c.isTLS = true
+			c.from, c.rcpt = "", false
+		case "MAIL":
+			c.from, c.rcpt = "", false
+			if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+				c.reply(501, "Syntax: MAIL FROM:<address>")
+				continue
+			}
+			if size := mailSize(arg); size > s.maxSize {
+				c.reply(552, "Message exceeds maximum size")
+				continue
+			}
+			c.from = arg[5:]
+			c.reply(250, "OK")
+		case "RCPT":
+			if c.from == "" {
+				c.reply(503, "Need MAIL before RCPT")
+				continue
+			}
+			if !strings.HasPrefix(strings.ToUpper(arg), "TO:") ||
+				len(strings.Fields(arg[3:])) == 0 {
+				c.reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+			if !s.accepts(arg[3:]) {
+				c.reply(550, "No such user here")
+				continue
+			}
+			c.rcpt = true
+			c.reply(250, "OK")
+		case "DATA":
+			if !c.rcpt {
+				c.reply(503, "Need RCPT before DATA")
+				continue
+			}
+			c.reply(354, "End data with <CR><LF>.<CR><LF>")
+			code, msg := s.receive(c.text.DotReader())
+			c.reply(code, msg)
+			c.from, c.rcpt = "", false
+		case "RSET":
+			c.from, c.rcpt = "", false
+			c.reply(250, "OK")
+		case "NOOP":
+			c.reply(250, "OK")
+		case "VRFY":
+			c.reply(252, "Cannot VRFY user")
+		case "QUIT":
+			c.reply(221, "Bye")
+			return
+		default:
+			c.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// accepts tests if a RCPT TO address is for this remailer
+func (s *smtpServer) accepts(arg string) bool {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return false
+	}
+	addr, err := mail.ParseAddress(fields[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(addr.Address, s.address)
+}
+
+// mailSize returns the value of the SIZE parameter to MAIL FROM, or zero if
+// it's not specified.
+func mailSize(arg string) (size int64) {
+	for _, param := range strings.Fields(arg)[1:] {
+		if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			size, _ = strconv.ParseInt(param[5:], 10, 64)
+		}
+	}
+	return
+}
+
+// receive reads a message from the DATA stream and returns the SMTP response.
+// Oversized and non-YAMN messages are rejected.
+func (s *smtpServer) receive(r io.Reader) (code int, msg string) {
+	// Read one byte beyond the limit to detect oversized messages
+	data, err := ioutil.ReadAll(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return 451, "Error reading message"
+	}
+	if int64(len(data)) > s.maxSize {
+		// Discard the remainder of the message
+		io.Copy(ioutil.Discard, r)
+		return 552, "Message exceeds maximum size"
+	}
+	mailMsg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return 554, "Malformed message"
+	}
+	err = s.deliver(mailMsg)
+	if errors.Is(err, errNotYamn) {
+		log.Info(err)
+		return 554, "Not a YAMN message"
+	}
+	if err != nil {
+		// The message was accepted but couldn't be processed.  Telling
+		// the sender would reveal the nature of the failure.
+		log.Info(err)
+	}
+	return 250, fmt.Sprintf("OK: Received %d bytes", len(data))
+}
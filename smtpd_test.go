@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/crooks/yamn/config"
+)
+
+// testSMTPServer starts an SMTP listener on a random localhost port
+func testSMTPServer(t *testing.T, deliver func(*mail.Message) error) *smtpServer {
+	s := newTestSMTPServer(t, deliver)
+	go s.serve()
+	return s
+}
+
+// newTestSMTPServer returns an SMTP listener on a random localhost port that
+// isn't yet serving connections.
+func newTestSMTPServer(t *testing.T, deliver func(*mail.Message) error) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{
+		listener: l,
+		hostname: "domain.foo",
+		address:  "remailer@domain.foo",
+		maxSize:  1024,
+		deliver:  deliver,
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+// smtpCode returns the SMTP response code of an error from net/smtp
+func smtpCode(err error) int {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		return tpErr.Code
+	}
+	return 0
+}
+
+// testSend sends a message to the test server and returns the error
+func testSend(s *smtpServer, rcpt, msg string) error {
+	return smtp.SendMail(
+		s.listener.Addr().String(),
+		nil,
+		"sender@domain.bar",
+		[]string{rcpt},
+		[]byte(msg),
+	)
+}
+
+func TestSMTPServer(t *testing.T) {
+	var received []*mail.Message
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		received = append(received, msg)
+		return nil
+	})
+	msg := "Subject: remailer-key\r\n\r\nBody\r\n"
+	if err := testSend(s, "Remailer@domain.foo", msg); err != nil {
+		t.Fatalf("Message for remailer rejected: %s", err)
+	}
+	if len(received) != 1 || received[0].Header.Get("Subject") != "remailer-key" {
+		t.Fatalf("Expected 1 remailer-key message, got %d", len(received))
+	}
+	if err := testSend(s, "other@domain.foo", msg); smtpCode(err) != 550 {
+		t.Errorf("Expected 550 for other recipients, got %v", err)
+	}
+	big := "Subject: Big\r\n\r\n" + strings.Repeat("x", 2048) + "\r\n"
+	if err := testSend(s, "remailer@domain.foo", big); smtpCode(err) != 552 {
+		t.Errorf("Expected 552 for oversized message, got %v", err)
+	}
+	if len(received) != 1 {
+		t.Errorf("Rejected messages were delivered")
+	}
+}
+
+func TestSMTPServerRejectsNonYamn(t *testing.T) {
+	cfg = new(config.Config)
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		return ingestMessage(msg, nil)
+	})
+	err := testSend(s, "remailer@domain.foo", "Subject: Spam\r\n\r\nBuy now\r\n")
+	if smtpCode(err) != 554 {
+		t.Errorf("Expected 554 for non-YAMN message, got %v", err)
+	}
+}
+
+func TestSMTPServerStats(t *testing.T) {
+	cfg = new(config.Config)
+	stats = new(statistics)
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		return ingestMessage(msg, nil)
+	})
+	a := newAdminServer(nil)
+	const sends = 5
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testSend(s, "remailer@domain.foo", "Subject: Spam\r\n\r\nBuy now\r\n")
+		}()
+		// Read the counters whilst messages are being received
+		a.stats()
+	}
+	wg.Wait()
+	counters, _ := a.stats()
+	if got := counters.(map[string]int)["in_mail"]; got != sends {
+		t.Errorf("Expected %d emails received, got %d", sends, got)
+	}
+}
+
+func TestSMTPServerEmptyRcpt(t *testing.T) {
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		return nil
+	})
+	conn, err := textproto.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"HELO domain.bar", 250},
+		{"MAIL FROM:<sender@domain.bar>", 250},
+		{"RCPT TO:", 501},
+		{"RCPT TO:   ", 501},
+		// The connection must survive the bad commands
+		{"NOOP", 250},
+	} {
+		if err = conn.PrintfLine("%s", cmd.line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = conn.ReadResponse(cmd.code); err != nil {
+			t.Errorf("%s: %s", cmd.line, err)
+		}
+	}
+	if s.accepts("") {
+		t.Error("Empty recipient accepted")
+	}
+}
+
+func TestMailSize(t *testing.T) {
+	tests := []struct {
+		arg  string
+		size int64
+	}{
+		{"FROM:<a@b.c>", 0},
+		{"FROM:<a@b.c> SIZE=2048", 2048},
+		{"FROM:<a@b.c> BODY=8BITMIME size=10", 10},
+	}
+	for _, test := range tests {
+		if got := mailSize(test.arg); got != test.size {
+			t.Errorf("%s: Expected %d, got %d", test.arg, test.size, got)
+		}
+	}
+}
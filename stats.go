@@ -1,45 +1,152 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/packet"
 )
 
+// statistics counts the messages handled by the remailer.  The SMTP listener,
+// pool and HTTP handlers run concurrently so the counters must only be
+// accessed whilst holding ingestMu.
 type statistics struct {
-	inDummy    int
-	inMail     int
-	inRemFoo   int
-	inYamn     int
-	outDummy   int
-	outMail    int
-	outYamn    int
-	outLoop    int
-	outRandhop int
-	outPlain   int
+	inDummy      int
+	inMail       int
+	inRemFoo     int
+	inYamn       int
+	inDecodeFail int
+	outDummy     int
+	outMail      int
+	outYamn      int
+	outLoop      int
+	outRandhop   int
+	outPlain     int
+	outReply     int
+	// Inbound packets rejected, by reason
+	rejUnknownKey int
+	rejHeaderAuth int
+	rejReplay     int
+	rejAntiTag    int
+	rejBodyAuth   int
+	rejTooOld     int
+	rejFuture     int
+	rejDelivery   int
+	rejRandhop    int
+	rejReply      int
+	// Counts prior to the last reset, for cumulative totals
+	previous map[string]int
 }
 
 func (s *statistics) reset() {
+	if s.previous == nil {
+		s.previous = make(map[string]int)
+	}
+	for name, count := range s.counters() {
+		s.previous[name] += count
+	}
 	s.inDummy = 0
 	s.inMail = 0
 	s.inYamn = 0
 	s.inRemFoo = 0
+	s.inDecodeFail = 0
 	s.outDummy = 0
 	s.outMail = 0
 	s.outYamn = 0
 	s.outLoop = 0
 	s.outRandhop = 0
 	s.outPlain = 0
+	s.outReply = 0
+	s.rejUnknownKey = 0
+	s.rejHeaderAuth = 0
+	s.rejReplay = 0
+	s.rejAntiTag = 0
+	s.rejBodyAuth = 0
+	s.rejTooOld = 0
+	s.rejFuture = 0
+	s.rejDelivery = 0
+	s.rejRandhop = 0
+	s.rejReply = 0
 	log.Info("Daily stats reset")
 }
 
+// reject increments the counter corresponding to the reason an inbound
+// packet was rejected.  Errors that don't match a known rejection reason are
+// counted as decode failures.
+func (s *statistics) reject(err error) {
+	switch {
+	case errors.Is(err, packet.ErrUnknownKeyID):
+		s.rejUnknownKey++
+	case errors.Is(err, packet.ErrHeaderAuth):
+		s.rejHeaderAuth++
+	case errors.Is(err, errReplay):
+		s.rejReplay++
+	case errors.Is(err, packet.ErrAntiTag):
+		s.rejAntiTag++
+	case errors.Is(err, packet.ErrBodyAuth):
+		s.rejBodyAuth++
+	case errors.Is(err, errTooOld):
+		s.rejTooOld++
+	case errors.Is(err, errFutureStamp):
+		s.rejFuture++
+	case errors.Is(err, errDeliveryMethod):
+		s.rejDelivery++
+	case errors.Is(err, errRandhopChunks):
+		s.rejRandhop++
+	case errors.Is(err, errReplyBlock):
+		s.rejReply++
+	default:
+		s.inDecodeFail++
+	}
+}
+
+// counters returns the statistics keyed by name
+func (s *statistics) counters() map[string]int {
+	return map[string]int{
+		"in_dummy":           s.inDummy,
+		"in_mail":            s.inMail,
+		"in_remfoo":          s.inRemFoo,
+		"in_yamn":            s.inYamn,
+		"in_decode_fail":     s.inDecodeFail,
+		"out_dummy":          s.outDummy,
+		"out_mail":           s.outMail,
+		"out_yamn":           s.outYamn,
+		"out_loop":           s.outLoop,
+		"out_randhop":        s.outRandhop,
+		"out_plain":          s.outPlain,
+		"out_reply":          s.outReply,
+		"rej_unknown_key":    s.rejUnknownKey,
+		"rej_header_auth":    s.rejHeaderAuth,
+		"rej_replay":         s.rejReplay,
+		"rej_anti_tag":       s.rejAntiTag,
+		"rej_body_auth":      s.rejBodyAuth,
+		"rej_too_old":        s.rejTooOld,
+		"rej_future":         s.rejFuture,
+		"rej_delivery":       s.rejDelivery,
+		"rej_randhop_chunks": s.rejRandhop,
+		"rej_reply_block":    s.rejReply,
+	}
+}
+
+// totals returns the statistics accumulated since the remailer started.
+// Unlike counters, they're unaffected by the daily reset.
+func (s *statistics) totals() map[string]int {
+	t := s.counters()
+	for name, count := range s.previous {
+		t[name] += count
+	}
+	return t
+}
+
 func (s *statistics) report() {
 	log.Infof(
-		"MailIn=%d, RemFoo=%d, YamnIn=%d, DummyIn=%d",
+		"MailIn=%d, RemFoo=%d, YamnIn=%d, DummyIn=%d, DecodeFail=%d",
 		s.inMail,
 		s.inRemFoo,
 		s.inYamn,
 		s.inDummy,
+		s.inDecodeFail,
 	)
 	line1 := fmt.Sprintf(
 		"MailOut=%d, YamnOut=%d, YamnLoop=%d, Randhop=%d, ",
@@ -49,9 +156,27 @@ func (s *statistics) report() {
 		s.outRandhop,
 	)
 	line2 := fmt.Sprintf(
-		"FinalOut=%d, DummyOut=%d",
+		"FinalOut=%d, DummyOut=%d, ReplyOut=%d",
 		s.outPlain,
 		s.outDummy,
+		s.outReply,
+	)
+	log.Infof(line1 + line2)
+	line1 = fmt.Sprintf(
+		"Rejected: UnknownKey=%d, HeaderAuth=%d, Replay=%d, AntiTag=%d, BodyAuth=%d, ",
+		s.rejUnknownKey,
+		s.rejHeaderAuth,
+		s.rejReplay,
+		s.rejAntiTag,
+		s.rejBodyAuth,
+	)
+	line2 = fmt.Sprintf(
+		"TooOld=%d, Future=%d, Delivery=%d, RandhopChunks=%d, ReplyBlock=%d",
+		s.rejTooOld,
+		s.rejFuture,
+		s.rejDelivery,
+		s.rejRandhop,
+		s.rejReply,
 	)
 	log.Infof(line1 + line2)
 }
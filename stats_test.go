@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/crooks/yamn/packet"
+)
+
+func TestStatsReject(t *testing.T) {
+	s := new(statistics)
+	s.reject(fmt.Errorf("packet decode failed: %w", packet.ErrAntiTag))
+	s.reject(fmt.Errorf("%w: Age=20, Max=14", errTooOld))
+	s.reject(errReplay)
+	s.reject(fmt.Errorf("%w: 9", packet.ErrBadVersion))
+	if s.rejAntiTag != 1 {
+		t.Errorf("Expected 1 anti-tag rejection, got %d", s.rejAntiTag)
+	}
+	if s.rejTooOld != 1 {
+		t.Errorf("Expected 1 too old rejection, got %d", s.rejTooOld)
+	}
+	if s.rejReplay != 1 {
+		t.Errorf("Expected 1 replay rejection, got %d", s.rejReplay)
+	}
+	if s.inDecodeFail != 1 {
+		t.Errorf("Expected 1 decode failure, got %d", s.inDecodeFail)
+	}
+	s.reset()
+	if s.rejAntiTag != 0 || s.inDecodeFail != 0 {
+		t.Error("Reset failed to zero rejection counters")
+	}
+}
+
+func TestStatsTotals(t *testing.T) {
+	s := new(statistics)
+	s.outMail = 4
+	s.reject(errors.New("unknown failure"))
+	s.reset()
+	s.outMail = 1
+	totals := s.totals()
+	if totals["out_mail"] != 5 {
+		t.Errorf("Expected 5 emails sent, got %d", totals["out_mail"])
+	}
+	if totals["in_decode_fail"] != 1 {
+		t.Errorf("Expected 1 decode failure, got %d", totals["in_decode_fail"])
+	}
+	if s.counters()["out_mail"] != 1 {
+		t.Errorf("Expected 1 email sent since reset, got %d", s.counters()["out_mail"])
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/yamn/packet"
+)
+
+const (
+	surbBegin = "-----BEGIN YAMN REPLY BLOCK-----"
+	surbEnd   = "-----END YAMN REPLY BLOCK-----"
+)
+
+// newSURB creates a Single-Use Reply Block that routes replies to the --to
+// address.  The Reply Block is written to stdout and the secret required to
+// read replies is retained in the SURB directory.
+func newSURB() {
+	if flag.To == "" {
+		fmt.Fprintln(os.Stderr, "A reply address must be specified with --to")
+		os.Exit(1)
+	}
+	err := os.MkdirAll(cfg.Files.SURBdir, 0700)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = clientPubring()
+	if err != nil {
+		log.Warnf("Pubring import failed: %s", cfg.Files.Pubring)
+		os.Exit(1)
+	}
+	spec, err := userChain()
+	if err != nil {
+		log.Errorf("Invalid chain: %s", err)
+		os.Exit(1)
+	}
+	chain, err := makeChain(spec)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("Reply chain: %s", strings.Join(chain, ","))
+	remailers, err := resolveChain(chain)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	block, secret, err := packet.NewReplyBlock(remailers, flag.To)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(surbSecretFile(secret.ID()), secret.Bytes(), 0600)
+	if err != nil {
+		log.Errorf("Unable to store reply secret: %s", err)
+		os.Exit(1)
+	}
+	armorSURB(os.Stdout, block)
+}
+
+// surbSecretFile returns the filename used to store the secret for a given
+// Reply ID.
+func surbSecretFile(id []byte) string {
+	return path.Join(cfg.Files.SURBdir, hex.EncodeToString(id))
+}
+
+// armorSURB writes a Reply Block as Base64 between cutmarks.
+func armorSURB(w io.Writer, block *packet.ReplyBlock) {
+	w.Write([]byte(surbBegin + "\n"))
+	wrap64(w, block.Bytes(), base64LineWrap)
+	w.Write([]byte("\n" + surbEnd + "\n"))
+}
+
+// stripSURBArmor reads an armored Reply Block.
+func stripSURBArmor(reader io.Reader) (block *packet.ReplyBlock, err error) {
+	scanner := bufio.NewScanner(reader)
+	b64 := new(bytes.Buffer)
+	var inBlock, gotEnd bool
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inBlock {
+			inBlock = line == surbBegin
+			continue
+		}
+		if line == surbEnd {
+			gotEnd = true
+			break
+		}
+		b64.WriteString(line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+	if !gotEnd {
+		err = errors.New("no reply block cutmarks found")
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(b64.String())
+	if err != nil {
+		return
+	}
+	block, err = packet.DecodeReplyBlock(b)
+	return
+}
+
+// replyPayload reads the Reply Block in filename and prefixes it to a reply.
+// The result is sent to an Exit remailer that attaches the reply to the Reply
+// Block.
+func replyPayload(filename string, reply []byte) (payload []byte, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	block, err := stripSURBArmor(f)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", filename, err)
+		return
+	}
+	// Replies can't be chunked as each Reply Block can only be used once.
+	maxReply := min(packet.MaxReplyBytes, maxFragLength-packet.ReplyBlockBytes)
+	if len(reply) > maxReply {
+		err = fmt.Errorf(
+			"reply (%d bytes) exceeds maximum reply size (%d bytes)",
+			len(reply),
+			maxReply,
+		)
+		return
+	}
+	payload = append(block.Bytes(), reply...)
+	return
+}
+
+// readReply reads a delivered reply from stdin and writes the decrypted
+// content to stdout.  The reply secret is deleted as Reply Blocks can only be
+// used once.
+func readReply() {
+	yamnMsg, err := stripArmor(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	id, err := packet.ReplyID(yamnMsg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	filename := surbSecretFile(id)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%x: No secret for this reply: %s\n", id, err)
+		os.Exit(1)
+	}
+	secret, err := packet.DecodeReplySecret(b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	reply, err := secret.Open(yamnMsg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(reply)
+	err = os.Remove(filename)
+	if err != nil {
+		log.Warnf("Unable to delete reply secret: %s", err)
+	}
+}
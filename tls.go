@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Masterminds/log-go"
+)
+
+// TLS policies for outbound SMTP.  Opportunistic encrypts whenever STARTTLS
+// is offered but doesn't verify certificates.  Verify also requires offered
+// certificates to validate.  Require refuses to send in plaintext.
+const (
+	tlsOpportunistic = "opportunistic"
+	tlsVerify        = "verify"
+	tlsRequire       = "require"
+)
+
+// errTLSPolicy indicates a delivery was refused because it would violate the
+// TLS policy.  Like other delivery failures, the message will be retried.
+var errTLSPolicy = errors.New("TLS policy violation")
+
+// tlsVersions maps the config representation of TLS versions to tls consts
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsRequired tests if the TLS policy, or pinned keys for host, prohibit
+// plaintext delivery.
+func tlsRequired(host string) bool {
+	return cfg.Mail.TLSPolicy == tlsRequire || len(cfg.Mail.TLSPins[host]) > 0
+}
+
+// useStartTLS decides if an SMTP session to host should be upgraded with
+// STARTTLS.  Under the opportunistic policy, the session is only upgraded if
+// the caller wants it.  The verify and require policies always upgrade when
+// STARTTLS is offered.  If it isn't offered, require refuses to send and
+// other policies warn that the message will be sent in plaintext.
+func useStartTLS(host string, offered, wanted bool) (upgrade bool, err error) {
+	switch {
+	case offered:
+		upgrade = wanted || cfg.Mail.TLSPolicy != tlsOpportunistic || tlsRequired(host)
+	case tlsRequired(host):
+		err = fmt.Errorf("%w: %s doesn't offer STARTTLS", errTLSPolicy, host)
+	case wanted || cfg.Mail.TLSPolicy == tlsVerify:
+		log.Warnf(
+			"%s doesn't offer STARTTLS. Sending in plaintext despite "+
+				"the %s TLS policy.",
+			host,
+			cfg.Mail.TLSPolicy,
+		)
+	}
+	return
+}
+
+// tlsConfig returns a TLS config for connecting to host that implements the
+// configured TLS policy.
+func tlsConfig(host string) (conf *tls.Config, err error) {
+	conf = &tls.Config{ServerName: host}
+	var known bool
+	conf.MinVersion, known = tlsVersions[cfg.Mail.TLSMinVersion]
+	if !known {
+		err = fmt.Errorf("%s: Unknown TLS version", cfg.Mail.TLSMinVersion)
+		return
+	}
+	switch cfg.Mail.TLSPolicy {
+	case tlsOpportunistic:
+		conf.InsecureSkipVerify = true
+	case tlsVerify, tlsRequire:
+		if cfg.Mail.TLSCAFile != "" {
+			var pem []byte
+			pem, err = ioutil.ReadFile(cfg.Mail.TLSCAFile)
+			if err != nil {
+				return
+			}
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM(pem) {
+				err = fmt.Errorf("%s: No certificates found", cfg.Mail.TLSCAFile)
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("%s: Unknown TLS policy", cfg.Mail.TLSPolicy)
+		return
+	}
+	// Pinned keys are checked regardless of policy
+	if pins := cfg.Mail.TLSPins[host]; len(pins) > 0 {
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs.PeerCertificates, pins)
+		}
+	}
+	return
+}
+
+// spkiHash returns the base64 encoded SHA256 hash of a certificate's
+// SubjectPublicKeyInfo.  This is the same format as used by HPKP.
+func spkiHash(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// verifyPins tests that one of the certificates presented by a server has a
+// pinned SPKI hash.  Pinning an intermediate or root allows the server's
+// certificate to be renewed without updating the pins.
+func verifyPins(certs []*x509.Certificate, pins []string) error {
+	for _, cert := range certs {
+		hash := spkiHash(cert)
+		for _, pin := range pins {
+			if hash == pin {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: No certificate matches the pinned keys", errTLSPolicy)
+}
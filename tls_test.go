@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/crooks/yamn/config"
+)
+
+// testKeyPair returns a self-signed certificate and its key
+func testKeyPair(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.domain.foo"},
+		DNSNames:     []string{"mx.domain.foo"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
+// testCert returns a self-signed certificate for use in pinning tests
+func testCert(t *testing.T) *x509.Certificate {
+	return testKeyPair(t).Leaf
+}
+
+func TestTLSConfig(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSMinVersion = "1.2"
+	tests := []struct {
+		policy   string
+		insecure bool
+		required bool
+	}{
+		{tlsOpportunistic, true, false},
+		{tlsVerify, false, false},
+		{tlsRequire, false, true},
+	}
+	for _, test := range tests {
+		cfg.Mail.TLSPolicy = test.policy
+		conf, err := tlsConfig("mx.domain.foo")
+		if err != nil {
+			t.Fatalf("%s: %s", test.policy, err)
+		}
+		if conf.InsecureSkipVerify != test.insecure {
+			t.Errorf("%s: Expected InsecureSkipVerify=%v", test.policy, test.insecure)
+		}
+		if conf.MinVersion != tls.VersionTLS12 || conf.ServerName != "mx.domain.foo" {
+			t.Errorf("%s: Unexpected MinVersion or ServerName", test.policy)
+		}
+		if tlsRequired("mx.domain.foo") != test.required {
+			t.Errorf("%s: Expected tlsRequired=%v", test.policy, test.required)
+		}
+	}
+	cfg.Mail.TLSPolicy = "paranoid"
+	if _, err := tlsConfig("mx.domain.foo"); err == nil {
+		t.Error("Expected an error for an unknown TLS policy")
+	}
+	cfg.Mail.TLSPolicy = tlsVerify
+	cfg.Mail.TLSMinVersion = "0.9"
+	if _, err := tlsConfig("mx.domain.foo"); err == nil {
+		t.Error("Expected an error for an unknown TLS version")
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSPolicy = tlsOpportunistic
+	cfg.Mail.TLSMinVersion = "1.3"
+	cert := testCert(t)
+	other := testCert(t)
+	cfg.Mail.TLSPins = map[string][]string{"mx.domain.foo": {spkiHash(cert)}}
+	// Pinned hosts require TLS, regardless of policy
+	if !tlsRequired("mx.domain.foo") || tlsRequired("mx.domain.bar") {
+		t.Error("Expected TLS to be required only for the pinned host")
+	}
+	conf, err := tlsConfig("mx.domain.foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.VerifyConnection == nil {
+		t.Fatal("No pin verification for pinned host")
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{other, cert}}
+	if err := conf.VerifyConnection(cs); err != nil {
+		t.Errorf("Pinned certificate in chain rejected: %s", err)
+	}
+	cs.PeerCertificates = []*x509.Certificate{other}
+	if err := conf.VerifyConnection(cs); !errors.Is(err, errTLSPolicy) {
+		t.Errorf("Expected a TLS policy error for an unpinned key, got %v", err)
+	}
+}
+
+func TestUseStartTLS(t *testing.T) {
+	cfg = new(config.Config)
+	tests := []struct {
+		policy  string
+		offered bool
+		wanted  bool
+		upgrade bool
+		refused bool
+	}{
+		{tlsOpportunistic, true, false, false, false},
+		{tlsOpportunistic, true, true, true, false},
+		{tlsOpportunistic, false, true, false, false},
+		// Verify doesn't depend on the caller wanting TLS
+		{tlsVerify, true, false, true, false},
+		{tlsVerify, false, false, false, false},
+		{tlsRequire, true, false, true, false},
+		{tlsRequire, false, true, false, true},
+	}
+	for _, test := range tests {
+		cfg.Mail.TLSPolicy = test.policy
+		upgrade, err := useStartTLS("mx.domain.foo", test.offered, test.wanted)
+		if upgrade != test.upgrade {
+			t.Errorf("%+v: Expected upgrade=%v", test, test.upgrade)
+		}
+		if errors.Is(err, errTLSPolicy) != test.refused {
+			t.Errorf("%+v: Unexpected error: %v", test, err)
+		}
+	}
+	// Pinned hosts refuse plaintext regardless of policy
+	cfg.Mail.TLSPolicy = tlsOpportunistic
+	cfg.Mail.TLSPins = map[string][]string{"mx.domain.foo": {"pin"}}
+	if _, err := useStartTLS("mx.domain.foo", false, false); !errors.Is(err, errTLSPolicy) {
+		t.Errorf("Expected a TLS policy error for a pinned host, got %v", err)
+	}
+}
+
+func TestDialSMTPRequireTLS(t *testing.T) {
+	cfg = new(config.Config)
+	cfg.Mail.TLSPolicy = tlsRequire
+	cfg.Mail.TLSMinVersion = "1.2"
+	// The test server doesn't offer STARTTLS
+	s := testSMTPServer(t, func(msg *mail.Message) error {
+		return nil
+	})
+	_, err := dialSMTP("127.0.0.1", s.listener.Addr().String(), false, false)
+	if !errors.Is(err, errTLSPolicy) {
+		t.Errorf("Expected a TLS policy error, got %v", err)
+	}
+}
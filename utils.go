@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -18,6 +17,7 @@ import (
 	"github.com/Masterminds/log-go"
 	"github.com/crooks/yamn/crandom"
 	"github.com/crooks/yamn/linebreaker"
+	"github.com/crooks/yamn/packet"
 	"github.com/dchest/blake2s"
 	//"github.com/codahale/blake2"
 )
@@ -122,7 +122,11 @@ func fileTime(filename string) (t time.Time, err error) {
 
 // httpGet retrieves url and stores it in filename
 func httpGet(url, filename string) (err error) {
-	res, err := http.Get(url)
+	client, err := httpClient()
+	if err != nil {
+		return
+	}
+	res, err := client.Get(url)
 	if err != nil {
 		return
 	}
@@ -202,14 +206,39 @@ func popstr(s *[]string) (element string) {
 	return
 }
 
-// writeInternalHeader inserts a Yamn internal header containing the pooled
-// date.  This is useful for performing expiry on old messages.
-func writeInternalHeader(w io.Writer) {
-	dateHeader := fmt.Sprintf(
-		"Yamn-Pooled-Date: %s\n",
-		time.Now().Format(shortdate),
-	)
-	w.Write([]byte(dateHeader))
+// writeInternalHeader inserts the Yamn internal headers of a pool file.  The
+// pooled date is used to perform expiry on old messages so it's written
+// whenever it's known.  Other headers are only written when they're set.  The
+// headers are written in a single call so a failure is reported once.
+func writeInternalHeader(w io.Writer, h poolHeader) (err error) {
+	buf := new(bytes.Buffer)
+	if !h.pooled.IsZero() {
+		fmt.Fprintf(buf, "Yamn-Pooled-Date: %s\n", h.pooled.Format(shortdate))
+	}
+	if !h.release.IsZero() {
+		fmt.Fprintf(
+			buf,
+			"Yamn-Release-Date: %s\n",
+			h.release.UTC().Format(time.RFC3339),
+		)
+	}
+	if h.attempts > 0 {
+		fmt.Fprintf(buf, "Yamn-Attempts: %d\n", h.attempts)
+	}
+	if !h.next.IsZero() {
+		fmt.Fprintf(
+			buf,
+			"Yamn-Next-Attempt: %s\n",
+			h.next.UTC().Format(time.RFC3339),
+		)
+	}
+	if h.lastErr != "" {
+		// Errors can span lines but headers can't
+		lastErr := strings.Join(strings.Fields(h.lastErr), " ")
+		fmt.Fprintf(buf, "Yamn-Last-Error: %s\n", lastErr)
+	}
+	_, err = w.Write(buf.Bytes())
+	return
 }
 
 func writeMailHeaders(w io.Writer, sendTo string) {
@@ -231,7 +260,7 @@ func wrap64(writer io.Writer, b []byte, wrap int) {
 // armor converts a plain-byte Yamn message to a Base64 armored message with
 // cutmarks and header fields.
 func armor(w io.Writer, payload []byte) {
-	err := lenCheck(len(payload), messageBytes)
+	err := lenCheck(len(payload), packet.MessageBytes)
 	if err != nil {
 		panic(err)
 	}
@@ -310,6 +339,10 @@ func stripArmor(reader io.Reader) (payload []byte, err error) {
 			b64.WriteString(line)
 		} // End of switch
 	} // End of file scan
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
 	switch scanPhase {
 	case 0:
 		err = errors.New("no :: found on message")
@@ -317,6 +350,9 @@ func stripArmor(reader io.Reader) (payload []byte, err error) {
 	case 1:
 		err = errors.New("no Begin cutmarks found on message")
 		return
+	case 2, 3:
+		err = errors.New("no payload found on message")
+		return
 	case 4:
 		err = errors.New("no End cutmarks found on message")
 		return
@@ -330,12 +366,12 @@ func stripArmor(reader io.Reader) (payload []byte, err error) {
 	payload = payload[0:payloadLen]
 	// Validate payload length against stated length.
 	if statedLen != payloadLen {
-		err = fmt.Errorf("payload size doesn't match stated size. Stated=%d, Got=%d", statedLen, payloadLen)
+		err = fmt.Errorf("%w: payload size doesn't match stated size. Stated=%d, Got=%d", packet.ErrBadLength, statedLen, payloadLen)
 		return
 	}
 	// Validate payload length against packet format.
-	if payloadLen != messageBytes {
-		err = fmt.Errorf("payload size doesn't match stated size. Wanted=%d, Got=%d", messageBytes, payloadLen)
+	if payloadLen != packet.MessageBytes {
+		err = fmt.Errorf("%w: payload size doesn't match packet size. Wanted=%d, Got=%d", packet.ErrBadLength, packet.MessageBytes, payloadLen)
 		return
 	}
 	//digest := blake2.New(&blake2.Config{Size: 16})
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// pollInterval is how often the Maildir and inbound pool are processed
+	// when filesystem notifications are unavailable.
+	pollInterval = 60 * time.Second
+	// watchPollInterval is a safety net for events the watcher might miss,
+	// such as those lost when the kernel's event queue overflows.
+	watchPollInterval = 15 * time.Minute
+)
+
+// inboundWatcher signals when new files appear in the Maildir or the inbound
+// pool.  Bursts of events are coalesced into a single wake-up.
+type inboundWatcher struct {
+	watcher *fsnotify.Watcher
+	maildir string // The Maildir's new directory
+	pooldir string
+	wake    chan struct{}
+}
+
+// watchInbound returns a watcher for the Maildir and inbound pool
+func watchInbound() (w *inboundWatcher, err error) {
+	w = &inboundWatcher{
+		maildir: path.Clean(path.Join(cfg.Files.Maildir, "new")),
+		pooldir: path.Clean(cfg.Files.Pooldir),
+		wake:    make(chan struct{}, 1),
+	}
+	w.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	for _, dir := range []string{w.maildir, w.pooldir} {
+		if err = w.watcher.Add(dir); err != nil {
+			w.watcher.Close()
+			return
+		}
+	}
+	go w.run()
+	return
+}
+
+// run reads filesystem events until the watcher is closed
+func (w *inboundWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.relevant(event) {
+				w.signal()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost so process the dirs anyway
+			log.Warnf("Filesystem watcher error: %s", err)
+			w.signal()
+		}
+	}
+}
+
+// relevant tests if an event indicates a file awaiting processing.  Maildir
+// deliveries and inbound pool files are renamed into place so they're complete
+// when created.  Temporary pool files don't have an inbound prefix.
+func (w *inboundWatcher) relevant(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Create == 0 {
+		return false
+	}
+	dir, file := path.Split(event.Name)
+	switch path.Clean(dir) {
+	case w.maildir:
+		return !strings.HasPrefix(file, ".")
+	case w.pooldir:
+		return strings.HasPrefix(file, "i")
+	}
+	return false
+}
+
+// signal requests processing without blocking.  If a wake-up is already
+// pending, there's nothing more to do.
+func (w *inboundWatcher) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops watching for events
+func (w *inboundWatcher) close() error {
+	return w.watcher.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectWake tests if the watcher signals within a short time
+func expectWake(w *inboundWatcher, timeout time.Duration) bool {
+	select {
+	case <-w.wake:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestWatchInbound(t *testing.T) {
+	testPoolDirs(t)
+	cfg.Files.Maildir = path.Join(t.TempDir(), "Maildir")
+	for _, dir := range []string{"new", "tmp"} {
+		err := os.MkdirAll(path.Join(cfg.Files.Maildir, dir), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := watchInbound()
+	if err != nil {
+		t.Skipf("Filesystem notifications unavailable: %s", err)
+	}
+	defer w.close()
+
+	// Outbound pool files aren't processed by the server loop
+	err = os.WriteFile(path.Join(cfg.Files.Pooldir, "m1234"), []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectWake(w, 200*time.Millisecond) {
+		t.Error("Unexpected wake for an outbound pool file")
+	}
+
+	// Inbound packets are written to a temporary file and renamed
+	err = writeInboundToPool([]byte("foo"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expectWake(w, 5*time.Second) {
+		t.Error("No wake for an inbound pool file")
+	}
+	files, err := readDir(cfg.Files.Pooldir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f, "tmp") {
+			t.Errorf("Temporary file left in pool: %s", f)
+		}
+	}
+
+	// Maildir deliveries are written to tmp and renamed into new
+	tmpFile := path.Join(cfg.Files.Maildir, "tmp", "1234.host")
+	err = os.WriteFile(tmpFile, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drain any wake left over from the inbound pool file
+	expectWake(w, 200*time.Millisecond)
+	err = os.Rename(tmpFile, path.Join(cfg.Files.Maildir, "new", "1234.host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expectWake(w, 5*time.Second) {
+		t.Error("No wake for a Maildir delivery")
+	}
+}
+
+func TestUntilMidnight(t *testing.T) {
+	now := time.Date(2023, 12, 31, 23, 30, 0, 0, time.UTC)
+	if d := untilMidnight(now); d != 30*time.Minute {
+		t.Errorf("Expected=30m, Got=%s", d)
+	}
+	now = time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	if d := untilMidnight(now); d != 24*time.Hour {
+		t.Errorf("Expected=24h, Got=%s", d)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	stdflag "flag"
 	"fmt"
 	"io/ioutil"
 	stdlog "log"
@@ -88,8 +89,17 @@ func main() {
 	}
 
 	// Setup complete, time to do some work
-	if flag.Client {
+	if flag.Preview {
+		previewChain()
+	} else if flag.Client {
 		mixprep()
+	} else if stdflag.Arg(0) == "pool" {
+		// Positional arguments are only used by the pool commands
+		err = poolCommand(stdflag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else if flag.Stdin {
 		dir := maildir.Dir(cfg.Files.Maildir)
 		newmsg, err := dir.NewDelivery()
@@ -109,8 +119,18 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	} else if flag.Pinger {
+		err = runPinger()
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
 	} else if flag.Dummy {
 		injectDummy()
+	} else if flag.NewSURB {
+		newSURB()
+	} else if flag.Reply {
+		readReply()
 	} else if flag.Refresh {
 		fmt.Printf("Keyring refresh: from=%s, to=%s\n", cfg.Urls.Pubring, cfg.Files.Pubring)
 		httpGet(cfg.Urls.Pubring, cfg.Files.Pubring)